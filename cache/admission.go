@@ -0,0 +1,109 @@
+package cache
+
+import (
+	"sync"
+	"time"
+)
+
+// hash functions of the admission sketch
+const admissionHashes = 4
+
+// window of an admission filter created without one
+const defaultAdmissionWindow = time.Minute
+
+// cache a loaded value only once its key was loaded minHits times within window, minHits <= 1 caches every value
+// a scan of keys that are read once then no longer pushes hot keys out of the cache, at the price of minHits-1 more loads of every new hot key
+// the counts live in a small sketch sized by how many entries cacheBytes can hold, window <= 0 means a minute
+// counts start over sooner when so many keys were loaded within window that the sketch would admit keys by mistake
+// values set by hand, pushed by replicas or handed off by peers are always cached
+func WithAdmission(minHits int,window time.Duration)GroupOption{
+	return func(g *Group){
+		if minHits <= 1{
+			g.admission = nil
+			return
+		}
+		if window <= 0{
+			window = defaultAdmissionWindow
+		}
+		// a group can not hold more entries than the overhead of one fits in cacheBytes
+		g.admission = newAdmission(minHits,window,g.mainCache.cacheByte/DefaultHeapEntryOverhead)
+	}
+}
+
+// admission filter, a count-min sketch of the loads of every key that is cleared every window
+// counts are estimates: a key may be admitted early when its counters collide with those of other keys, never late
+type admission struct{
+	mu sync.Mutex
+	counters []uint8
+	mask uint64
+	minHits int
+	window time.Duration
+	reset time.Time // counters are cleared at the first load after it
+	loads int // loads counted since the counters were cleared
+	maxLoads int // counters are cleared after this many loads, about 2% of new keys are admitted early by then
+}
+
+func newAdmission(minHits int,window time.Duration,entries int64)*admission{
+	if minHits > 255{
+		minHits = 255
+	}
+	// most loaded keys are never cached, so the sketch has room for many more keys than the cache
+	size := int64(1) << 12
+	for size < entries*16 && size < 1<<24{
+		size <<= 1
+	}
+	return &admission{counters: make([]uint8,size),mask: uint64(size-1),minHits: minHits,window: window,maxLoads: int(size/8)}
+}
+
+// count a load of key and report if its value may be cached
+func (a *admission)admit(key string,now time.Time)bool{
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if now.After(a.reset) || a.loads >= a.maxLoads{
+		for i := range a.counters{
+			a.counters[i] = 0
+		}
+		a.reset = now.Add(a.window)
+		a.loads = 0
+	}
+	a.loads++
+	h := fnv64(key)
+	h1,h2 := h&0xffffffff,h>>32|1
+	var idx [admissionHashes]uint64
+	min := uint8(255)
+	for i := range idx{
+		idx[i] = (h1+uint64(i)*h2)&a.mask
+		if c := a.counters[idx[i]];c < min{
+			min = c
+		}
+	}
+	// only the smallest counters grow, so keys sharing a counter inflate each other less
+	if min < 255{
+		for _,j := range idx{
+			if a.counters[j] == min{
+				a.counters[j]++
+			}
+		}
+		min++
+	}
+	return int(min) >= a.minHits
+}
+
+// check if a loaded value of key may be cached, counting the load
+func (g *Group)admits(key string)bool{
+	if g.admission == nil || g.admission.admit(key,time.Now()){
+		return true
+	}
+	g.stats.admissionRejects.Add(1)
+	return false
+}
+
+// fnv-1a of s without allocating a hash.Hash
+func fnv64(s string)uint64{
+	h := uint64(14695981039346656037)
+	for i := 0;i < len(s);i++{
+		h ^= uint64(s[i])
+		h *= 1099511628211
+	}
+	return h
+}
@@ -0,0 +1,77 @@
+package cache
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdmission(t *testing.T) {
+	a := newAdmission(3, time.Minute, 100)
+	now := time.Now()
+	for i, expect := range []bool{false, false, true, true} {
+		if got := a.admit("Tom", now); got != expect {
+			t.Fatalf("load %d: expect admitted %v, got %v", i+1, expect, got)
+		}
+	}
+	if a.admit("Jack", now) {
+		t.Fatal("expect the counts of Tom not to admit Jack")
+	}
+	// counts start over every window
+	later := now.Add(2 * time.Minute)
+	if a.admit("Tom", later) || a.admit("Tom", later) || !a.admit("Tom", later) {
+		t.Fatal("expect Tom to need 3 loads again in the next window")
+	}
+}
+
+func TestGroupAdmission(t *testing.T) {
+	loads := 0
+	g := NewGroup("admitted", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		loads++
+		return []byte(db[key]), nil
+	}), WithAdmission(2, time.Minute))
+	for i := 0; i < 4; i++ {
+		if v, err := g.Get("Tom"); err != nil || v.String() != "630" {
+			t.Fatalf("expect 630, got %v", err)
+		}
+	}
+	// loaded twice before it was cached
+	if stats := g.Stats(); loads != 2 || stats.AdmissionRejects != 1 || stats.CacheHits != 2 {
+		t.Fatalf("expect 2 loads and 2 hits, got %d loads %+v", loads, stats)
+	}
+	// values set by hand skip admission
+	g.Set("Sam", []byte("567"))
+	if _, ok := g.mainCache.get("Sam"); !ok {
+		t.Fatal("expect Sam cached")
+	}
+}
+
+// a scan of keys read once between reads of a hot set: without admission the scan flushes the hot keys every round
+func TestAdmissionHitRatio(t *testing.T) {
+	value := []byte(strings.Repeat("x", 100))
+	getter := GetterFunc(func(key string) ([]byte, error) { return value, nil })
+	ratio := func(opts ...GroupOption) float64 {
+		// room for about 60 entries
+		g := NewGroup("hitratio", 60*110, getter, append(opts, WithEntryOverhead(0))...)
+		scanned := 0
+		for round := 0; round < 20; round++ {
+			for i := 0; i < 50; i++ {
+				g.Get(fmt.Sprintf("hot%02d", i))
+			}
+			for i := 0; i < 100; i++ {
+				g.Get(fmt.Sprintf("scan%d", scanned))
+				scanned++
+			}
+		}
+		stats := g.Stats()
+		return float64(stats.CacheHits) / float64(stats.Gets)
+	}
+	without := ratio()
+	with := ratio(WithAdmission(2, time.Minute))
+	t.Logf("hit ratio without admission %.2f, with %.2f", without, with)
+	// hot keys are a third of the gets and hit from the third round on, at best 0.3
+	if without > 0.05 || with < 0.25 {
+		t.Fatalf("expect admission to keep the hot keys, got hit ratio %.2f without and %.2f with", without, with)
+	}
+}
@@ -0,0 +1,246 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// authenticators return this error when a request carries no credentials they understand
+var ErrNoCredentials = errors.New("no credentials")
+
+// Authenticator identifies the caller of an api request
+type Authenticator interface{
+	// return the principal that sent r, ErrNoCredentials if r has no credentials for this authenticator
+	// any other error means the credentials are invalid
+	Authenticate(r *http.Request)(principal string,err error)
+}
+
+// AuthenticatorFunc lets a function be used as an Authenticator
+type AuthenticatorFunc func(r *http.Request)(string,error)
+
+func (f AuthenticatorFunc)Authenticate(r *http.Request)(string,error){
+	return f(r)
+}
+
+// try authenticators in order, the first one that finds credentials decides
+func ChainAuth(auths ...Authenticator)Authenticator{
+	return AuthenticatorFunc(func(r *http.Request)(string,error){
+		for _,auth := range auths{
+			principal,err := auth.Authenticate(r)
+			if err != ErrNoCredentials{
+				return principal,err
+			}
+		}
+		return "",ErrNoCredentials
+	})
+}
+
+// authenticate "Authorization: Bearer <token>" with static tokens, tokens maps every token to its principal
+func NewTokenAuth(tokens map[string]string)Authenticator{
+	// copied, so the caller can not change the tokens behind our back
+	known := make(map[string]string,len(tokens))
+	for token,principal := range tokens{
+		known[token] = principal
+	}
+	return AuthenticatorFunc(func(r *http.Request)(string,error){
+		header := r.Header.Get("Authorization")
+		if !strings.HasPrefix(header,"Bearer "){
+			return "",ErrNoCredentials
+		}
+		token := strings.TrimPrefix(header,"Bearer ")
+		for t,principal := range known{
+			// compare every token in constant time, so timing does not leak how much of a token matched
+			if subtle.ConstantTimeCompare([]byte(t),[]byte(token)) == 1{
+				return principal,nil
+			}
+		}
+		return "",errors.New("unknown token")
+	})
+}
+
+const (
+	// authorization scheme of signed requests: "GOCACHE-HMAC <key id>:<signature>"
+	hmacScheme = "GOCACHE-HMAC "
+	// unix time in seconds the request was signed at
+	hmacDateHeader = "X-Gocache-Date"
+	// signed requests older or newer than this are rejected
+	hmacMaxSkew = 5*time.Minute
+)
+
+// authenticate requests signed with SignRequest, keys maps every key id to its secret
+// the key id is the principal
+func NewHMACAuth(keys map[string][]byte)Authenticator{
+	known := make(map[string][]byte,len(keys))
+	for id,secret := range keys{
+		known[id] = secret
+	}
+	return AuthenticatorFunc(func(r *http.Request)(string,error){
+		header := r.Header.Get("Authorization")
+		if !strings.HasPrefix(header,hmacScheme){
+			return "",ErrNoCredentials
+		}
+		id,signature,ok := strings.Cut(strings.TrimPrefix(header,hmacScheme),":")
+		if !ok{
+			return "",errors.New("malformed signature")
+		}
+		secret,ok := known[id]
+		if !ok{
+			return "",fmt.Errorf("unknown key %q",id)
+		}
+		date := r.Header.Get(hmacDateHeader)
+		if err := checkSignedAt(date,time.Now(),hmacMaxSkew);err != nil{
+			return "",err
+		}
+		body,err := readBody(r)
+		if err != nil{
+			return "",err
+		}
+		expect := signature256(secret,canonicalRequest(r.Method,r.URL.RequestURI(),date,hashBody(body)))
+		if !hmac.Equal([]byte(expect),[]byte(signature)){
+			return "",errors.New("invalid signature")
+		}
+		return id,nil
+	})
+}
+
+// sign r for NewHMACAuth with the key id and secret, the body of r is read and replaced
+func SignRequest(r *http.Request,id string,secret []byte)error{
+	body,err := readBody(r)
+	if err != nil{
+		return err
+	}
+	date := strconv.FormatInt(time.Now().Unix(),10)
+	r.Header.Set(hmacDateHeader,date)
+	r.Header.Set("Authorization",hmacScheme+id+":"+signature256(secret,canonicalRequest(r.Method,r.URL.RequestURI(),date,hashBody(body))))
+	return nil
+}
+
+// check the signing time of a request is within maxSkew of now
+func checkSignedAt(date string,now time.Time,maxSkew time.Duration)error{
+	sec,err := strconv.ParseInt(date,10,64)
+	if err != nil{
+		return fmt.Errorf("invalid %s header",hmacDateHeader)
+	}
+	if skew := now.Sub(time.Unix(sec,0));skew > maxSkew || skew < -maxSkew{
+		return errors.New("signature expired")
+	}
+	return nil
+}
+
+// the part of a request a signature covers, like method, uri, date and body hash
+func canonicalRequest(parts ...string)string{
+	return strings.Join(parts,"\n")
+}
+
+func hashBody(body []byte)string{
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+func signature256(secret []byte,canonical string)string{
+	mac := hmac.New(sha256.New,secret)
+	mac.Write([]byte(canonical))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// read the whole body of r and put it back, so handlers can still read it
+func readBody(r *http.Request)([]byte,error){
+	if r.Body == nil || r.Body == http.NoBody{
+		return nil,nil
+	}
+	body,err := io.ReadAll(io.LimitReader(r.Body,maxAPIValueBytes+1))
+	r.Body.Close()
+	if err != nil{
+		return nil,err
+	}
+	if len(body) > maxAPIValueBytes{
+		return nil,errors.New("request body too large")
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return body,nil
+}
+
+// Permission is what a principal may do with a group, every level includes the ones below it
+type Permission int
+
+const (
+	PermRead Permission = iota+1 // get values
+	PermWrite // set and delete values
+	PermAdmin // list groups and read stats
+)
+
+// parse "read", "write" or "admin"
+func ParsePermission(s string)(Permission,error){
+	switch s{
+	case "read":
+		return PermRead,nil
+	case "write":
+		return PermWrite,nil
+	case "admin":
+		return PermAdmin,nil
+	}
+	return 0,fmt.Errorf("unknown permission %q",s)
+}
+
+func (p Permission)String()string{
+	switch p{
+	case PermRead:
+		return "read"
+	case PermWrite:
+		return "write"
+	case PermAdmin:
+		return "admin"
+	}
+	return "none"
+}
+
+// group name and principal that match every group and every authenticated principal in an ACL
+const AnyGroup = "*"
+const AnyPrincipal = "*"
+
+// ACL maps principals to the groups they may use and how
+type ACL struct{
+	mu sync.RWMutex
+	rules map[string]map[string]Permission // principal -> group -> permission
+}
+
+func NewACL()*ACL{
+	return &ACL{rules: make(map[string]map[string]Permission)}
+}
+
+// let principal use group with perm, AnyGroup and AnyPrincipal match everything
+func (a *ACL)Allow(principal string,group string,perm Permission){
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.rules[principal] == nil{
+		a.rules[principal] = make(map[string]Permission)
+	}
+	if perm > a.rules[principal][group]{
+		a.rules[principal][group] = perm
+	}
+}
+
+// check if principal may use group with perm
+func (a *ACL)Allowed(principal string,group string,perm Permission)bool{
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for _,p := range []string{principal,AnyPrincipal}{
+		rules := a.rules[p]
+		if rules[group] >= perm || rules[AnyGroup] >= perm{
+			return true
+		}
+	}
+	return false
+}
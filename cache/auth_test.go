@@ -0,0 +1,116 @@
+package cache
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestACL(t *testing.T) {
+	acl := NewACL()
+	acl.Allow("alice", "scores", PermWrite)
+	acl.Allow("ops", AnyGroup, PermAdmin)
+	acl.Allow(AnyPrincipal, "public", PermRead)
+
+	cases := []struct {
+		principal, group string
+		perm             Permission
+		allowed          bool
+	}{
+		{"alice", "scores", PermRead, true},
+		{"alice", "scores", PermWrite, true},
+		{"alice", "scores", PermAdmin, false},
+		{"alice", "ratings", PermRead, false},
+		{"ops", "ratings", PermAdmin, true},
+		{"bob", "public", PermRead, true},
+		{"bob", "public", PermWrite, false},
+	}
+	for _, c := range cases {
+		if got := acl.Allowed(c.principal, c.group, c.perm); got != c.allowed {
+			t.Errorf("%s %s on %s: expect %v, got %v", c.principal, c.perm, c.group, c.allowed, got)
+		}
+	}
+}
+
+func TestAPIAuth(t *testing.T) {
+	g := NewGroup("authz", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		return []byte(db[key]), nil
+	}))
+	secret := []byte("s3cret")
+	auth := ChainAuth(
+		NewTokenAuth(map[string]string{"t-alice": "alice", "t-bob": "bob"}),
+		NewHMACAuth(map[string][]byte{"svc": secret}),
+	)
+	acl := NewACL()
+	acl.Allow("alice", "authz", PermRead)
+	acl.Allow("bob", "authz", PermWrite)
+	acl.Allow("svc", AnyGroup, PermAdmin)
+	server, err := NewAPIServer("", ":0", g, WithAuth(auth, acl))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := server.httpServer.Handler
+
+	// send a request with a bearer token, or signed by svc when token is "svc"
+	send := func(method string, target string, body string, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		switch token {
+		case "":
+		case "svc":
+			if err := SignRequest(r, "svc", secret); err != nil {
+				t.Fatal(err)
+			}
+		default:
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	cases := []struct {
+		method, target, body, token string
+		code                        int
+	}{
+		{"GET", "/api?key=Tom", "", "", http.StatusUnauthorized},
+		{"GET", "/api?key=Tom", "", "t-mallory", http.StatusUnauthorized},
+		{"GET", "/api?key=Tom", "", "t-alice", http.StatusOK},
+		{"PUT", "/api?key=Tom", "1", "t-alice", http.StatusForbidden},
+		{"GET", "/api?key=Tom&group=unknown", "", "t-alice", http.StatusForbidden},
+		{"PUT", "/api?key=Tom", "1", "t-bob", http.StatusNoContent},
+		{"DELETE", "/api?key=Tom", "", "svc", http.StatusNoContent},
+	}
+	for _, c := range cases {
+		if w := send(c.method, c.target, c.body, c.token); w.Code != c.code {
+			t.Fatalf("%s %s as %q: expect %d, got %d %q", c.method, c.target, c.token, c.code, w.Code, w.Body.String())
+		}
+	}
+
+	// stats only show groups the caller administers
+	for token, expect := range map[string]bool{"svc": true, "t-alice": false} {
+		var stats map[string]Stats
+		if err := json.Unmarshal(send("GET", "/api/stats", "", token).Body.Bytes(), &stats); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := stats["authz"]; ok != expect {
+			t.Fatalf("%s: expect authz in stats %v, got %v", token, expect, stats)
+		}
+	}
+
+	// a signature does not cover a changed body, or a request signed too long ago
+	r := httptest.NewRequest("PUT", "/api?key=Tom", strings.NewReader("1"))
+	SignRequest(r, "svc", secret)
+	r.Body = http.NoBody
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expect tampered request to be rejected, got %d", w.Code)
+	}
+	if err := checkSignedAt(strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10), time.Now(), hmacMaxSkew); err == nil {
+		t.Fatal("expect old signature to be rejected")
+	}
+}
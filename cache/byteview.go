@@ -1,26 +1,82 @@
 package cache
 
+import (
+	"bytes"
+	"io"
+)
+
 // So the ByteView is what we store in cache as value
 // This is a read only struct, since we don't want the value in cache be modifed from outside
 type ByteView struct{
 	// we store value in bytes arr
 	b []byte
+	// set when b is compressed, only cached values are, Group.Get always returns plain bytes
+	codec Compressor
 }
 
 // this struct must implement Len method to be Value interface
+// a compressed value is charged by its compressed size
 func(v ByteView)Len()int{
 	return len(v.b)
 }
 
 // return a clone
+// it copies the whole value on every call, prefer WriteTo, Reader, At or Slice to read large values
 func(v ByteView)ByteSlice()[]byte{
 	return cloneByte(v.b)
 }
-// return a string
+// return a string, a copy like ByteSlice
 func(v ByteView)String()string{
 	return string(v.b)
 }
 
+// write the value to w without copying it, implements io.WriterTo
+func(v ByteView)WriteTo(w io.Writer)(int64,error){
+	n,err := w.Write(v.b)
+	return int64(n),err
+}
+
+// reader over the value, it reads the cached bytes in place
+func(v ByteView)Reader()io.ReadSeeker{
+	return bytes.NewReader(v.b)
+}
+
+// byte at index i, panics if i is out of range like indexing a slice
+func(v ByteView)At(i int)byte{
+	return v.b[i]
+}
+
+// view of the bytes from index from up to to, it shares memory with v
+func(v ByteView)Slice(from int,to int)ByteView{
+	return ByteView{b: v.b[from:to]}
+}
+
+// view of the bytes from index from to the end, it shares memory with v
+func(v ByteView)SliceFrom(from int)ByteView{
+	return ByteView{b: v.b[from:]}
+}
+
+// copy the value into dest, return the number of bytes copied
+func(v ByteView)Copy(dest []byte)int{
+	return copy(dest,v.b)
+}
+
+// check if both views hold the same bytes
+func(v ByteView)Equal(other ByteView)bool{
+	return bytes.Equal(v.b,other.b)
+}
+
+// check if the view holds the bytes of b
+func(v ByteView)EqualBytes(b []byte)bool{
+	return bytes.Equal(v.b,b)
+}
+
+// check if the view holds the bytes of s, without converting either of them
+func(v ByteView)EqualString(s string)bool{
+	// the compiler compares without allocating the string
+	return string(v.b) == s
+}
+
 // internal clone method
 func cloneByte(b[]byte)[]byte{
 	c := make([]byte,len(b))
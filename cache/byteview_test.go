@@ -0,0 +1,95 @@
+package cache
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestByteViewReads(t *testing.T) {
+	v := ByteView{b: []byte("gocache")}
+	var buf bytes.Buffer
+	if n, err := v.WriteTo(&buf); err != nil || n != 7 || buf.String() != "gocache" {
+		t.Fatalf("expect gocache written, got %q %d %v", buf.String(), n, err)
+	}
+	if b, _ := io.ReadAll(v.Reader()); string(b) != "gocache" {
+		t.Fatalf("expect reader to read gocache, got %q", b)
+	}
+	if v.At(2) != 'c' || !v.Slice(2, 5).EqualString("cac") || !v.SliceFrom(5).EqualBytes([]byte("he")) {
+		t.Fatal("expect indexing and slicing to match the value")
+	}
+	dest := make([]byte, 2)
+	if n := v.Copy(dest); n != 2 || string(dest) != "go" {
+		t.Fatalf("expect go copied, got %q", dest)
+	}
+	if !v.Equal(ByteView{b: []byte("gocache")}) || v.Equal(ByteView{b: []byte("gocachf")}) || v.EqualString("go") {
+		t.Fatal("unexpected equality")
+	}
+	// slices share memory but the view can not be changed through them
+	if s := v.Slice(0, 2).ByteSlice(); &s[0] == &v.b[0] {
+		t.Fatal("expect ByteSlice to copy")
+	}
+}
+
+// response writer that throws the body away, so benchmarks only count allocations of the handler
+type discardWriter struct {
+	header http.Header
+}
+
+func (w *discardWriter) Header() http.Header         { return w.header }
+func (w *discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *discardWriter) WriteHeader(int)             {}
+
+var largeValue = bytes.Repeat([]byte("gocache "), 128<<10) // 1MB
+
+func BenchmarkByteViewRead(b *testing.B) {
+	v := ByteView{b: largeValue}
+	b.Run("ByteSlice", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			io.Discard.Write(v.ByteSlice())
+		}
+	})
+	b.Run("String", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			io.WriteString(io.Discard, v.String())
+		}
+	})
+	b.Run("WriteTo", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			v.WriteTo(io.Discard)
+		}
+	})
+	b.Run("EqualString", func(b *testing.B) {
+		s := string(largeValue)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			v.EqualString(s)
+		}
+	})
+}
+
+// serving a cached 1MB value allocates a small constant amount, not the size of the value
+func BenchmarkAPIGetLargeValue(b *testing.B) {
+	g := NewGroup("bench-large", 4<<20, GetterFunc(func(key string) ([]byte, error) {
+		return largeValue, nil
+	}))
+	g.Set("large", largeValue)
+	server, err := NewAPIServer("", ":0", g)
+	if err != nil {
+		b.Fatal(err)
+	}
+	handler := server.httpServer.Handler
+	r := httptest.NewRequest(http.MethodGet, "/api?group=bench-large&key=large", nil)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(largeValue)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		handler.ServeHTTP(&discardWriter{header: make(http.Header)}, r)
+	}
+}
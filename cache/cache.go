@@ -1,39 +1,188 @@
 package cache
 
 import (
-	"cache/lru"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // the cache it self is concurrent
-// inorder to secure the data, we wrap the lru cache with a thread safe struct cache
+// inorder to secure the data, we wrap the storage with a thread safe struct cache
 type cache struct{
 	// lock for thread safety
 	mu sync.Mutex
-	lru *lru.Cache
+	store storage // created on the first add, nil until then
 	cacheByte int64
+	slab bool // keep entries in a slab instead of a lru list on the heap
+	overhead int64 // bytes charged per entry on top of key and value, negative means the default of the storage
+	used atomic.Int64 // bytes of the storage, readable without the lock for the memory budget
+	preallocated atomic.Bool // the storage took all its bytes when it was created, evicting entries frees none of them
+	onEvict func(key string,value ByteView,reason EvictReason) // called with removed entries after the lock is released, nil to not track them
+	removed []removedEntry // entries removed while the lock is held
+}
+
+// an entry that left the storage, reported to onEvict once the lock is released
+type removedEntry struct{
+	key string
+	value ByteView
+	reason EvictReason
 }
 
 // add new kv into lru cache
 func(c *cache)add(key string, value ByteView){
+	c.addWithExpire(key,value,time.Time{})
+}
+
+// add new kv into lru cache which expires at given time, zero time means never expire
+func(c *cache)addWithExpire(key string, value ByteView, expire time.Time){
 	c.mu.Lock()
-	defer c.mu.Unlock()
-	if c.lru == nil{
-		c.lru = lru.New(c.cacheByte,nil)
+	if c.store == nil{
+		if c.slab && c.cacheByte > 0{
+			c.store = newSlabStorage(c.cacheByte,c.entryOverhead(DefaultSlabEntryOverhead))
+			// the whole slab is allocated up front, so the memory budget is charged all of it
+			c.used.Store(c.cacheByte)
+			c.preallocated.Store(true)
+		}else{
+			c.store = newLRUStorage(c.cacheByte,c.entryOverhead(DefaultHeapEntryOverhead))
+		}
+		if c.onEvict != nil{
+			c.store.setOnRemoved(func(key string,value ByteView,reason EvictReason){
+				c.removed = append(c.removed, removedEntry{key: key,value: value,reason: reason})
+			})
+		}
+	}
+	c.store.addWithExpire(key,value,expire)
+	c.account()
+	c.unlock()
+	enforceMemoryBudget()
+}
+
+func(c *cache)entryOverhead(def int64)int64{
+	if c.overhead < 0{
+		return def
+	}
+	return c.overhead
+}
+
+// publish the bytes of the storage after it changed, the lock must be held
+func(c *cache)account(){
+	if c.preallocated.Load(){
+		return
+	}
+	_,bytes := c.store.stats()
+	c.used.Store(bytes)
+}
+
+// release the lock, then report the entries removed while it was held
+func(c *cache)unlock(){
+	removed := c.removed
+	c.removed = nil
+	c.mu.Unlock()
+	for _,e := range removed{
+		c.onEvict(e.key,e.value,e.reason)
 	}
-	c.lru.Add(key,value)
 }
+
 // get value from lru
 func(c *cache)get(key string)(value ByteView,ok bool){
+	c.mu.Lock()
+	if c.store == nil{
+		c.mu.Unlock()
+		return
+	}
+	value,ok = c.store.get(key)
+	// expired entries are removed by reads
+	c.account()
+	c.unlock()
+	return
+}
+
+// remove key from lru, return true if it was cached
+func(c *cache)remove(key string)bool{
+	c.mu.Lock()
+	if c.store == nil{
+		c.mu.Unlock()
+		return false
+	}
+	ok := c.store.remove(key)
+	c.account()
+	c.unlock()
+	return ok
+}
+
+// evict the oldest entry, return false if there was none
+func(c *cache)removeOldest()bool{
+	c.mu.Lock()
+	if c.store == nil{
+		c.mu.Unlock()
+		return false
+	}
+	if items,_ := c.store.stats();items == 0{
+		c.mu.Unlock()
+		return false
+	}
+	c.store.removeOldest()
+	c.account()
+	c.unlock()
+	return true
+}
+
+// last time the entry that is evicted next was used, false if the cache is empty
+func(c *cache)oldestUse()(time.Time,bool){
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	if c.store == nil{
+		return time.Time{},false
+	}
+	return c.store.oldestUse()
+}
 
-	if c.lru == nil{
+// change expire time of a cached key, return false if key is not cached
+func(c *cache)touch(key string, expire time.Time)bool{
+	c.mu.Lock()
+	if c.store == nil{
+		c.mu.Unlock()
+		return false
+	}
+	ok := c.store.touch(key,expire)
+	c.account()
+	c.unlock()
+	return ok
+}
+
+// check if key is cached without changing its recency
+func(c *cache)contains(key string)bool{
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.store != nil && c.store.contains(key)
+}
+
+// get value and expire time of key without changing its recency
+func(c *cache)peek(key string)(value ByteView,expire time.Time,ok bool){
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.store == nil{
 		return
 	}
-	if v,ok := c.lru.Get(key);ok{
-		return v.(ByteView),ok
+	return c.store.peek(key)
+}
+
+// cached keys, most recently used first
+func(c *cache)keys()[]string{
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.store == nil{
+		return nil
 	}
-	return 
+	return c.store.keys()
 }
 
+// number of entries and used bytes of lru
+func(c *cache)stats()(items int,bytes int64){
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.store == nil{
+		return
+	}
+	return c.store.stats()
+}
@@ -0,0 +1,75 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+
+	"github.com/ugorji/go/codec"
+	"google.golang.org/protobuf/proto"
+)
+
+// JSONCodec encodes values with encoding/json
+type JSONCodec[T any] struct{}
+
+func (JSONCodec[T])Encode(v T)([]byte,error){
+	return json.Marshal(v)
+}
+
+func (JSONCodec[T])Decode(b []byte)(T,error){
+	var v T
+	err := json.Unmarshal(b,&v)
+	return v,err
+}
+
+// GobCodec encodes values with encoding/gob, every value carries its type description so it is larger than json for small values
+type GobCodec[T any] struct{}
+
+func (GobCodec[T])Encode(v T)([]byte,error){
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v);err != nil{
+		return nil,err
+	}
+	return buf.Bytes(),nil
+}
+
+func (GobCodec[T])Decode(b []byte)(T,error){
+	var v T
+	err := gob.NewDecoder(bytes.NewReader(b)).Decode(&v)
+	return v,err
+}
+
+// ProtoCodec encodes protobuf messages, T is the pointer type of a generated message like *pb.User
+type ProtoCodec[T proto.Message] struct{}
+
+func (ProtoCodec[T])Encode(v T)([]byte,error){
+	return proto.Marshal(v)
+}
+
+func (ProtoCodec[T])Decode(b []byte)(T,error){
+	// generated messages describe their type even as nil pointers
+	var zero T
+	v := zero.ProtoReflect().New().Interface().(T)
+	if err := proto.Unmarshal(b,v);err != nil{
+		return zero,err
+	}
+	return v,nil
+}
+
+// shared by every MsgpackCodec, handles are safe for concurrent use once configured
+var msgpackHandle = &codec.MsgpackHandle{WriteExt: true}
+
+// MsgpackCodec encodes values with msgpack, struct fields use their `codec` or `json` tags
+type MsgpackCodec[T any] struct{}
+
+func (MsgpackCodec[T])Encode(v T)([]byte,error){
+	var b []byte
+	err := codec.NewEncoderBytes(&b,msgpackHandle).Encode(v)
+	return b,err
+}
+
+func (MsgpackCodec[T])Decode(b []byte)(T,error){
+	var v T
+	err := codec.NewDecoderBytes(b,msgpackHandle).Decode(&v)
+	return v,err
+}
@@ -0,0 +1,292 @@
+package cache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compressor shrinks values before they are cached, and before they are sent to peers that accept it
+type Compressor interface{
+	Name() string // content coding of the compressed bytes on the wire, like "gzip"
+	Compress(b []byte)([]byte,error)
+	Decompress(b []byte)([]byte,error)
+}
+
+// largest value the included compressors decompress, so a small value from a peer can not expand without bound
+const maxDecompressedBytes = 256<<20
+
+var(
+	compressorsMu sync.RWMutex
+	compressors = make(map[string]Compressor) // compressors peers may send, by name
+)
+
+func init(){
+	RegisterCompressor(NewGzipCompressor(gzip.DefaultCompression))
+	RegisterCompressor(NewDeflateCompressor(zlib.DefaultCompression))
+	RegisterCompressor(NewSnappyCompressor())
+	RegisterCompressor(NewZstdCompressor(3))
+}
+
+// make values compressed with c readable when a peer sends them
+// gzip, deflate, snappy and zstd are registered already, a compressor replaces the one registered with the same name
+func RegisterCompressor(c Compressor){
+	compressorsMu.Lock()
+	defer compressorsMu.Unlock()
+	compressors[c.Name()] = c
+}
+
+// registered compressor with the given name
+func CompressorByName(name string)(Compressor,bool){
+	compressorsMu.RLock()
+	defer compressorsMu.RUnlock()
+	c,ok := compressors[name]
+	return c,ok
+}
+
+// names of every registered compressor, sent as Accept-Encoding to peers
+func compressorNames()string{
+	compressorsMu.RLock()
+	names := make([]string,0,len(compressors))
+	for name := range compressors{
+		names = append(names, name)
+	}
+	compressorsMu.RUnlock()
+	sort.Strings(names)
+	return strings.Join(names,", ")
+}
+
+// check if an Accept-Encoding header allows coding, codings with q=0 are refused
+func acceptsEncoding(header string,coding string)bool{
+	for _,part := range strings.Split(header,","){
+		name,params,_ := strings.Cut(part,";")
+		if name = strings.TrimSpace(name);!strings.EqualFold(name,coding) && name != "*"{
+			continue
+		}
+		if params = strings.TrimSpace(params);strings.HasPrefix(params,"q="){
+			q,err := strconv.ParseFloat(strings.TrimPrefix(params,"q="),64)
+			return err == nil && q > 0
+		}
+		return true
+	}
+	return false
+}
+
+// compress values with the writer of a stdlib format, writers are pooled since they are expensive to create
+type streamCompressor struct{
+	name string
+	writers sync.Pool
+	newReader func(r io.Reader)(io.ReadCloser,error)
+}
+
+func (c *streamCompressor)Name()string{
+	return c.name
+}
+
+func (c *streamCompressor)Compress(b []byte)([]byte,error){
+	var buf bytes.Buffer
+	w := c.writers.Get().(interface{
+		io.WriteCloser
+		Reset(io.Writer)
+	})
+	defer c.writers.Put(w)
+	w.Reset(&buf)
+	if _,err := w.Write(b);err != nil{
+		return nil,err
+	}
+	if err := w.Close();err != nil{
+		return nil,err
+	}
+	// the buffer grew in steps, a copy charges the cache exactly what it holds
+	return cloneByte(buf.Bytes()),nil
+}
+
+func (c *streamCompressor)Decompress(b []byte)([]byte,error){
+	r,err := c.newReader(bytes.NewReader(b))
+	if err != nil{
+		return nil,err
+	}
+	defer r.Close()
+	b,err = io.ReadAll(io.LimitReader(r,maxDecompressedBytes+1))
+	if err != nil{
+		return nil,err
+	}
+	if len(b) > maxDecompressedBytes{
+		return nil,errDecompressedTooLarge(c.name)
+	}
+	return b,nil
+}
+
+func errDecompressedTooLarge(name string)error{
+	return fmt.Errorf("%s value decompresses to more than %d bytes: %w",name,maxDecompressedBytes,ErrValueTooLarge)
+}
+
+// gzip with the given level, like gzip.BestSpeed, an invalid level uses the default
+func NewGzipCompressor(level int)Compressor{
+	if _,err := gzip.NewWriterLevel(nil,level);err != nil{
+		level = gzip.DefaultCompression
+	}
+	c := &streamCompressor{name: "gzip",newReader: func(r io.Reader)(io.ReadCloser,error){
+		return gzip.NewReader(r)
+	}}
+	c.writers.New = func()interface{}{
+		w,_ := gzip.NewWriterLevel(nil,level)
+		return w
+	}
+	return c
+}
+
+// zlib wrapped deflate with the given level, which is what "deflate" means in http
+func NewDeflateCompressor(level int)Compressor{
+	if _,err := zlib.NewWriterLevel(nil,level);err != nil{
+		level = zlib.DefaultCompression
+	}
+	c := &streamCompressor{name: "deflate",newReader: zlib.NewReader}
+	c.writers.New = func()interface{}{
+		w,_ := zlib.NewWriterLevel(nil,level)
+		return w
+	}
+	return c
+}
+
+// snappy block format, fast with a lower ratio than the others, a good fit for values read often
+func NewSnappyCompressor()Compressor{
+	return snappyCompressor{}
+}
+
+type snappyCompressor struct{}
+
+func (snappyCompressor)Name()string{
+	return "snappy"
+}
+
+func (snappyCompressor)Compress(b []byte)([]byte,error){
+	return snappy.Encode(nil,b),nil
+}
+
+func (snappyCompressor)Decompress(b []byte)([]byte,error){
+	// the size is in the header, so a value too large is refused before anything is allocated
+	n,err := snappy.DecodedLen(b)
+	if err != nil{
+		return nil,err
+	}
+	if n > maxDecompressedBytes{
+		return nil,errDecompressedTooLarge("snappy")
+	}
+	return snappy.Decode(nil,b)
+}
+
+// zstd with the given level from 1 (fastest) to 22 (smallest), mapped to the closest level the encoder has
+// the encoder and decoder are shared, both are safe for concurrent use
+func NewZstdCompressor(level int)Compressor{
+	return &zstdCompressor{level: zstd.EncoderLevelFromZstd(level)}
+}
+
+type zstdCompressor struct{
+	level zstd.EncoderLevel
+	once sync.Once
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+	err error
+}
+
+func (c *zstdCompressor)Name()string{
+	return "zstd"
+}
+
+// encoder and decoder are created on first use, they hold buffers we do not want in every process
+func (c *zstdCompressor)init()error{
+	c.once.Do(func(){
+		c.encoder,c.err = zstd.NewWriter(nil,zstd.WithEncoderLevel(c.level),zstd.WithEncoderConcurrency(1))
+		if c.err != nil{
+			return
+		}
+		c.decoder,c.err = zstd.NewReader(nil,zstd.WithDecoderConcurrency(0),zstd.WithDecoderMaxMemory(maxDecompressedBytes))
+	})
+	return c.err
+}
+
+func (c *zstdCompressor)Compress(b []byte)([]byte,error){
+	if err := c.init();err != nil{
+		return nil,err
+	}
+	return c.encoder.EncodeAll(b,nil),nil
+}
+
+func (c *zstdCompressor)Decompress(b []byte)([]byte,error){
+	if err := c.init();err != nil{
+		return nil,err
+	}
+	out,err := c.decoder.DecodeAll(b,nil)
+	if err == zstd.ErrDecoderSizeExceeded{
+		return nil,errDecompressedTooLarge("zstd")
+	}
+	return out,err
+}
+
+// compress cached values of at least minBytes with c, values that do not shrink are kept as they are
+// values are charged against the cache budget by their compressed size, and decompressed on every read
+// peers that accept the encoding get the compressed bytes as they are, c is registered so peers can read it
+func WithCompression(c Compressor,minBytes int)GroupOption{
+	return func(g *Group){
+		g.compressor,g.compressMin = c,minBytes
+		if c != nil{
+			RegisterCompressor(c)
+		}
+	}
+}
+
+// the form value is cached in, compressed if the group compresses and it is worth it
+func (g *Group)compress(value ByteView)ByteView{
+	if g.compressor == nil || value.codec != nil || value.Len() < g.compressMin{
+		return value
+	}
+	b,err := g.compressor.Compress(value.b)
+	if err != nil{
+		log.Println("[GeeCache] Failed to compress value", err)
+		return value
+	}
+	if len(b) >= value.Len(){
+		return value
+	}
+	return ByteView{b: b,codec: g.compressor}
+}
+
+// plain bytes of a cached value
+func (v ByteView)decompressed()(ByteView,error){
+	if v.codec == nil{
+		return v,nil
+	}
+	b,err := v.codec.Decompress(v.b)
+	if err != nil{
+		return ByteView{},err
+	}
+	return ByteView{b: b},nil
+}
+
+// get key for a peer whose request accepts the encodings in acceptEncoding, a miss is loaded here and not sent on to another peer
+// a value cached in a form the peer accepts is sent as it is, with its encoding, "" means plain bytes
+func (g *Group)getForPeer(key string,acceptEncoding string)([]byte,string,error){
+	if g.compressor != nil{
+		if cached,ok := g.mainCache.get(key);ok && cached.codec != nil && acceptsEncoding(acceptEncoding,cached.codec.Name()){
+			g.stats.gets.Add(1)
+			g.stats.cacheHits.Add(1)
+			return cached.b,cached.codec.Name(),nil
+		}
+	}
+	view,err := g.get(key,false)
+	if err != nil{
+		return nil,"",err
+	}
+	return view.b,"",nil
+}
@@ -0,0 +1,156 @@
+package cache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestCompressors(t *testing.T) {
+	value := []byte(strings.Repeat(`{"name":"Tom","score":630},`, 100))
+	for _, c := range []Compressor{NewGzipCompressor(-42), NewDeflateCompressor(9), NewSnappyCompressor(), NewZstdCompressor(19)} {
+		compressed, err := c.Compress(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(compressed) >= len(value) {
+			t.Fatalf("%s: expect value to shrink, got %d bytes", c.Name(), len(compressed))
+		}
+		plain, err := c.Decompress(compressed)
+		if err != nil || !bytes.Equal(plain, value) {
+			t.Fatalf("%s: expect round trip, got %v", c.Name(), err)
+		}
+	}
+}
+
+// zeros that compress to a few hundred kilobytes must not expand past the limit when a peer sends them
+func TestDecompressLimit(t *testing.T) {
+	bomb := func(w io.WriteCloser, buf *bytes.Buffer) []byte {
+		if _, err := io.CopyN(w, zeroReader{}, maxDecompressedBytes+1); err != nil {
+			t.Fatal(err)
+		}
+		w.Close()
+		return buf.Bytes()
+	}
+	var gz, zl, zs bytes.Buffer
+	zw, _ := zstd.NewWriter(&zs)
+	bombs := map[Compressor][]byte{
+		NewGzipCompressor(gzip.BestSpeed):    bomb(gzip.NewWriter(&gz), &gz),
+		NewDeflateCompressor(zlib.BestSpeed): bomb(zlib.NewWriter(&zl), &zl),
+		NewZstdCompressor(1):                 bomb(zw, &zs),
+		// snappy keeps the decoded length up front
+		NewSnappyCompressor(): binary.AppendUvarint(nil, maxDecompressedBytes+1),
+	}
+	for c, b := range bombs {
+		if _, err := c.Decompress(b); !errors.Is(err, ErrValueTooLarge) {
+			t.Fatalf("%s: expect ErrValueTooLarge, got %v", c.Name(), err)
+		}
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func TestAcceptsEncoding(t *testing.T) {
+	cases := []struct {
+		header  string
+		coding  string
+		accepts bool
+	}{
+		{"gzip, deflate", "gzip", true},
+		{"deflate,GZIP", "gzip", true},
+		{"deflate", "gzip", false},
+		{"gzip;q=0.5", "gzip", true},
+		{"gzip;q=0", "gzip", false},
+		{"*", "gzip", true},
+		{"", "gzip", false},
+	}
+	for _, c := range cases {
+		if got := acceptsEncoding(c.header, c.coding); got != c.accepts {
+			t.Errorf("%q accepts %s: expect %v, got %v", c.header, c.coding, c.accepts, got)
+		}
+	}
+}
+
+func TestGroupCompression(t *testing.T) {
+	large := []byte(strings.Repeat(`{"name":"Tom","score":630},`, 100))
+	random := make([]byte, 1024)
+	rand.Read(random)
+	g := NewGroup("compressed", 2<<20, GetterFunc(func(key string) ([]byte, error) {
+		return large, nil
+	}), WithCompression(NewGzipCompressor(-1), 64))
+
+	g.Set("small", []byte("630"))
+	g.Set("random", random)
+	if _, err := g.Get("large"); err != nil {
+		t.Fatal(err)
+	}
+	for key, compressed := range map[string]bool{"small": false, "random": false, "large": true} {
+		cached, _, _ := g.mainCache.peek(key)
+		if (cached.codec != nil) != compressed {
+			t.Errorf("%s: expect compressed %v", key, compressed)
+		}
+	}
+	if stats := g.Stats(); stats.Bytes >= int64(len(large)+len(random)) {
+		t.Fatalf("expect the cache to be charged the compressed size, got %d bytes", stats.Bytes)
+	}
+	// reads are transparent
+	for key, value := range map[string][]byte{"small": []byte("630"), "random": random, "large": large} {
+		if v, err := g.Get(key); err != nil || !bytes.Equal(v.ByteSlice(), value) {
+			t.Fatalf("%s: expect the value as it was set, got %v", key, err)
+		}
+	}
+}
+
+func TestPeerCompression(t *testing.T) {
+	large := strings.Repeat(`{"name":"Jack","score":589},`, 100)
+	g := NewGroup("peercompressed", 2<<20, GetterFunc(func(key string) ([]byte, error) {
+		return []byte(large), nil
+	}), WithCompression(NewDeflateCompressor(-1), 64))
+	server, err := NewCacheServer("http://self", ":0", []string{"http://self"}, g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(server.httpServer.Handler)
+	defer ts.Close()
+
+	getter := &httpGetter{baseUrl: ts.URL + defaultBasePath, client: http.DefaultClient}
+	for i := 0; i < 2; i++ {
+		if v, err := getter.Get("peercompressed", "Jack"); err != nil || string(v) != large {
+			t.Fatalf("fetch %d: expect the plain value, got %v", i, err)
+		}
+	}
+
+	// the cached form is only sent to peers that accept it
+	for accept, encoding := range map[string]string{"deflate, gzip": "deflate", "gzip": "", "": ""} {
+		r, _ := http.NewRequest(http.MethodGet, ts.URL+defaultBasePath+"peercompressed/Jack", nil)
+		r.Header.Set("Accept-Encoding", accept)
+		res, err := http.DefaultTransport.RoundTrip(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if got := res.Header.Get("Content-Encoding"); got != encoding {
+			t.Errorf("accept %q: expect encoding %q, got %q", accept, encoding, got)
+		}
+		if encoding != "" && res.ContentLength >= int64(len(large)) {
+			t.Errorf("accept %q: expect a compressed body, got %d bytes", accept, res.ContentLength)
+		}
+	}
+}
@@ -0,0 +1,657 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config describes one cache node: who it is, who its peers are, what it listens on and which groups it serves
+type Config struct{
+	Self string `json:"self" yaml:"self"` // address peers use to reach this node, must be one of Peers
+	Listen string `json:"listen" yaml:"listen"` // address the cache server listens on, like ":8001"
+	Peers []Peer `json:"peers" yaml:"peers"` // every node in the cluster, including this one
+	Selector string `json:"selector" yaml:"selector"` // how keys map to peers: "ring" (default), "rendezvous" or "jump"
+	LoadBound float64 `json:"load_bound" yaml:"load_bound"` // epsilon of consistent hashing with bounded loads, 0 disables it
+	HandoffRate int64 `json:"handoff_rate" yaml:"handoff_rate"` // bytes per second of key handoff when peers change, 0 disables it
+	MemoryBudget int64 `json:"memory_budget" yaml:"memory_budget"` // bytes cached by all groups together, entry overhead included, 0 means no limit
+	MemoryPolicy string `json:"memory_policy" yaml:"memory_policy"` // which group gives entries back at the budget: "coldest" (default) or "largest"
+	API APIConfig `json:"api" yaml:"api"`
+	RESPListen string `json:"resp_listen" yaml:"resp_listen"` // redis protocol front end, empty to disable
+	MemcachedListen string `json:"memcached_listen" yaml:"memcached_listen"` // memcached protocol front end, empty to disable
+	Groups []GroupConfig `json:"groups" yaml:"groups"`
+	Timeouts Timeouts `json:"timeouts" yaml:"timeouts"`
+	TLS TLSConfig `json:"tls" yaml:"tls"`
+	Limits Limits `json:"limits" yaml:"limits"`
+	PeerKeys []HMACKeyConfig `json:"peer_keys" yaml:"peer_keys"` // secrets shared by the nodes, the first signs peer requests, empty leaves peers unchecked
+}
+
+// Peer is a node of the cluster, written either as its address or as {"addr": ..., "weight": ...}
+type Peer struct{
+	Addr string `json:"addr" yaml:"addr"`
+	Weight int `json:"weight,omitempty" yaml:"weight,omitempty"` // share of keys relative to other peers, 0 means 1, at most 100
+}
+
+func (p *Peer)UnmarshalJSON(b []byte)error{
+	var addr string
+	if err := json.Unmarshal(b,&addr);err == nil{
+		*p = Peer{Addr: addr}
+		return nil
+	}
+	// a type alias drops the method, so this does not recurse
+	type peer Peer
+	return json.Unmarshal(b,(*peer)(p))
+}
+
+func (p *Peer)UnmarshalYAML(unmarshal func(interface{}) error)error{
+	var addr string
+	if err := unmarshal(&addr);err == nil{
+		*p = Peer{Addr: addr}
+		return nil
+	}
+	type peer Peer
+	return unmarshal((*peer)(p))
+}
+
+// parse a peer from "addr" or "addr#weight", used by environment overrides
+func ParsePeer(s string)(Peer,error){
+	addr,weight,found := strings.Cut(strings.TrimSpace(s),"#")
+	if !found{
+		return Peer{Addr: addr},nil
+	}
+	w,err := strconv.Atoi(weight)
+	if err != nil{
+		return Peer{},fmt.Errorf("peer %s: invalid weight %q",addr,weight)
+	}
+	return Peer{Addr: addr,Weight: w},nil
+}
+
+// addresses of all peers
+func (c *Config)PeerAddrs()[]string{
+	addrs := make([]string,len(c.Peers))
+	for i,p := range c.Peers{
+		addrs[i] = p.Addr
+	}
+	return addrs
+}
+
+// weights of peers that declared one
+func (c *Config)PeerWeights()map[string]int{
+	weights := make(map[string]int)
+	for _,p := range c.Peers{
+		if p.Weight > 0{
+			weights[p.Addr] = p.Weight
+		}
+	}
+	return weights
+}
+
+// front end http server exposed to users
+type APIConfig struct{
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	Addr string `json:"addr" yaml:"addr"` // address users reach the api server on
+	Listen string `json:"listen" yaml:"listen"`
+	Auth AuthConfig `json:"auth" yaml:"auth"` // no tokens and no hmac keys leaves the api open
+}
+
+// who may call the api server and what they may do
+type AuthConfig struct{
+	Tokens []TokenConfig `json:"tokens" yaml:"tokens"` // "Authorization: Bearer <token>"
+	HMACKeys []HMACKeyConfig `json:"hmac_keys" yaml:"hmac_keys"` // requests signed with a shared secret
+	ACL []ACLRule `json:"acl" yaml:"acl"` // empty lets every authenticated caller do everything
+}
+
+// static api token and the principal it authenticates
+type TokenConfig struct{
+	Token string `json:"token" yaml:"token"`
+	Principal string `json:"principal" yaml:"principal"`
+}
+
+// hmac signing key, for api callers its id is the principal
+type HMACKeyConfig struct{
+	ID string `json:"id" yaml:"id"`
+	Secret string `json:"secret" yaml:"secret"`
+}
+
+// let a principal ("*" for everyone authenticated) use groups ("*" for all) with a permission
+type ACLRule struct{
+	Principal string `json:"principal" yaml:"principal"`
+	Groups []string `json:"groups" yaml:"groups"`
+	Permission string `json:"permission" yaml:"permission"` // "read", "write" or "admin"
+}
+
+// check if callers must authenticate
+func (a AuthConfig)Enabled()bool{
+	return len(a.Tokens) > 0 || len(a.HMACKeys) > 0
+}
+
+// settings of one group
+type GroupConfig struct{
+	Name string `json:"name" yaml:"name"`
+	CacheBytes int64 `json:"cache_bytes" yaml:"cache_bytes"` // byte budget of the group in this node
+	TTL Duration `json:"ttl" yaml:"ttl"` // 0 means values never expire
+	Eviction string `json:"eviction" yaml:"eviction"` // eviction policy, only "lru" for now
+	Storage string `json:"storage" yaml:"storage"` // "heap" keeps values in a lru list, "slab" in preallocated byte slabs the gc does not scan
+	EntryOverhead int64 `json:"entry_overhead" yaml:"entry_overhead"` // bytes counted per entry on top of key and value, 0 uses the default of the storage
+	MinBytes int64 `json:"min_bytes" yaml:"min_bytes"` // bytes of the group the memory budget never evicts, cache_bytes is its maximum
+	AdmissionHits int `json:"admission_hits" yaml:"admission_hits"` // loads of a key within admission_window before its value is cached, 0 or 1 caches every value
+	AdmissionWindow Duration `json:"admission_window" yaml:"admission_window"` // 0 means a minute
+	Replicas int `json:"replicas" yaml:"replicas"` // number of nodes caching each key, 0 or 1 disables replication
+	HedgePercentile float64 `json:"hedge_percentile" yaml:"hedge_percentile"` // ask a second source when a peer is slower than this share of fetches, 0 disables it
+	HedgeMinDelay Duration `json:"hedge_min_delay" yaml:"hedge_min_delay"` // never hedge sooner than this
+	MaxLoads int `json:"max_loads" yaml:"max_loads"` // database loads of the group at once, 0 means no limit
+	Compression string `json:"compression" yaml:"compression"` // "gzip", "deflate", "snappy" or "zstd" compresses cached values, empty keeps them as they are
+	CompressionMinBytes int `json:"compression_min_bytes" yaml:"compression_min_bytes"` // smaller values are not compressed
+	MaxValueBytes int64 `json:"max_value_bytes" yaml:"max_value_bytes"` // larger values are never cached, 0 means no limit
+	Passthrough bool `json:"passthrough" yaml:"passthrough"` // serve values over max_value_bytes without caching them instead of rejecting them
+}
+
+// pem files of the node, empty serves plain http
+// with a CA file the cache servers use mutual tls, peers must present a certificate signed by it
+type TLSConfig struct{
+	CertFile string `json:"cert_file" yaml:"cert_file"`
+	KeyFile string `json:"key_file" yaml:"key_file"`
+	CAFile string `json:"ca_file" yaml:"ca_file"`
+}
+
+// check if tls is turned on
+func (t TLSConfig)Enabled()bool{
+	return t.CertFile != ""
+}
+
+// request rates and load the node accepts, 0 means no limit
+type Limits struct{
+	ClientRate float64 `json:"client_rate" yaml:"client_rate"` // api requests per second of every client
+	ClientBurst int `json:"client_burst" yaml:"client_burst"`
+	GroupRate float64 `json:"group_rate" yaml:"group_rate"` // api requests per second of every group
+	GroupBurst int `json:"group_burst" yaml:"group_burst"`
+	PeerMaxInFlight int `json:"peer_max_in_flight" yaml:"peer_max_in_flight"` // peer fetches served at once, the rest queue
+	PeerQueueTarget Duration `json:"peer_queue_target" yaml:"peer_queue_target"` // peer fetches queued longer get shed
+}
+
+// network time limits, 0 means no limit
+type Timeouts struct{
+	PeerRequest Duration `json:"peer_request" yaml:"peer_request"` // one fetch from a peer
+	Read Duration `json:"read" yaml:"read"` // reading a request in cache and api servers
+	Write Duration `json:"write" yaml:"write"` // writing a response in cache and api servers
+	Shutdown Duration `json:"shutdown" yaml:"shutdown"` // draining the node on exit
+}
+
+// largest peer weight, the same bound as cache.MaxPeerWeight
+const maxPeerWeight = 100
+
+// memory policies a node can be configured with
+var memoryPolicies = map[string]bool{
+	"": true,
+	"coldest": true,
+	"largest": true,
+}
+
+// peer selectors a node can be configured with
+var selectors = map[string]bool{
+	"": true,
+	"ring": true,
+	"rendezvous": true,
+	"jump": true,
+}
+
+// eviction policies a group can be configured with
+var evictionPolicies = map[string]bool{
+	"lru": true,
+}
+
+var storages = map[string]bool{
+	"": true,
+	"heap": true,
+	"slab": true,
+}
+
+var compressions = map[string]bool{
+	"": true,
+	"gzip": true,
+	"deflate": true,
+	"snappy": true,
+	"zstd": true,
+}
+
+var permissions = map[string]bool{
+	"read": true,
+	"write": true,
+	"admin": true,
+}
+
+// Duration is a time.Duration written as "1m30s" in config files, plain numbers are seconds
+type Duration time.Duration
+
+func (d Duration)String()string{
+	return time.Duration(d).String()
+}
+
+func (d *Duration)UnmarshalJSON(b []byte)error{
+	var v interface{}
+	if err := json.Unmarshal(b,&v);err != nil{
+		return err
+	}
+	return d.set(v)
+}
+
+func (d *Duration)UnmarshalYAML(unmarshal func(interface{}) error)error{
+	var v interface{}
+	if err := unmarshal(&v);err != nil{
+		return err
+	}
+	return d.set(v)
+}
+
+func (d Duration)MarshalJSON()([]byte,error){
+	return json.Marshal(d.String())
+}
+
+func (d *Duration)set(v interface{})error{
+	switch v := v.(type){
+	case string:
+		if seconds,err := strconv.ParseFloat(v,64);err == nil{
+			*d = Duration(seconds*float64(time.Second))
+			return nil
+		}
+		parsed,err := time.ParseDuration(v)
+		if err != nil{
+			return err
+		}
+		*d = Duration(parsed)
+	case float64:
+		*d = Duration(v*float64(time.Second))
+	case int:
+		*d = Duration(time.Duration(v)*time.Second)
+	case nil:
+		*d = 0
+	default:
+		return fmt.Errorf("invalid duration %v",v)
+	}
+	return nil
+}
+
+// a three node cluster on localhost, the same topology that used to be hard coded in main
+func Default()*Config{
+	return &Config{
+		Self: "http://localhost:8001",
+		Listen: ":8001",
+		Peers: []Peer{
+			{Addr: "http://localhost:8001"},
+			{Addr: "http://localhost:8002"},
+			{Addr: "http://localhost:8003"},
+		},
+		API: APIConfig{
+			Addr: "http://localhost:9999",
+			Listen: ":9999",
+		},
+		Groups: []GroupConfig{
+			{Name: "scores",CacheBytes: 2<<10,Eviction: "lru"},
+		},
+		Timeouts: Timeouts{
+			PeerRequest: Duration(2*time.Second),
+			Shutdown: Duration(10*time.Second),
+		},
+	}
+}
+
+// read config from a json or yaml file (chosen by extension), apply environment overrides and validate it
+// fields missing from the file keep their Default value
+func Load(path string)(*Config,error){
+	data,err := os.ReadFile(path)
+	if err != nil{
+		return nil,err
+	}
+	c := Default()
+	// the file decides the groups, defaults would otherwise be merged into them
+	c.Groups = nil
+	switch strings.ToLower(filepath.Ext(path)){
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(data))
+		// typos in field names should not be silently ignored
+		dec.DisallowUnknownFields()
+		err = dec.Decode(c)
+	case ".yaml",".yml":
+		err = yaml.UnmarshalStrict(data,c)
+	default:
+		return nil,fmt.Errorf("config %s: unsupported format, use .json, .yaml or .yml",path)
+	}
+	if err != nil{
+		return nil,fmt.Errorf("config %s: %w",path,err)
+	}
+	if err := c.ApplyEnv(os.LookupEnv);err != nil{
+		return nil,fmt.Errorf("config %s: %w",path,err)
+	}
+	if err := c.Validate();err != nil{
+		return nil,fmt.Errorf("config %s: %w",path,err)
+	}
+	return c,nil
+}
+
+// override config with GOCACHE_* environment variables, lookup is usually os.LookupEnv
+//
+//	GOCACHE_SELF, GOCACHE_LISTEN, GOCACHE_PEERS (comma separated "addr" or "addr#weight"),
+//	GOCACHE_API_ENABLED, GOCACHE_API_ADDR, GOCACHE_API_LISTEN,
+//	GOCACHE_RESP_LISTEN, GOCACHE_MEMCACHED_LISTEN,
+//	GOCACHE_PEER_TIMEOUT, GOCACHE_READ_TIMEOUT, GOCACHE_WRITE_TIMEOUT, GOCACHE_SHUTDOWN_TIMEOUT,
+//	GOCACHE_TLS_CERT, GOCACHE_TLS_KEY, GOCACHE_TLS_CA,
+//	GOCACHE_PEER_KEYS (comma separated "id:secret", the first one signs)
+func (c *Config)ApplyEnv(lookup func(string)(string,bool))error{
+	str := func(name string,dst *string){
+		if v,ok := lookup(name);ok{
+			*dst = v
+		}
+	}
+	str("GOCACHE_SELF",&c.Self)
+	str("GOCACHE_LISTEN",&c.Listen)
+	str("GOCACHE_API_ADDR",&c.API.Addr)
+	str("GOCACHE_API_LISTEN",&c.API.Listen)
+	str("GOCACHE_RESP_LISTEN",&c.RESPListen)
+	str("GOCACHE_MEMCACHED_LISTEN",&c.MemcachedListen)
+	str("GOCACHE_TLS_CERT",&c.TLS.CertFile)
+	str("GOCACHE_TLS_KEY",&c.TLS.KeyFile)
+	str("GOCACHE_TLS_CA",&c.TLS.CAFile)
+	if v,ok := lookup("GOCACHE_PEERS");ok{
+		c.Peers = nil
+		for _,s := range strings.Split(v,","){
+			if strings.TrimSpace(s) == ""{
+				continue
+			}
+			peer,err := ParsePeer(s)
+			if err != nil{
+				return fmt.Errorf("GOCACHE_PEERS: %w",err)
+			}
+			c.Peers = append(c.Peers, peer)
+		}
+	}
+	if v,ok := lookup("GOCACHE_PEER_KEYS");ok{
+		c.PeerKeys = nil
+		for _,s := range strings.Split(v,","){
+			if strings.TrimSpace(s) == ""{
+				continue
+			}
+			id,secret,ok := strings.Cut(strings.TrimSpace(s),":")
+			if !ok{
+				return fmt.Errorf("GOCACHE_PEER_KEYS: %q is not id:secret",s)
+			}
+			c.PeerKeys = append(c.PeerKeys, HMACKeyConfig{ID: id,Secret: secret})
+		}
+	}
+	if v,ok := lookup("GOCACHE_API_ENABLED");ok{
+		enabled,err := strconv.ParseBool(v)
+		if err != nil{
+			return fmt.Errorf("GOCACHE_API_ENABLED: %w",err)
+		}
+		c.API.Enabled = enabled
+	}
+	durations := []struct{
+		name string
+		dst *Duration
+	}{
+		{"GOCACHE_PEER_TIMEOUT",&c.Timeouts.PeerRequest},
+		{"GOCACHE_READ_TIMEOUT",&c.Timeouts.Read},
+		{"GOCACHE_WRITE_TIMEOUT",&c.Timeouts.Write},
+		{"GOCACHE_SHUTDOWN_TIMEOUT",&c.Timeouts.Shutdown},
+	}
+	for _,d := range durations{
+		if v,ok := lookup(d.name);ok{
+			if err := d.dst.set(v);err != nil{
+				return fmt.Errorf("%s: %w",d.name,err)
+			}
+		}
+	}
+	return nil
+}
+
+// check the config is usable, every problem found is reported in one error
+func (c *Config)Validate()error{
+	var errs []string
+	fail := func(format string,v ...interface{}){
+		errs = append(errs, fmt.Sprintf(format,v...))
+	}
+
+	if len(c.Peers) == 0{
+		fail("peers: at least one peer is required")
+	}
+	seen := make(map[string]bool,len(c.Peers))
+	for _,peer := range c.Peers{
+		if err := validateAddr(peer.Addr);err != nil{
+			fail("peers: %v",err)
+		}
+		if seen[peer.Addr]{
+			fail("peers: duplicate peer %s",peer.Addr)
+		}
+		if peer.Weight < 0{
+			fail("peers: %s has negative weight",peer.Addr)
+		}else if peer.Weight > maxPeerWeight{
+			fail("peers: %s weight is above %d",peer.Addr,maxPeerWeight)
+		}
+		if c.TLS.Enabled() && !strings.HasPrefix(peer.Addr,"https://"){
+			fail("peers: %s must be https when tls is enabled",peer.Addr)
+		}
+		seen[peer.Addr] = true
+	}
+	if c.Self == ""{
+		fail("self: is required")
+	}else if !seen[c.Self]{
+		fail("self: %s is not one of the peers",c.Self)
+	}
+	if c.Listen == ""{
+		fail("listen: is required")
+	}
+	if !selectors[c.Selector]{
+		fail("selector: unknown selector %q",c.Selector)
+	}
+	if c.LoadBound < 0{
+		fail("load_bound: must not be negative")
+	}else if c.LoadBound > 0 && c.Selector != "" && c.Selector != "ring"{
+		fail("load_bound: only supported by the ring selector")
+	}
+	if c.HandoffRate < 0{
+		fail("handoff_rate: must not be negative")
+	}
+	if c.MemoryBudget < 0{
+		fail("memory_budget: must not be negative")
+	}
+	if !memoryPolicies[c.MemoryPolicy]{
+		fail("memory_policy: unknown policy %q",c.MemoryPolicy)
+	}
+	var minBytes int64
+	for _,g := range c.Groups{
+		minBytes += g.MinBytes
+	}
+	if c.MemoryBudget > 0 && minBytes > c.MemoryBudget{
+		fail("groups: min_bytes add up to %d, more than the memory_budget of %d",minBytes,c.MemoryBudget)
+	}
+	if c.API.Enabled && c.API.Listen == ""{
+		fail("api.listen: is required when the api server is enabled")
+	}
+	peerKeys := make(map[string]bool,len(c.PeerKeys))
+	for i,k := range c.PeerKeys{
+		if k.ID == "" || k.Secret == ""{
+			fail("peer_keys[%d]: id and secret are required",i)
+		}else if peerKeys[k.ID]{
+			fail("peer_keys[%d]: duplicate id %s",i,k.ID)
+		}
+		peerKeys[k.ID] = true
+	}
+	auth := c.API.Auth
+	tokens := make(map[string]bool,len(auth.Tokens))
+	for i,t := range auth.Tokens{
+		if t.Token == "" || t.Principal == ""{
+			fail("api.auth.tokens[%d]: token and principal are required",i)
+		}else if tokens[t.Token]{
+			fail("api.auth.tokens[%d]: duplicate token",i)
+		}
+		tokens[t.Token] = true
+	}
+	keys := make(map[string]bool,len(auth.HMACKeys))
+	for i,k := range auth.HMACKeys{
+		if k.ID == "" || k.Secret == ""{
+			fail("api.auth.hmac_keys[%d]: id and secret are required",i)
+		}else if keys[k.ID]{
+			fail("api.auth.hmac_keys[%d]: duplicate id %s",i,k.ID)
+		}
+		keys[k.ID] = true
+	}
+	if len(auth.ACL) > 0 && !auth.Enabled(){
+		fail("api.auth.acl: needs tokens or hmac_keys")
+	}
+	for i,rule := range auth.ACL{
+		if rule.Principal == ""{
+			fail("api.auth.acl[%d].principal: is required",i)
+		}
+		if len(rule.Groups) == 0{
+			fail("api.auth.acl[%d].groups: at least one group is required",i)
+		}
+		if !permissions[rule.Permission]{
+			fail("api.auth.acl[%d].permission: unknown permission %q",i,rule.Permission)
+		}
+	}
+
+	if len(c.Groups) == 0{
+		fail("groups: at least one group is required")
+	}
+	names := make(map[string]bool,len(c.Groups))
+	for i,g := range c.Groups{
+		if g.Name == ""{
+			fail("groups[%d].name: is required",i)
+		}else if names[g.Name]{
+			fail("groups[%d].name: duplicate group %s",i,g.Name)
+		}
+		names[g.Name] = true
+		if g.CacheBytes <= 0{
+			fail("groups[%d].cache_bytes: must be positive",i)
+		}
+		if g.TTL < 0{
+			fail("groups[%d].ttl: must not be negative",i)
+		}
+		if g.Eviction != "" && !evictionPolicies[g.Eviction]{
+			fail("groups[%d].eviction: unknown policy %q",i,g.Eviction)
+		}
+		if !storages[g.Storage]{
+			fail("groups[%d].storage: unknown storage %q",i,g.Storage)
+		}
+		if g.EntryOverhead < 0{
+			fail("groups[%d].entry_overhead: must not be negative",i)
+		}
+		if g.AdmissionHits < 0 || g.AdmissionHits > 255{
+			fail("groups[%d].admission_hits: must be between 0 and 255",i)
+		}
+		if g.AdmissionWindow < 0{
+			fail("groups[%d].admission_window: must not be negative",i)
+		}
+		if g.MinBytes < 0{
+			fail("groups[%d].min_bytes: must not be negative",i)
+		}else if g.MinBytes > g.CacheBytes{
+			fail("groups[%d].min_bytes: more than its cache_bytes",i)
+		}
+		if g.HedgePercentile < 0 || g.HedgePercentile > 1{
+			fail("groups[%d].hedge_percentile: must be between 0 and 1",i)
+		}
+		if g.HedgeMinDelay < 0{
+			fail("groups[%d].hedge_min_delay: must not be negative",i)
+		}
+		if !compressions[g.Compression]{
+			fail("groups[%d].compression: unknown compression %q",i,g.Compression)
+		}
+		if g.CompressionMinBytes < 0{
+			fail("groups[%d].compression_min_bytes: must not be negative",i)
+		}
+		if g.MaxLoads < 0{
+			fail("groups[%d].max_loads: must not be negative",i)
+		}
+		if g.MaxValueBytes < 0{
+			fail("groups[%d].max_value_bytes: must not be negative",i)
+		}else if g.Passthrough && g.MaxValueBytes == 0{
+			fail("groups[%d].passthrough: requires max_value_bytes",i)
+		}
+		if g.Replicas < 0{
+			fail("groups[%d].replicas: must not be negative",i)
+		}else if g.Replicas > len(c.Peers){
+			fail("groups[%d].replicas: %d is more than the %d peers",i,g.Replicas,len(c.Peers))
+		}
+	}
+
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == ""){
+		fail("tls: cert_file and key_file must be given together")
+	}
+	if c.TLS.CAFile != "" && !c.TLS.Enabled(){
+		fail("tls.ca_file: needs cert_file and key_file")
+	}
+	for _,f := range []struct{
+		name string
+		path string
+	}{
+		{"cert_file",c.TLS.CertFile},
+		{"key_file",c.TLS.KeyFile},
+		{"ca_file",c.TLS.CAFile},
+	}{
+		if f.path == ""{
+			continue
+		}
+		if _,err := os.Stat(f.path);err != nil{
+			fail("tls.%s: %v",f.name,err)
+		}
+	}
+
+	l := c.Limits
+	limits := []struct{
+		name string
+		v float64
+	}{
+		{"client_rate",l.ClientRate},
+		{"client_burst",float64(l.ClientBurst)},
+		{"group_rate",l.GroupRate},
+		{"group_burst",float64(l.GroupBurst)},
+		{"peer_max_in_flight",float64(l.PeerMaxInFlight)},
+		{"peer_queue_target",float64(l.PeerQueueTarget)},
+	}
+	for _,limit := range limits{
+		if limit.v < 0{
+			fail("limits.%s: must not be negative",limit.name)
+		}
+	}
+
+	t := c.Timeouts
+	timeouts := []struct{
+		name string
+		d Duration
+	}{
+		{"peer_request",t.PeerRequest},
+		{"read",t.Read},
+		{"write",t.Write},
+		{"shutdown",t.Shutdown},
+	}
+	for _,timeout := range timeouts{
+		if timeout.d < 0{
+			fail("timeouts.%s: must not be negative",timeout.name)
+		}
+	}
+
+	if len(errs) == 0{
+		return nil
+	}
+	return errors.New("invalid config: "+strings.Join(errs,"; "))
+}
+
+// peers are reached over http, so their address must be a http(s) url with a host
+func validateAddr(addr string)error{
+	u,err := url.Parse(addr)
+	if err != nil{
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == ""{
+		return fmt.Errorf("%s is not a http address",addr)
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// write content into a temporary file with given name and return its path
+func writeConfig(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadFormats(t *testing.T) {
+	jsonPath := writeConfig(t, "node.json", `{
+		"self": "http://10.0.0.1:8001",
+		"listen": ":8001",
+		"peers": ["http://10.0.0.1:8001", {"addr": "http://10.0.0.2:8001", "weight": 3}],
+		"groups": [{"name": "scores", "cache_bytes": 4096, "ttl": "1m"}],
+		"timeouts": {"peer_request": 3}
+	}`)
+	yamlPath := writeConfig(t, "node.yaml", `
+self: http://10.0.0.1:8001
+listen: ":8001"
+peers:
+  - http://10.0.0.1:8001
+  - addr: http://10.0.0.2:8001
+    weight: 3
+groups:
+  - name: scores
+    cache_bytes: 4096
+    ttl: 1m
+timeouts:
+  peer_request: 3
+`)
+	for _, path := range []string{jsonPath, yamlPath} {
+		c, err := Load(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectPeers := []Peer{{Addr: "http://10.0.0.1:8001"}, {Addr: "http://10.0.0.2:8001", Weight: 3}}
+		if !reflect.DeepEqual(c.Peers, expectPeers) {
+			t.Fatalf("%s: unexpected peers %v", path, c.Peers)
+		}
+		if len(c.Groups) != 1 || c.Groups[0].TTL != Duration(time.Minute) || c.Groups[0].CacheBytes != 4096 {
+			t.Fatalf("%s: unexpected groups %+v", path, c.Groups)
+		}
+		if c.Timeouts.PeerRequest != Duration(3*time.Second) {
+			t.Fatalf("%s: expect peer timeout 3s, got %v", path, c.Timeouts.PeerRequest)
+		}
+		// missing fields keep their defaults
+		if c.Timeouts.Shutdown != Default().Timeouts.Shutdown {
+			t.Fatalf("%s: expect default shutdown timeout, got %v", path, c.Timeouts.Shutdown)
+		}
+	}
+}
+
+func TestLoadRejectsUnknownFields(t *testing.T) {
+	path := writeConfig(t, "node.json", `{"peerz": []}`)
+	if _, err := Load(path); err == nil {
+		t.Fatal("expect unknown field to be rejected")
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	env := map[string]string{
+		"GOCACHE_SELF":         "http://b:8001",
+		"GOCACHE_PEERS":        "http://a:8001, http://b:8001#2",
+		"GOCACHE_API_ENABLED":  "true",
+		"GOCACHE_PEER_TIMEOUT": "500ms",
+		"GOCACHE_PEER_KEYS":    "k2:new, k1:old",
+	}
+	c := Default()
+	err := c.ApplyEnv(func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Self != "http://b:8001" || !c.API.Enabled || c.Timeouts.PeerRequest != Duration(500*time.Millisecond) {
+		t.Fatalf("env not applied: %+v", c)
+	}
+	if !reflect.DeepEqual(c.Peers, []Peer{{Addr: "http://a:8001"}, {Addr: "http://b:8001", Weight: 2}}) {
+		t.Fatalf("unexpected peers %v", c.Peers)
+	}
+	if !reflect.DeepEqual(c.PeerKeys, []HMACKeyConfig{{ID: "k2", Secret: "new"}, {ID: "k1", Secret: "old"}}) {
+		t.Fatalf("unexpected peer keys %v", c.PeerKeys)
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	c := Default()
+	c.Self = "http://elsewhere:8001"
+	c.Peers = append(c.Peers, Peer{Addr: "localhost:8004"}, c.Peers[0], Peer{Addr: "http://localhost:8005", Weight: -1})
+	c.Groups = append(c.Groups, GroupConfig{Name: "scores", CacheBytes: 0, Eviction: "random", Replicas: 9, Compression: "zip", Passthrough: true, Storage: "disk", EntryOverhead: -1, MinBytes: 10, AdmissionHits: 300})
+	c.Timeouts.Read = Duration(-time.Second)
+	c.Limits.ClientRate = -1
+	c.MemoryBudget = -1
+	c.MemoryPolicy = "random"
+	c.Selector = "random"
+	c.TLS = TLSConfig{CertFile: "missing.pem"}
+	c.PeerKeys = []HMACKeyConfig{{ID: "k1", Secret: "s"}, {ID: "k1", Secret: "t"}}
+	c.API.Auth = AuthConfig{
+		Tokens: []TokenConfig{{Token: "t", Principal: "alice"}, {Token: "t", Principal: "bob"}},
+		ACL:    []ACLRule{{Principal: "alice", Groups: []string{"scores"}, Permission: "owner"}, {Principal: "bob"}},
+	}
+
+	err := c.Validate()
+	if err == nil {
+		t.Fatal("expect invalid config")
+	}
+	for _, msg := range []string{
+		"self: http://elsewhere:8001 is not one of the peers",
+		"localhost:8004 is not a http address",
+		"duplicate peer http://localhost:8001",
+		"http://localhost:8005 has negative weight",
+		"groups[1].name: duplicate group scores",
+		"groups[1].cache_bytes: must be positive",
+		`groups[1].eviction: unknown policy "random"`,
+		`groups[1].storage: unknown storage "disk"`,
+		"groups[1].entry_overhead: must not be negative",
+		"groups[1].min_bytes: more than its cache_bytes",
+		"groups[1].admission_hits: must be between 0 and 255",
+		"groups[1].replicas: 9 is more than the 6 peers",
+		`groups[1].compression: unknown compression "zip"`,
+		"groups[1].passthrough: requires max_value_bytes",
+		"timeouts.read: must not be negative",
+		"limits.client_rate: must not be negative",
+		"memory_budget: must not be negative",
+		`memory_policy: unknown policy "random"`,
+		`selector: unknown selector "random"`,
+		"peers: http://localhost:8001 must be https when tls is enabled",
+		"tls: cert_file and key_file must be given together",
+		"tls.cert_file: stat missing.pem",
+		"peer_keys[1]: duplicate id k1",
+		"api.auth.tokens[1]: duplicate token",
+		`api.auth.acl[0].permission: unknown permission "owner"`,
+		"api.auth.acl[1].groups: at least one group is required",
+	} {
+		if !strings.Contains(err.Error(), msg) {
+			t.Errorf("expect %q in %q", msg, err)
+		}
+	}
+}
@@ -2,19 +2,31 @@ package consistenthash
 
 import (
 	"hash/crc32"
+	"math"
 	"sort"
 	"strconv"
 )
 
 
+// largest weight of a node, a larger one is treated as MaxWeight so the ring stays bounded
+const MaxWeight = 100
+
 type Hash func(data []byte)uint32
 // create a hash interface that allows user to inject customized hash function
 
 type Map struct{
 	hash Hash // customized hash function injection
 	replicas int // how many virtual node you want to have
-	keys []int // hash ring
+	keys []int // hash ring, sorted and every point only once
 	hashMap map[int]string // mapping relation between key on hash ring and real hash server
+	claims map[int][]string // every server with a virtual node on a point, sorted, the first one owns the point
+	points map[string][]int // virtual nodes of every real server
+	weights map[string]int // weight of every real server on the ring
+	totalWeight int
+	// bounded load mode, see SetLoadBound
+	loadBound float64 // 0 disables bounded loads
+	loads map[string]int // current load of every real server
+	totalLoad int
 }
 
 // consistent hashing constructor
@@ -23,6 +35,10 @@ func New(replicas int, fn Hash)*Map{
 		replicas: replicas,
 		hash: fn,
 		hashMap: make(map[int]string),
+		claims: make(map[int][]string),
+		points: make(map[string][]int),
+		weights: make(map[string]int),
+		loads: make(map[string]int),
 	}
 	// default consistent hashing function
 	if m.hash == nil{
@@ -34,13 +50,87 @@ func New(replicas int, fn Hash)*Map{
 func (m *Map)Add(keys ...string){
 	// for every key, we generate number of virtual nodes and place them into hash ring
 	for _,key := range keys{
-		for i:= 0;i < m.replicas;i++{
-			hash := int(m.hash([]byte(strconv.Itoa(i)+key)))
+		m.addVirtualNodes(key,1)
+	}
+	sort.Ints(m.keys)
+}
+
+// add a node with replicas*weight virtual nodes, so a node with weight 2 owns about twice the keys of weight 1
+// weight < 1 is treated as 1 and weight > MaxWeight as MaxWeight
+func (m *Map)AddWeighted(key string,weight int){
+	if weight < 1{
+		weight = 1
+	}else if weight > MaxWeight{
+		weight = MaxWeight
+	}
+	m.addVirtualNodes(key,weight)
+	sort.Ints(m.keys)
+}
+
+// place replicas*weight virtual nodes of key on the ring, caller sorts the ring afterwards
+// adding a server again replaces its virtual nodes
+// when virtual nodes of two servers hash to the same point the smaller name owns it,
+// so the ring does not depend on the order servers were added in
+func (m *Map)addVirtualNodes(key string,weight int){
+	if _,ok := m.weights[key];ok{
+		m.Remove(key)
+	}
+	m.totalWeight += weight
+	m.weights[key] = weight
+	for i:= 0;i < m.replicas*weight;i++{
+		hash := int(m.hash([]byte(strconv.Itoa(i)+key)))
+		m.points[key] = append(m.points[key], hash)
+		claims := m.claims[hash]
+		if len(claims) == 0{
 			m.keys = append(m.keys,hash)
-			m.hashMap[hash] = key
 		}
+		// keep claims sorted, the loser takes the point over if the owner is removed
+		idx := sort.SearchStrings(claims,key)
+		claims = append(claims,"")
+		copy(claims[idx+1:],claims[idx:])
+		claims[idx] = key
+		m.claims[hash] = claims
+		m.hashMap[hash] = claims[0]
 	}
-	sort.Ints(m.keys)
+}
+
+// remove a server and exactly its virtual nodes, points it shared with another server go to that server
+func (m *Map)Remove(key string){
+	weight,ok := m.weights[key]
+	if !ok{
+		return
+	}
+	m.totalWeight -= weight
+	m.totalLoad -= m.loads[key]
+	delete(m.weights,key)
+	delete(m.loads,key)
+	emptied := make(map[int]bool)
+	for _,hash := range m.points[key]{
+		claims := m.claims[hash]
+		idx := sort.SearchStrings(claims,key)
+		if idx == len(claims) || claims[idx] != key{
+			// points and claims are updated together, so this does not happen
+			continue
+		}
+		claims = append(claims[:idx],claims[idx+1:]...)
+		if len(claims) == 0{
+			delete(m.claims,hash)
+			delete(m.hashMap,hash)
+			emptied[hash] = true
+			continue
+		}
+		m.claims[hash] = claims
+		m.hashMap[hash] = claims[0]
+	}
+	delete(m.points,key)
+	// drop points nobody owns anymore, the ring stays sorted
+	kept := m.keys[:0]
+	for _,hash := range m.keys{
+		if !emptied[hash]{
+			kept = append(kept, hash)
+		}
+	}
+	m.keys = kept
 }
 
 // given a key, return the server it stored in
@@ -60,3 +150,86 @@ func(m *Map)Get(key string)string{
 	return m.hashMap[m.keys[idx%len(m.keys)]]
 }
 
+// return up to n distinct servers for key, walking clockwise from the key
+// the first one is the server Get returns, the others are its successors on the ring
+func(m *Map)GetN(key string,n int)[]string{
+	if len(m.keys) == 0 || n <= 0{
+		return nil
+	}
+	if n > len(m.weights){
+		n = len(m.weights)
+	}
+	hash := int(m.hash([]byte(key)))
+	idx := sort.Search(len(m.keys),func(i int)bool{
+		return m.keys[i] >= hash
+	})
+	servers := make([]string,0,n)
+	seen := make(map[string]bool,n)
+	for i := 0;i < len(m.keys) && len(servers) < n;i++{
+		server := m.hashMap[m.keys[(idx+i)%len(m.keys)]]
+		if !seen[server]{
+			seen[server] = true
+			servers = append(servers, server)
+		}
+	}
+	return servers
+}
+
+// switch the map into consistent hashing with bounded loads
+// no server gets more than ceil((1+epsilon) * average load) (scaled by its weight) from GetLeast,
+// keys whose server is full walk clockwise to the next server that has room, epsilon <= 0 turns it off
+func (m *Map)SetLoadBound(epsilon float64){
+	if epsilon < 0{
+		epsilon = 0
+	}
+	m.loadBound = epsilon
+}
+
+// like Get, but in bounded load mode it skips servers that reached their load limit
+func (m *Map)GetLeast(key string)string{
+	if len(m.keys) == 0{
+		return ""
+	}
+	hash := int(m.hash([]byte(key)))
+	idx := sort.Search(len(m.keys),func(i int)bool{
+		return m.keys[i] >= hash
+	})
+	if m.loadBound == 0{
+		return m.hashMap[m.keys[idx%len(m.keys)]]
+	}
+	// walk clockwise until a server with room is found
+	// every server is seen at most once per round, and at least one always has room
+	for i := 0;i < len(m.keys);i++{
+		server := m.hashMap[m.keys[(idx+i)%len(m.keys)]]
+		if m.loads[server] < m.maxLoad(server){
+			return server
+		}
+	}
+	return m.hashMap[m.keys[idx%len(m.keys)]]
+}
+
+// load limit of server if one more request arrives
+func (m *Map)maxLoad(server string)int{
+	share := float64(m.weights[server])/float64(m.totalWeight)
+	// drop float rounding noise so that exact multiples are not rounded up
+	return int(math.Ceil((1+m.loadBound)*float64(m.totalLoad+1)*share - 1e-9))
+}
+
+// add one unit of load to server, call Done when the work finishes
+func (m *Map)Inc(server string){
+	m.loads[server]++
+	m.totalLoad++
+}
+
+// remove one unit of load from server
+func (m *Map)Done(server string){
+	if m.loads[server] > 0{
+		m.loads[server]--
+		m.totalLoad--
+	}
+}
+
+// current load of server
+func (m *Map)Load(server string)int{
+	return m.loads[server]
+}
@@ -1,8 +1,15 @@
 package consistenthash
 
 import (
+	"fmt"
+	"hash/crc32"
+	"math"
+	"math/rand"
+	"reflect"
+	"sort"
 	"strconv"
 	"testing"
+	"testing/quick"
 )
 
 func TestHashing(t *testing.T) {
@@ -35,4 +42,253 @@ func TestHashing(t *testing.T) {
 		}
 	}
 
-}
\ No newline at end of file
+}
+func TestGetN(t *testing.T) {
+	hash := New(3, func(key []byte) uint32 {
+		i, _ := strconv.Atoi(string(key))
+		return uint32(i)
+	})
+	hash.Add("6", "4", "2")
+
+	testCase := map[string][]string{
+		"11": {"2", "4"},
+		"27": {"2", "4"},
+		"23": {"4", "6"},
+	}
+	for k, v := range testCase {
+		if got := hash.GetN(k, 2); !reflect.DeepEqual(got, v) {
+			t.Errorf("Asking for 2 replicas of %s, should have yielded %v, got %v", k, v, got)
+		}
+	}
+	// virtual nodes of a server are only counted once
+	if got := hash.GetN("23", 5); !reflect.DeepEqual(got, []string{"4", "6", "2"}) {
+		t.Errorf("expect every server once, got %v", got)
+	}
+}
+
+func TestAddWeighted(t *testing.T) {
+	hash := New(100, nil)
+	weights := map[string]int{"small": 1, "medium": 2, "large": 4}
+	for node, weight := range weights {
+		hash.AddWeighted(node, weight)
+	}
+	if len(hash.keys) != 100*(1+2+4) {
+		t.Fatalf("expect %d virtual nodes, got %d", 100*7, len(hash.keys))
+	}
+
+	counts := make(map[string]int)
+	total := 100000
+	for i := 0; i < total; i++ {
+		counts[hash.Get("key"+strconv.Itoa(i))]++
+	}
+	// every node should own a share of keys close to its share of the total weight
+	for node, weight := range weights {
+		expect := float64(total) * float64(weight) / 7
+		if got := float64(counts[node]); got < expect*0.75 || got > expect*1.25 {
+			t.Errorf("node %s with weight %d owns %d keys, expect about %.0f", node, weight, counts[node], expect)
+		}
+	}
+}
+
+func TestAddWeightedClamped(t *testing.T) {
+	hash := New(10, nil)
+	hash.AddWeighted("huge", 1<<30)
+	if len(hash.keys) != 10*MaxWeight {
+		t.Fatalf("expect a weight above MaxWeight to be clamped, got %d virtual nodes", len(hash.keys))
+	}
+}
+
+// simulate requests for zipf distributed keys that stay in flight, and return the highest load of a server
+func simulateLoads(m *Map, nodes int, requests int, bounded bool) int {
+	zipf := rand.NewZipf(rand.New(rand.NewSource(1)), 1.1, 1, 10000)
+	for i := 0; i < requests; i++ {
+		key := "key" + strconv.FormatUint(zipf.Uint64(), 10)
+		server := m.Get(key)
+		if bounded {
+			server = m.GetLeast(key)
+		}
+		m.Inc(server)
+	}
+	max := 0
+	for i := 0; i < nodes; i++ {
+		if load := m.Load("node" + strconv.Itoa(i)); load > max {
+			max = load
+		}
+	}
+	return max
+}
+
+func TestBoundedLoads(t *testing.T) {
+	nodes, requests := 10, 10000
+	newMap := func() *Map {
+		m := New(50, nil)
+		for i := 0; i < nodes; i++ {
+			m.Add("node" + strconv.Itoa(i))
+		}
+		return m
+	}
+
+	unbounded := simulateLoads(newMap(), nodes, requests, false)
+
+	m := newMap()
+	m.SetLoadBound(0.25)
+	bounded := simulateLoads(m, nodes, requests, true)
+	limit := int(math.Ceil(1.25 * float64(requests) / float64(nodes)))
+	if bounded > limit {
+		t.Fatalf("expect max load <= %d with bounded loads, got %d", limit, bounded)
+	}
+	if unbounded <= limit {
+		t.Fatalf("hot keys should overload a node without bounded loads, got max load %d", unbounded)
+	}
+	t.Logf("max load: unbounded %d, bounded %d, average %d", unbounded, bounded, requests/nodes)
+
+	// finished work frees room on the server again
+	before := m.Load("node0")
+	m.Done("node0")
+	if m.Load("node0") != before-1 || m.totalLoad != requests-1 {
+		t.Fatal("Done should release load")
+	}
+}
+
+func TestBoundedLoadsWeighted(t *testing.T) {
+	m := New(50, nil)
+	m.AddWeighted("small", 1)
+	m.AddWeighted("large", 3)
+	m.SetLoadBound(0.1)
+	// a single hot key spills over but keeps to the weights
+	for i := 0; i < 400; i++ {
+		m.Inc(m.GetLeast("hot"))
+	}
+	if small := m.Load("small"); small > int(math.Ceil(1.1*400/4)) {
+		t.Fatalf("small node got %d of 400 requests, expect about a quarter", small)
+	}
+	if large := m.Load("large"); large > int(math.Ceil(1.1*400*3/4)) {
+		t.Fatalf("large node got %d of 400 requests, expect about three quarters", large)
+	}
+}
+
+// a tiny hash space, so virtual nodes collide all the time
+func collidingHash(data []byte) uint32 {
+	return crc32.ChecksumIEEE(data) % 64
+}
+
+// check the invariants of the ring: every point once and sorted, owned by the smallest server placed on it,
+// and every virtual node of every server on the ring
+func checkRing(m *Map) error {
+	for i := 1; i < len(m.keys); i++ {
+		if m.keys[i-1] >= m.keys[i] {
+			return fmt.Errorf("ring not sorted or point %d twice: %v", m.keys[i], m.keys)
+		}
+	}
+	if len(m.keys) != len(m.hashMap) || len(m.keys) != len(m.claims) {
+		return fmt.Errorf("%d points on the ring, but %d owners and %d claims", len(m.keys), len(m.hashMap), len(m.claims))
+	}
+	for _, hash := range m.keys {
+		claims := m.claims[hash]
+		if !sort.StringsAreSorted(claims) || len(claims) == 0 || m.hashMap[hash] != claims[0] {
+			return fmt.Errorf("point %d owned by %s, claimed by %v", hash, m.hashMap[hash], claims)
+		}
+	}
+	totalWeight := 0
+	for server, weight := range m.weights {
+		totalWeight += weight
+		if len(m.points[server]) != m.replicas*weight {
+			return fmt.Errorf("server %s has %d virtual nodes, expect %d", server, len(m.points[server]), m.replicas*weight)
+		}
+		for _, hash := range m.points[server] {
+			if i := sort.SearchStrings(m.claims[hash], server); i == len(m.claims[hash]) || m.claims[hash][i] != server {
+				return fmt.Errorf("virtual node %d of %s is not on the ring", hash, server)
+			}
+		}
+	}
+	if totalWeight != m.totalWeight || len(m.points) != len(m.weights) {
+		return fmt.Errorf("total weight %d, expect %d", m.totalWeight, totalWeight)
+	}
+	return nil
+}
+
+// copy of the ring, so rings can be compared after changes
+func snapshot(m *Map) ([]int, map[int]string) {
+	owners := make(map[int]string, len(m.hashMap))
+	for hash, server := range m.hashMap {
+		owners[hash] = server
+	}
+	return append([]int(nil), m.keys...), owners
+}
+
+// servers are named after small numbers, so a server is often added again with another weight
+func serverName(n uint8) string {
+	return "node" + strconv.Itoa(int(n%16))
+}
+
+func TestRingInvariants(t *testing.T) {
+	f := func(add []uint8, remove []uint8) bool {
+		m := New(3, collidingHash)
+		for _, n := range add {
+			m.AddWeighted(serverName(n), int(n%3)+1)
+			if err := checkRing(m); err != nil {
+				t.Log(err)
+				return false
+			}
+		}
+		for _, n := range remove {
+			m.Remove(serverName(n))
+			if err := checkRing(m); err != nil {
+				t.Log(err)
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRingOrderIndependent(t *testing.T) {
+	f := func(add []uint8, seed int64) bool {
+		// the last weight given to a server wins, so only keep one per server
+		weights := make(map[string]int)
+		for _, n := range add {
+			weights[serverName(n)] = int(n%3) + 1
+		}
+		servers := make([]string, 0, len(weights))
+		for server := range weights {
+			servers = append(servers, server)
+		}
+		sort.Strings(servers)
+		a, b := New(3, collidingHash), New(3, collidingHash)
+		for _, server := range servers {
+			a.AddWeighted(server, weights[server])
+		}
+		rand.New(rand.NewSource(seed)).Shuffle(len(servers), func(i, j int) {
+			servers[i], servers[j] = servers[j], servers[i]
+		})
+		for _, server := range servers {
+			b.AddWeighted(server, weights[server])
+		}
+		keysA, ownersA := snapshot(a)
+		keysB, ownersB := snapshot(b)
+		return reflect.DeepEqual(keysA, keysB) && reflect.DeepEqual(ownersA, ownersB)
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRemoveRestoresRing(t *testing.T) {
+	f := func(add []uint8, weight uint8) bool {
+		m := New(3, collidingHash)
+		for _, n := range add {
+			m.AddWeighted(serverName(n), int(n%3)+1)
+		}
+		keys, owners := snapshot(m)
+		m.AddWeighted("extra", int(weight%3)+1)
+		m.Remove("extra")
+		keysAfter, ownersAfter := snapshot(m)
+		return reflect.DeepEqual(keys, keysAfter) && reflect.DeepEqual(owners, ownersAfter)
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -2,11 +2,19 @@ package cache
 
 import (
 	"cache/singleflight"
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// getter functions can wrap this error to tell front ends that a key does not exist in database
+var ErrNotFound = errors.New("key not found")
+
 // Getter interface
 type Getter interface{
 	Get(key string)([]byte,error)
@@ -20,6 +28,12 @@ func(f GetterFunc) Get(key string)([]byte,error){
 	return f(key)
 }
 
+// getters that implement ContextGetter are called with GetContext instead of Get
+// ctx is cancelled when the value is no longer needed, like when a hedged peer answered first
+type ContextGetter interface{
+	GetContext(ctx context.Context,key string)([]byte,error)
+}
+
 // group is the top granularity of the cache. Same type of data will be stored in the same group like"Score","Rating"
 type Group struct{
 	name string // name of group
@@ -27,6 +41,80 @@ type Group struct{
 	mainCache cache // concurrent cache for current group
 	peers PeerPicker // peer picker to fetch from peer if searched key is not in current cache
 	loader *singleflight.Group // a single flight gourp to prevent cache penetration
+	localLoader *singleflight.Group // merges loads of requests from peers, which never go to another peer
+	stats groupStats // counters of current group
+	hookMu sync.Mutex // lock for shutdown hooks
+	shutdownHooks []func(ctx context.Context) error // cleanup functions run when the node shuts down
+	ttl time.Duration // default time to live of cached values, 0 means never expire
+	replicas int // number of nodes caching each key, only used with a ReplicaPicker
+	hedge *hedgePolicy // sends a second request when a peer is slow, nil disables it
+	loadSlots chan struct{} // limits concurrent database loads, nil means no limit
+	compressor Compressor // compresses cached values, nil keeps them as they are
+	compressMin int // smaller values are not compressed
+	maxValueBytes int64 // larger values are never cached, 0 means no limit
+	passthrough bool // serve values over maxValueBytes without caching them instead of failing
+	minBytes int64 // bytes the memory budget never evicts
+	admission *admission // keeps values of keys loaded only once out of the cache, nil caches every value
+	hooks groupHooks // called on evictions, loads and errors
+}
+
+// GroupOption configures optional behaviour of a group when it is created
+type GroupOption func(*Group)
+
+// values loaded or set without explicit ttl expire after ttl, ttl <= 0 means never expire
+func WithTTL(ttl time.Duration)GroupOption{
+	return func(g *Group){
+		g.ttl = ttl
+	}
+}
+
+// cache every key on n nodes, the owner and its n-1 successors, so a failing node does not take its keys with it
+// a miss is read from the first reachable replica, the replica that loads from the database pushes the value to the others
+// it needs a peer picker that implements ReplicaPicker, like NetworkController, n <= 1 turns replication off
+func WithReplicas(n int)GroupOption{
+	return func(g *Group){
+		g.replicas = n
+	}
+}
+
+// internal counters of a group, updated atomically
+type groupStats struct{
+	gets atomic.Int64 // every Get call
+	cacheHits atomic.Int64 // served from cache in this node
+	peerLoads atomic.Int64 // served by a peer node
+	peerErrors atomic.Int64 // failed peer fetches
+	localLoads atomic.Int64 // loaded from database by this node
+	localLoadErrs atomic.Int64 // failed database loads
+	replicaPushes atomic.Int64 // values pushed to other replicas
+	handoffSent atomic.Int64 // entries streamed to new owners when the ring changed
+	handoffReceived atomic.Int64 // entries taken over from previous owners
+	hedges atomic.Int64 // second requests sent because a peer was slow
+	hedgeWins atomic.Int64 // second requests that answered before the slow peer
+	loadWaits atomic.Int64 // database loads that waited for a free slot
+	oversized atomic.Int64 // values over the size limit, rejected or passed through
+	budgetEvictions atomic.Int64 // entries evicted to keep all groups in the memory budget
+	admissionRejects atomic.Int64 // loaded values not cached because their key was not loaded often enough
+}
+
+// Stats is a snapshot of the counters and cache usage of a group
+type Stats struct{
+	Gets int64 `json:"gets"`
+	CacheHits int64 `json:"cache_hits"`
+	PeerLoads int64 `json:"peer_loads"`
+	PeerErrors int64 `json:"peer_errors"`
+	LocalLoads int64 `json:"local_loads"`
+	LocalLoadErrs int64 `json:"local_load_errs"`
+	ReplicaPushes int64 `json:"replica_pushes"`
+	HandoffSent int64 `json:"handoff_sent"`
+	HandoffReceived int64 `json:"handoff_received"`
+	Hedges int64 `json:"hedges"`
+	HedgeWins int64 `json:"hedge_wins"`
+	LoadWaits int64 `json:"load_waits"`
+	Oversized int64 `json:"oversized"`
+	BudgetEvictions int64 `json:"budget_evictions"`
+	AdmissionRejects int64 `json:"admission_rejects"`
+	Items int `json:"items"` // number of cached entries in this node
+	Bytes int64 `json:"bytes"` // bytes used by cached entries in this node, their overhead included
 }
 
 var(
@@ -35,7 +123,7 @@ var(
 )
 
 // constructor of a group, with name, cache size, and getter function to fetch data from database
-func NewGroup(name string,cacheBytes int64, getter Getter)*Group{
+func NewGroup(name string,cacheBytes int64, getter Getter, opts ...GroupOption)*Group{
 	if(getter == nil){
 		panic("nil getter")
 	}
@@ -46,8 +134,12 @@ func NewGroup(name string,cacheBytes int64, getter Getter)*Group{
 	g := &Group{
 		name:name,
 		getter: getter,
-		mainCache: cache{cacheByte: cacheBytes},
+		mainCache: cache{cacheByte: cacheBytes,overhead: -1},
 		loader: &singleflight.Group{},
+		localLoader: &singleflight.Group{},
+	}
+	for _,opt := range opts{
+		opt(g)
 	}
 	groups[name] = g
 	// return created group
@@ -63,37 +155,83 @@ func GetGroup(name string)*Group{
 	g := groups[name]
 	return g
 }
+// return names of all the groups in sorted order
+func GroupNames()[]string{
+	mu.RLock()
+	defer mu.RUnlock()
+	names := make([]string,0,len(groups))
+	for name := range groups{
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// name of current group
+func (g *Group)Name()string{
+	return g.name
+}
+
 // get function to get key from current group
 func (g *Group) Get(key string)(ByteView,error){
+	return g.get(key,true)
+}
+
+// get key, a miss is fetched from the owning peer only if forward is set
+// requests from peers are not forwarded: the peer already picked this node, asking another one adds hops or sends them back
+func (g *Group)get(key string,forward bool)(ByteView,error){
 	// null check for key
 	if(key == ""){
 		return ByteView{},fmt.Errorf("key is required")
 	}
+	g.stats.gets.Add(1)
 	// try to get value from cache in this node
-	if v,ok := g.mainCache.get(key);ok{
-		log.Println("Cache hit")
+	if v,ok := g.lookupCache(key);ok{
 		return v,nil
 	}
+	if !forward{
+		return g.loadLocally(key)
+	}
 	// current node does not contain corresponding value
 	// entering remote fetching process
 	return g.load(key)
 }
 
+// plain value of key if it is cached in this node, counted as a cache hit
+func (g *Group)lookupCache(key string)(ByteView,bool){
+	v,ok := g.mainCache.get(key)
+	if !ok{
+		return ByteView{},false
+	}
+	v,err := v.decompressed()
+	if err != nil{
+		// a value that can not be read is as good as missing
+		log.Println("[GeeCache] Failed to decompress cached value", err)
+		g.mainCache.remove(key)
+		return ByteView{},false
+	}
+	log.Println("Cache hit")
+	g.stats.cacheHits.Add(1)
+	return v,true
+}
+
 // function to load data from remote node or database
 func (g *Group) load(key string) (value ByteView, err error) {
 	// each key is only fetched once (either locally or remotely)
 	// regardless of the number of concurrent callers.
 	viewi, err := g.loader.Do(key, func() (interface{}, error) {
+		if rp, ok := g.peers.(ReplicaPicker); ok && g.replicas > 1 {
+			return g.loadReplicated(rp, key)
+		}
 		if g.peers != nil {
 			if peer, ok := g.peers.PickPeer(key); ok {
-				if value, err = g.getFromPeer(peer, key); err == nil {
-					return value, nil
-				}
-				log.Println("[GeeCache] Failed to get from peer", err)
+				return g.getFromPeerOr(context.Background(), peer, key, func(ctx context.Context) (ByteView, error) {
+					return g.getLocally(ctx, key)
+				})
 			}
 		}
 
-		return g.getLocally(key)
+		return g.getLocally(context.Background(), key)
 	})
 
 	if err == nil {
@@ -102,23 +240,114 @@ func (g *Group) load(key string) (value ByteView, err error) {
 	return
 }
 
-// use the peer getter function to fetch data
-func (g *Group)getFromPeer(peer PeerGetter, key string)(ByteView,error){
-	bytes,err := peer.Get(g.name,key)
+// load key from the database of this node, concurrent loads of a key are merged apart from those of load
+// so a peer request never waits on a load of this node that was forwarded to a peer
+func (g *Group)loadLocally(key string)(ByteView,error){
+	viewi,err := g.localLoader.Do(key,func()(interface{},error){
+		return g.getLocally(context.Background(),key)
+	})
+	if err != nil{
+		return ByteView{},err
+	}
+	return viewi.(ByteView),nil
+}
+
+// read key from the first replica that answers
+// if this node is a replica it loads from the database itself and pushes the value to the other replicas
+func (g *Group) loadReplicated(rp ReplicaPicker, key string) (ByteView, error) {
+	return g.loadFromReplicas(context.Background(), key, rp.PickReplicas(key, g.replicas), 0)
+}
+
+// load key from replicas[i], falling back to the replicas after it
+func (g *Group) loadFromReplicas(ctx context.Context, key string, replicas []PeerGetter, i int) (ByteView, error) {
+	if i == len(replicas) {
+		// no replica answered, the database is the last resort
+		return g.getLocally(ctx, key)
+	}
+	if replicas[i] == nil {
+		value, err := g.getLocally(ctx, key)
+		// values not cached here, too large or not admitted, are not cached by the other replicas either
+		if err == nil && g.mainCache.contains(key) {
+			g.pushReplicas(key, value, replicas, i)
+		}
+		return value, err
+	}
+	return g.getFromPeerOr(ctx, replicas[i], key, func(ctx context.Context) (ByteView, error) {
+		return g.loadFromReplicas(ctx, key, replicas, i+1)
+	})
+}
+
+// send value to every replica except the one at index self, in the background
+func (g *Group) pushReplicas(key string, value ByteView, replicas []PeerGetter, self int) {
+	for i, peer := range replicas {
+		setter, ok := peer.(PeerSetter)
+		if i == self || !ok {
+			continue
+		}
+		go func() {
+			if err := setter.Set(g.name, key, value.b); err != nil {
+				// without peer auth replicas fill up by loading themselves
+				if !errors.Is(err, ErrPeerWritesOff) {
+					log.Println("[GeeCache] Failed to push to replica", err)
+				}
+				return
+			}
+			g.stats.replicaPushes.Add(1)
+		}()
+	}
+}
+
+// use the peer getter function to fetch data, the request is cancelled with ctx if the getter supports it
+func (g *Group)getFromPeer(ctx context.Context, peer PeerGetter, key string)(ByteView,error){
+	var bytes []byte
+	var err error
+	if cg,ok := peer.(ContextPeerGetter);ok{
+		bytes,err = cg.GetContext(ctx,g.name,key)
+	}else{
+		bytes,err = peer.Get(g.name,key)
+	}
 	if err != nil{
 		// fetch failed
 		return ByteView{},err
 	}
-	return ByteView{bytes},nil
+	return ByteView{b: bytes},nil
 }
 
-// fetch data from database
-func (g *Group)getLocally(key string)(ByteView,error){
-	bytes,err := g.getter.Get(key)
+// fetch data from database, waiting for a load slot until ctx is done
+func (g *Group)getLocally(ctx context.Context,key string)(ByteView,error){
+	release,err := g.acquireLoad(ctx)
+	if err != nil{
+		return ByteView{},err
+	}
+	var bytes []byte
+	start := time.Now()
+	if cg,ok := g.getter.(ContextGetter);ok{
+		bytes,err = cg.GetContext(ctx,key)
+	}else{
+		bytes,err = g.getter.Get(key)
+	}
+	took := time.Since(start)
+	release()
 	// fetch failed
 	if err != nil{
+		// the caller gave up, like a hedged peer fetch that won, the load did not fail
+		if ctx.Err() != nil{
+			return ByteView{},err
+		}
+		g.stats.localLoadErrs.Add(1)
+		g.failed(key,err)
 		return ByteView{},err
 	}
+	g.stats.localLoads.Add(1)
+	g.loaded(key,ByteView{b: bytes},took)
+	if !g.fits(int64(len(bytes))){
+		g.stats.oversized.Add(1)
+		if !g.passthrough{
+			return ByteView{},g.tooLarge(key,int64(len(bytes)))
+		}
+		// served, but not cached
+		return ByteView{b: cloneByte(bytes)},nil
+	}
 	// retrieve the data
 	value := ByteView{
 		// return its copy, its read only
@@ -130,13 +359,20 @@ func (g *Group)getLocally(key string)(ByteView,error){
 	// then I realized that in this case, we are actually using a distributed database as well
 	// So if the key are not suppose to be store in this cache. Other cache node should have trigger this procedure as well.
 	// Only if other peer node does not have the data, then we will reach this step.
-	g.populateCache(key,value)
+	if g.admits(key){
+		g.populateCache(key,value)
+	}
 	return value,nil
 }
 
 // add node and value into cache in current node
 func (g *Group)populateCache(key string,value ByteView){
-	g.mainCache.add(key,value)
+	g.store(key,value,expireAt(g.ttl))
+}
+
+// cache value in the form the group keeps it in, compressed if it compresses values
+func (g *Group)store(key string,value ByteView,expire time.Time){
+	g.mainCache.addWithExpire(key,g.compress(value),expire)
 }
 
 // inject peer picker into current node
@@ -147,5 +383,123 @@ func (g *Group)RegisterPeers(peers PeerPicker){
 	g.peers = peers
 }
 
+// store value for key in the cache of this node, the value is copied and expires after the group ttl
+// it does not write through to the database, the getter stays the source of truth
+func (g *Group)Set(key string,value []byte)error{
+	return g.SetWithTTL(key,value,g.ttl)
+}
+
+// same as Set, but the value expires after ttl, ttl <= 0 means never expire
+func (g *Group)SetWithTTL(key string,value []byte,ttl time.Duration)error{
+	if key == ""{
+		return fmt.Errorf("key is required")
+	}
+	if !g.fits(int64(len(value))){
+		return g.tooLarge(key,int64(len(value)))
+	}
+	g.store(key,ByteView{b: cloneByte(value)},expireAt(ttl))
+	return nil
+}
+
+// change the ttl of a key cached in this node, return false if key is not cached
+func (g *Group)Touch(key string,ttl time.Duration)bool{
+	return g.mainCache.touch(key,expireAt(ttl))
+}
+
+// check if key is cached in this node, this never triggers a load
+func (g *Group)Cached(key string)bool{
+	return g.mainCache.contains(key)
+}
+
+// convert a ttl into an absolute expire time, zero time means never expire
+func expireAt(ttl time.Duration)time.Time{
+	if ttl <= 0{
+		return time.Time{}
+	}
+	return time.Now().Add(ttl)
+}
+
+// remove key from the cache of this node, return true if it was cached
+func (g *Group)Delete(key string)bool{
+	return g.mainCache.remove(key)
+}
+
+// snapshot of counters and cache usage of current group
+func (g *Group)Stats()Stats{
+	items,bytes := g.mainCache.stats()
+	return Stats{
+		Gets: g.stats.gets.Load(),
+		CacheHits: g.stats.cacheHits.Load(),
+		PeerLoads: g.stats.peerLoads.Load(),
+		PeerErrors: g.stats.peerErrors.Load(),
+		LocalLoads: g.stats.localLoads.Load(),
+		LocalLoadErrs: g.stats.localLoadErrs.Load(),
+		ReplicaPushes: g.stats.replicaPushes.Load(),
+		HandoffSent: g.stats.handoffSent.Load(),
+		HandoffReceived: g.stats.handoffReceived.Load(),
+		Hedges: g.stats.hedges.Load(),
+		HedgeWins: g.stats.hedgeWins.Load(),
+		LoadWaits: g.stats.loadWaits.Load(),
+		Oversized: g.stats.oversized.Load(),
+		BudgetEvictions: g.stats.budgetEvictions.Load(),
+		AdmissionRejects: g.stats.admissionRejects.Load(),
+		Items: items,
+		Bytes: bytes,
+	}
+}
 
+// register a function that is called when the node shuts down, after ongoing loads are drained
+// hooks run in the order they were registered
+func (g *Group)OnShutdown(fn func(ctx context.Context) error){
+	g.hookMu.Lock()
+	defer g.hookMu.Unlock()
+	g.shutdownHooks = append(g.shutdownHooks, fn)
+}
 
+// wait for ongoing loads of current group to finish, then run its shutdown hooks
+func (g *Group)shutdown(ctx context.Context)error{
+	drained := make(chan struct{})
+	go func(){
+		g.loader.Wait()
+		g.localLoader.Wait()
+		close(drained)
+	}()
+	select{
+	case <-drained:
+	case <-ctx.Done():
+		return fmt.Errorf("group %s: draining loads: %w",g.name,ctx.Err())
+	}
+
+	g.hookMu.Lock()
+	hooks := append([]func(ctx context.Context) error(nil),g.shutdownHooks...)
+	g.hookMu.Unlock()
+	// every hook runs even if an earlier one failed, the first error is returned
+	var first error
+	for _,hook := range hooks{
+		if err := hook(ctx);err != nil{
+			log.Printf("[Group %s] shutdown hook failed: %v",g.name,err)
+			if first == nil{
+				first = fmt.Errorf("group %s: %w",g.name,err)
+			}
+		}
+	}
+	return first
+}
+
+// shut down every group, call it after the servers stopped taking new requests
+func Shutdown(ctx context.Context)error{
+	mu.RLock()
+	all := make([]*Group,0,len(groups))
+	for _,g := range groups{
+		all = append(all, g)
+	}
+	mu.RUnlock()
+
+	var first error
+	for _,g := range all{
+		if err := g.shutdown(ctx);err != nil && first == nil{
+			first = err
+		}
+	}
+	return first
+}
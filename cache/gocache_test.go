@@ -1,10 +1,13 @@
 package cache
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"reflect"
+	"sync"
 	"testing"
+	"time"
 )
 
 var db = map[string]string{
@@ -68,3 +71,113 @@ func TestGroup(t *testing.T) {
 }
 
 
+
+func TestShutdown(t *testing.T) {
+	release := make(chan struct{})
+	loaded := make(chan struct{})
+	var mu sync.Mutex
+	var order []string
+	record := func(event string) {
+		mu.Lock()
+		defer mu.Unlock()
+		order = append(order, event)
+	}
+	g := NewGroup("shutdown", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		close(loaded)
+		<-release
+		record("load")
+		return []byte(key), nil
+	}))
+	g.OnShutdown(func(ctx context.Context) error {
+		record("hook")
+		return nil
+	})
+
+	go g.Get("slow")
+	<-loaded
+
+	// shutdown must give up when the load does not finish in time
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := g.shutdown(ctx); err == nil {
+		t.Fatal("expect shutdown to time out while a load is in flight")
+	}
+
+	close(release)
+	if err := g.shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(order, []string{"load", "hook"}) {
+		t.Fatalf("expect hook to run after the load drained, got %v", order)
+	}
+}
+
+// peer that answers from a fixed map, or fails if down
+type fakePeer struct {
+	mu     sync.Mutex
+	values map[string]string
+	down   bool
+	pushed chan string
+}
+
+func (p *fakePeer) Get(group string, key string) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if v, ok := p.values[key]; ok && !p.down {
+		return []byte(v), nil
+	}
+	return nil, fmt.Errorf("%s: not cached", key)
+}
+
+func (p *fakePeer) Set(group string, key string, value []byte) error {
+	p.mu.Lock()
+	p.values[key] = string(value)
+	p.mu.Unlock()
+	p.pushed <- key
+	return nil
+}
+
+// replica picker returning the same replicas for every key
+type fakeReplicas []PeerGetter
+
+func (r fakeReplicas) PickPeer(key string) (PeerGetter, bool) { return r[0], r[0] != nil }
+
+func (r fakeReplicas) PickReplicas(key string, n int) []PeerGetter { return r[:n] }
+
+func TestReplicatedLoad(t *testing.T) {
+	var dbLoads int
+	g := NewGroup("replicated", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		dbLoads++
+		return []byte(db[key]), nil
+	}), WithReplicas(3))
+	down := &fakePeer{values: map[string]string{"Tom": "630"}, down: true, pushed: make(chan string, 10)}
+	warm := &fakePeer{values: map[string]string{"Tom": "630"}, pushed: make(chan string, 10)}
+	cold := &fakePeer{values: map[string]string{}, pushed: make(chan string, 10)}
+
+	// the owner is down, the next replica still has the key, so the database is not asked
+	g.peers = fakeReplicas{down, warm, nil}
+	if v, err := g.Get("Tom"); err != nil || v.String() != "630" || dbLoads != 0 {
+		t.Fatalf("expect Tom from the warm replica, got %q %v after %d database loads", v.String(), err, dbLoads)
+	}
+
+	// this node is a replica, so it loads Jack itself and pushes it to the other replicas
+	g.peers = fakeReplicas{down, nil, cold}
+	if v, err := g.Get("Jack"); err != nil || v.String() != "589" || dbLoads != 1 {
+		t.Fatalf("expect Jack from the database, got %q %v after %d database loads", v.String(), err, dbLoads)
+	}
+	for _, p := range []*fakePeer{down, cold} {
+		select {
+		case key := <-p.pushed:
+			if key != "Jack" {
+				t.Fatalf("expect Jack to be pushed, got %s", key)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("value was not pushed to replica")
+		}
+	}
+	if st := g.Stats(); st.PeerErrors != 2 || st.PeerLoads != 1 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+}
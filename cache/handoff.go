@@ -0,0 +1,304 @@
+package cache
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// when the ring changes a node streams the entries it no longer owns to their new owner under this path
+const transferPath = "_transfer"
+
+// largest key accepted in a transfer stream
+const maxTransferKeyBytes = 64<<10
+
+// turn on warm key handoff: whenever peers join, leave or change weight, cached keys that move to another peer
+// are streamed to it in the background, at most bytesPerSecond bytes per second so normal traffic is not starved
+// 0 turns it off, call it before the controller starts serving
+func (p *NetworkController)SetHandoffRate(bytesPerSecond int64){
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.handoffRate = bytesPerSecond
+}
+
+// copy of the current selector, so keys can be compared before and after a change, caller holds the lock
+func (p *NetworkController)snapshotLocked(without string)PeerSelector{
+	s := p.newSelector()
+	p.fillLocked(s,without)
+	return s
+}
+
+// start moving keys from the ring before to the current one in the background
+// a handoff that is still running is cancelled, the new one starts from its ring so the keys it did not move yet are not lost
+// caller holds the lock
+func (p *NetworkController)startHandoffLocked(before PeerSelector){
+	if p.handoffCancel != nil{
+		p.handoffCancel()
+		before = p.handoffBefore
+	}
+	ctx,cancel := context.WithCancel(context.Background())
+	p.handoffSeq++
+	seq := p.handoffSeq
+	p.handoffCancel,p.handoffBefore = cancel,before
+	after := p.snapshotLocked("")
+	go func(){
+		defer cancel()
+		err := p.handoff(ctx,before,after)
+		if err != nil && !errors.Is(err,context.Canceled){
+			p.Log("Handoff failed: %v",err)
+		}
+		p.mu.Lock()
+		if p.handoffSeq == seq{
+			p.handoffCancel,p.handoffBefore = nil,nil
+		}
+		p.mu.Unlock()
+	}()
+}
+
+// stop a running handoff
+func (p *NetworkController)stopHandoff(){
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.handoffCancel != nil{
+		p.handoffCancel()
+		p.handoffCancel,p.handoffBefore = nil,nil
+	}
+}
+
+// hand every key this node is responsible for to the peers that own it once this node is gone
+// used when the node shuts down, it does nothing unless handoff is turned on
+func (p *NetworkController)handoffLeaving(ctx context.Context)error{
+	p.stopHandoff()
+	p.mu.Lock()
+	if p.handoffRate <= 0 || p.peers == nil{
+		p.mu.Unlock()
+		return nil
+	}
+	before,after := p.snapshotLocked(""),p.snapshotLocked(p.self)
+	p.mu.Unlock()
+	return p.handoff(ctx,before,after)
+}
+
+// stream the cached keys of every group served by this controller whose replicas changed from before to after
+// only keys this node was responsible for are sent, to the peers that did not have them before
+func (p *NetworkController)handoff(ctx context.Context,before PeerSelector,after PeerSelector)error{
+	p.mu.Lock()
+	pace := &throttle{rate: p.handoffRate,start: time.Now()}
+	p.mu.Unlock()
+	for _,name := range GroupNames(){
+		g := GetGroup(name)
+		if g == nil || g.peers != PeerPicker(p){
+			continue
+		}
+		moved := p.movedKeys(g,before,after)
+		peers := make([]string,0,len(moved))
+		for peer := range moved{
+			peers = append(peers, peer)
+		}
+		sort.Strings(peers)
+		for _,peer := range peers{
+			n,err := p.transfer(ctx,peer,g,moved[peer],pace)
+			g.stats.handoffSent.Add(int64(n))
+			if err != nil{
+				return fmt.Errorf("group %s to %s: %w",g.name,peer,err)
+			}
+			p.Log("Handed %d keys of group %s to %s",n,g.name,peer)
+		}
+	}
+	return nil
+}
+
+// cached keys of g that gained a replica, grouped by that new replica
+func (p *NetworkController)movedKeys(g *Group,before PeerSelector,after PeerSelector)map[string][]string{
+	n := 1
+	if g.replicas > 1{
+		n = g.replicas
+	}
+	moved := make(map[string][]string)
+	for _,key := range g.mainCache.keys(){
+		old := before.GetN(key,n)
+		if !containsPeer(old,p.self){
+			continue
+		}
+		for _,peer := range after.GetN(key,n){
+			if peer != p.self && !containsPeer(old,peer){
+				moved[peer] = append(moved[peer], key)
+			}
+		}
+	}
+	return moved
+}
+
+func containsPeer(peers []string,peer string)bool{
+	for _,p := range peers{
+		if p == peer{
+			return true
+		}
+	}
+	return false
+}
+
+// stream the entries of keys to peer in one request, return how many were sent
+// keys evicted or expired in the meantime are skipped
+func (p *NetworkController)transfer(ctx context.Context,peer string,g *Group,keys []string,pace *throttle)(int,error){
+	ctx,cancel := context.WithCancel(ctx)
+	defer cancel()
+	pr,pw := io.Pipe()
+	sent := 0
+	done := make(chan struct{})
+	go func(){
+		defer close(done)
+		w := bufio.NewWriter(pw)
+		for _,key := range keys{
+			value,expire,ok := g.mainCache.peek(key)
+			if !ok{
+				continue
+			}
+			// the new owner may keep values in another form, so they travel plain
+			value,err := value.decompressed()
+			if err != nil{
+				continue
+			}
+			if err := writeEntry(w,key,value.b,expire);err != nil{
+				pw.CloseWithError(err)
+				return
+			}
+			sent++
+			if err := pace.wait(ctx,len(key)+value.Len());err != nil{
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.CloseWithError(w.Flush())
+	}()
+
+	u := fmt.Sprintf("%v%v%v/%v",peer,p.basePath,transferPath,url.QueryEscape(g.name))
+	// a stream may take much longer than a single fetch, so the peer timeout does not apply
+	client := *p.client
+	client.Timeout = 0
+	req,err := http.NewRequestWithContext(ctx,http.MethodPost,u,pr)
+	if err == nil{
+		// a stream can not be hashed up front, the signature covers everything but the body
+		err = p.keys.sign(req)
+	}
+	var res *http.Response
+	if err == nil{
+		res,err = client.Do(req)
+	}
+	// make sure the writer goroutine is done before sent is read
+	cancel()
+	pr.Close()
+	<-done
+	if err != nil{
+		return 0,err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK{
+		return 0,fmt.Errorf("server returned %v",res.Status)
+	}
+	return sent,nil
+}
+
+// cache the entries of a transfer stream in g, keys already cached are kept, return how many were added
+func (g *Group)receiveEntries(r io.Reader,maxValueBytes int)(int,error){
+	br := bufio.NewReader(r)
+	added := 0
+	for{
+		key,value,expire,err := readEntry(br,maxValueBytes)
+		if err == io.EOF{
+			return added,nil
+		}
+		if err != nil{
+			return added,err
+		}
+		if (!expire.IsZero() && time.Now().After(expire)) || g.mainCache.contains(key) || !g.fits(int64(len(value))){
+			continue
+		}
+		g.store(key,ByteView{b: value},expire)
+		g.stats.handoffReceived.Add(1)
+		added++
+	}
+}
+
+// an entry on the wire: key length, key, value length, value, expire time in unix nanoseconds or 0
+func writeEntry(w *bufio.Writer,key string,value []byte,expire time.Time)error{
+	var buf [binary.MaxVarintLen64]byte
+	var nanos int64
+	if !expire.IsZero(){
+		nanos = expire.UnixNano()
+	}
+	w.Write(buf[:binary.PutUvarint(buf[:],uint64(len(key)))])
+	w.WriteString(key)
+	w.Write(buf[:binary.PutUvarint(buf[:],uint64(len(value)))])
+	w.Write(value)
+	_,err := w.Write(buf[:binary.PutVarint(buf[:],nanos)])
+	return err
+}
+
+// read one entry written by writeEntry, io.EOF means the stream ended cleanly
+func readEntry(r *bufio.Reader,maxValueBytes int)(key string,value []byte,expire time.Time,err error){
+	keyLen,err := binary.ReadUvarint(r)
+	if err != nil{
+		return
+	}
+	if keyLen == 0 || keyLen > maxTransferKeyBytes{
+		return "",nil,time.Time{},fmt.Errorf("invalid key length %d",keyLen)
+	}
+	k := make([]byte,keyLen)
+	if _,err = io.ReadFull(r,k);err != nil{
+		return "",nil,time.Time{},io.ErrUnexpectedEOF
+	}
+	valueLen,err := binary.ReadUvarint(r)
+	if err != nil{
+		return "",nil,time.Time{},io.ErrUnexpectedEOF
+	}
+	if valueLen > uint64(maxValueBytes){
+		return "",nil,time.Time{},fmt.Errorf("value of %s is %d bytes, limit is %d",k,valueLen,maxValueBytes)
+	}
+	value = make([]byte,valueLen)
+	if _,err = io.ReadFull(r,value);err != nil{
+		return "",nil,time.Time{},io.ErrUnexpectedEOF
+	}
+	nanos,err := binary.ReadVarint(r)
+	if err != nil{
+		return "",nil,time.Time{},io.ErrUnexpectedEOF
+	}
+	if nanos != 0{
+		expire = time.Unix(0,nanos)
+	}
+	return string(k),value,expire,nil
+}
+
+// paces a stream to rate bytes per second, rate <= 0 means no limit
+type throttle struct{
+	rate int64
+	start time.Time
+	sent int64
+}
+
+// account n more bytes and sleep until the stream is back under its rate
+func (t *throttle)wait(ctx context.Context,n int)error{
+	t.sent += int64(n)
+	if t.rate <= 0{
+		return ctx.Err()
+	}
+	ahead := time.Duration(float64(t.sent)/float64(t.rate)*float64(time.Second)) - time.Since(t.start)
+	if ahead <= 0{
+		return ctx.Err()
+	}
+	timer := time.NewTimer(ahead)
+	defer timer.Stop()
+	select{
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
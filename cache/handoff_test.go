@@ -0,0 +1,190 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTransferEntries(t *testing.T) {
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	writeEntry(w, "Tom", []byte("630"), time.Time{})
+	writeEntry(w, "Jack", []byte("589"), time.Now().Add(time.Hour))
+	writeEntry(w, "Sam", []byte("567"), time.Now().Add(-time.Second))
+	w.Flush()
+
+	g := NewGroup("transfer", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		return nil, ErrNotFound
+	}))
+	g.Set("Jack", []byte("newer"))
+	n, err := g.receiveEntries(&buf, 1<<10)
+	if err != nil || n != 1 {
+		t.Fatalf("expect only Tom to be added, got %d %v", n, err)
+	}
+	// expired entries are dropped and cached keys are kept
+	for key, expect := range map[string]string{"Tom": "630", "Jack": "newer"} {
+		if v, err := g.Get(key); err != nil || v.String() != expect {
+			t.Fatalf("expect %s=%s, got %q %v", key, expect, v.String(), err)
+		}
+	}
+	if g.Cached("Sam") {
+		t.Fatal("expired entry should not be cached")
+	}
+
+	// a truncated stream is an error
+	writeEntry(w, "Tom", []byte("630"), time.Time{})
+	w.Flush()
+	if _, err := g.receiveEntries(bytes.NewReader(buf.Bytes()[:4]), 1<<10); err == nil {
+		t.Fatal("expect truncated stream to fail")
+	}
+}
+
+func TestHandoffOnJoin(t *testing.T) {
+	// the joining peer records the keys streamed to it
+	var mu sync.Mutex
+	var received []string
+	done := make(chan struct{})
+	joining := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		br := bufio.NewReader(r.Body)
+		for {
+			key, _, _, err := readEntry(br, 1<<10)
+			if err != nil {
+				break
+			}
+			mu.Lock()
+			received = append(received, key)
+			mu.Unlock()
+		}
+		close(done)
+	}))
+	defer joining.Close()
+
+	self := "http://self"
+	g := NewGroup("handoff", 64<<10, GetterFunc(func(key string) ([]byte, error) {
+		return []byte(key), nil
+	}))
+	p := NewNetworkController(self)
+	p.SetHandoffRate(1 << 20)
+	p.Set(self)
+	g.RegisterPeers(p)
+	for i := 0; i < 200; i++ {
+		key := "key" + strconv.Itoa(i)
+		g.populateCache(key, ByteView{b: []byte(key)})
+	}
+
+	p.Set(self, joining.URL)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handoff did not reach the joining peer")
+	}
+
+	var expect []string
+	for i := 0; i < 200; i++ {
+		if key := "key" + strconv.Itoa(i); p.Owner(key) == joining.URL {
+			expect = append(expect, key)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	sort.Strings(expect)
+	sort.Strings(received)
+	if len(expect) == 0 || !reflect.DeepEqual(expect, received) {
+		t.Fatalf("expect the %d keys the joining peer owns, got %d", len(expect), len(received))
+	}
+}
+
+func TestHandoffOnLeave(t *testing.T) {
+	// the peers left on the ring record the keys streamed to them
+	var mu sync.Mutex
+	received := make(map[string][]string)
+	var peers []string
+	for i := 0; i < 2; i++ {
+		peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			br := bufio.NewReader(r.Body)
+			for {
+				key, _, _, err := readEntry(br, 1<<10)
+				if err != nil {
+					break
+				}
+				mu.Lock()
+				received[key] = append(received[key], "http://"+r.Host)
+				mu.Unlock()
+			}
+		}))
+		defer peer.Close()
+		peers = append(peers, peer.URL)
+	}
+
+	self, gone := "http://self", "http://gone"
+	g := NewGroup("handoff-leave", 64<<10, GetterFunc(func(key string) ([]byte, error) {
+		return []byte(key), nil
+	}), WithReplicas(2))
+	p := NewNetworkController(self)
+	p.SetHandoffRate(1 << 20)
+	p.Set(append([]string{self, gone}, peers...)...)
+	g.RegisterPeers(p)
+	for i := 0; i < 200; i++ {
+		key := "key" + strconv.Itoa(i)
+		g.populateCache(key, ByteView{b: []byte(key)})
+	}
+
+	// keys we shared with the leaving peer gain a new replica, which gets our copy
+	expect := make(map[string][]string)
+	for i := 0; i < 200; i++ {
+		key := "key" + strconv.Itoa(i)
+		if replicas := p.peers.GetN(key, 2); containsPeer(replicas, self) && containsPeer(replicas, gone) {
+			expect[key] = nil
+		}
+	}
+	p.Remove(gone)
+	for key := range expect {
+		for _, peer := range p.peers.GetN(key, 2) {
+			if peer != self {
+				expect[key] = append(expect[key], peer)
+			}
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		done := reflect.DeepEqual(expect, received)
+		got := len(received)
+		mu.Unlock()
+		if done && len(expect) > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expect %d keys handed to their new replicas, got %d", len(expect), got)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	pace := &throttle{rate: 10000, start: time.Now()}
+	for i := 0; i < 3; i++ {
+		if err := pace.wait(context.Background(), 1000); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 3000 bytes at 10000 bytes per second
+	if elapsed := time.Since(pace.start); elapsed < 250*time.Millisecond {
+		t.Fatalf("expect the stream to be slowed down, took %v", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := pace.wait(ctx, 1000); err == nil {
+		t.Fatal("expect a cancelled wait to fail")
+	}
+}
@@ -0,0 +1,181 @@
+package cache
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// number of recent peer fetches the hedge delay is computed from
+	hedgeWindow = 256
+	// hedging starts once this many fetches were timed
+	hedgeMinSamples = 20
+)
+
+// send a second request when a peer is slow: if the peer has not answered after the given percentile
+// of recent peer fetch times (like 0.95), but at least minDelay, the next replica or the database is asked too
+// the first success wins and the other request is cancelled, percentile <= 0 turns hedging off
+func WithHedging(percentile float64,minDelay time.Duration)GroupOption{
+	return func(g *Group){
+		if percentile <= 0{
+			g.hedge = nil
+			return
+		}
+		if percentile > 1{
+			percentile = 1
+		}
+		g.hedge = &hedgePolicy{percentile: percentile,minDelay: minDelay}
+	}
+}
+
+// when to hedge, learned from the latency of successful peer fetches
+type hedgePolicy struct{
+	percentile float64
+	minDelay time.Duration
+	mu sync.Mutex
+	samples [hedgeWindow]time.Duration // ring buffer of recent fetch times
+	n int // number of samples recorded, up to hedgeWindow
+	next int // slot of the next sample
+}
+
+// record the duration of a successful peer fetch
+func (h *hedgePolicy)observe(d time.Duration){
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.samples[h.next] = d
+	h.next = (h.next+1)%hedgeWindow
+	if h.n < hedgeWindow{
+		h.n++
+	}
+}
+
+// how long to wait for a peer before hedging, false until enough fetches were seen
+func (h *hedgePolicy)delay()(time.Duration,bool){
+	h.mu.Lock()
+	if h.n < hedgeMinSamples{
+		h.mu.Unlock()
+		return 0,false
+	}
+	sorted := make([]time.Duration,h.n)
+	copy(sorted,h.samples[:h.n])
+	h.mu.Unlock()
+	sort.Slice(sorted,func(i,j int)bool{
+		return sorted[i] < sorted[j]
+	})
+	d := sorted[int(h.percentile*float64(len(sorted)-1))]
+	if d < h.minDelay{
+		d = h.minDelay
+	}
+	return d,true
+}
+
+// fetch key from peer, and use fallback (the next replica or the database) if that fails
+// with hedging on, fallback also starts when peer is slower than the hedge delay, the first success wins
+func (g *Group)getFromPeerOr(ctx context.Context,peer PeerGetter,key string,fallback func(ctx context.Context)(ByteView,error))(ByteView,error){
+	var delay time.Duration
+	hedging := false
+	if g.hedge != nil{
+		delay,hedging = g.hedge.delay()
+	}
+	if !hedging{
+		start := time.Now()
+		value,err := g.getFromPeer(ctx,peer,key)
+		if err == nil{
+			g.peerFetched(key,value,start)
+			return value,nil
+		}
+		// the database would give us the same answer
+		if peerAnswered(err){
+			return ByteView{},err
+		}
+		g.peerFailed(key,err)
+		return fallback(ctx)
+	}
+
+	// whichever request loses is cancelled when we return
+	ctx,cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct{
+		value ByteView
+		err error
+		hedge bool
+	}
+	// buffered, so the loser can finish after we returned
+	results := make(chan result,2)
+	start := time.Now()
+	go func(){
+		value,err := g.getFromPeer(ctx,peer,key)
+		results <- result{value: value,err: err}
+	}()
+	startFallback := func(){
+		go func(){
+			value,err := fallback(ctx)
+			results <- result{value: value,err: err,hedge: true}
+		}()
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	pending := 1
+	fallbackStarted := false
+	var fallbackErr error
+	for pending > 0{
+		select{
+		case <-timer.C:
+			if !fallbackStarted{
+				g.stats.hedges.Add(1)
+				fallbackStarted = true
+				pending++
+				startFallback()
+			}
+		case r := <-results:
+			pending--
+			if !r.hedge{
+				if r.err == nil{
+					g.peerFetched(key,r.value,start)
+					return r.value,nil
+				}
+				if peerAnswered(r.err){
+					return ByteView{},r.err
+				}
+				g.peerFailed(key,r.err)
+				if !fallbackStarted{
+					// the peer failed before we hedged, fall back as usual
+					fallbackStarted = true
+					pending++
+					startFallback()
+				}
+				continue
+			}
+			if r.err == nil{
+				// only a hedge that overtook a pending peer counts as won
+				if pending > 0{
+					g.stats.hedgeWins.Add(1)
+				}
+				return r.value,nil
+			}
+			fallbackErr = r.err
+		}
+	}
+	// both failed, the fallback has the final word, like ErrNotFound from the database
+	return ByteView{},fallbackErr
+}
+
+// count a successful peer fetch of key that started at start
+func (g *Group)peerFetched(key string,value ByteView,start time.Time){
+	took := time.Since(start)
+	g.stats.peerLoads.Add(1)
+	if g.hedge != nil{
+		g.hedge.observe(took)
+	}
+	g.peerLoaded(key,value,took)
+}
+
+func (g *Group)peerFailed(key string,err error){
+	g.stats.peerErrors.Add(1)
+	log.Println("[GeeCache] Failed to get from peer", err)
+	g.failed(key,err)
+}
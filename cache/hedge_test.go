@@ -0,0 +1,158 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// peer that answers after a delay, or gives up when its request is cancelled
+type slowPeer struct {
+	delay     time.Duration
+	err       error // returned instead of a value
+	cancelled chan struct{}
+}
+
+func (p *slowPeer) Get(group string, key string) ([]byte, error) {
+	return p.GetContext(context.Background(), group, key)
+}
+
+func (p *slowPeer) GetContext(ctx context.Context, group string, key string) ([]byte, error) {
+	select {
+	case <-time.After(p.delay):
+		if p.err != nil {
+			return nil, p.err
+		}
+		return []byte("peer"), nil
+	case <-ctx.Done():
+		close(p.cancelled)
+		return nil, ctx.Err()
+	}
+}
+
+func TestHedgeDelay(t *testing.T) {
+	h := &hedgePolicy{percentile: 0.9, minDelay: 5 * time.Millisecond}
+	if _, ok := h.delay(); ok {
+		t.Fatal("expect no hedging without samples")
+	}
+	for i := 1; i <= 100; i++ {
+		h.observe(time.Duration(i) * time.Millisecond)
+	}
+	if d, ok := h.delay(); !ok || d != 90*time.Millisecond {
+		t.Fatalf("expect 90th percentile of 90ms, got %v", d)
+	}
+	h.minDelay = time.Second
+	if d, _ := h.delay(); d != time.Second {
+		t.Fatalf("expect delay of at least minDelay, got %v", d)
+	}
+}
+
+func TestHedgedLoad(t *testing.T) {
+	g := NewGroup("hedged", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		if key == "missing" {
+			return nil, fmt.Errorf("%s: %w", key, ErrNotFound)
+		}
+		return []byte("db"), nil
+	}), WithHedging(0.95, 10*time.Millisecond))
+	for i := 0; i < hedgeMinSamples; i++ {
+		g.hedge.observe(time.Millisecond)
+	}
+
+	// a fast peer answers before the hedge delay
+	fast := &slowPeer{delay: 0, cancelled: make(chan struct{})}
+	g.peers = fakeReplicas{fast}
+	if v, err := g.Get("fast"); err != nil || v.String() != "peer" {
+		t.Fatalf("expect value from peer, got %q %v", v.String(), err)
+	}
+
+	// a slow peer is overtaken by the database and its request cancelled
+	slow := &slowPeer{delay: time.Second, cancelled: make(chan struct{})}
+	g.peers = fakeReplicas{slow}
+	start := time.Now()
+	if v, err := g.Get("slow"); err != nil || v.String() != "db" {
+		t.Fatalf("expect value from database, got %q %v", v.String(), err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("hedged load took %v", elapsed)
+	}
+	select {
+	case <-slow.cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("expect the slow request to be cancelled")
+	}
+
+	// both fail, the error of the database is returned
+	g.peers = fakeReplicas{&slowPeer{delay: 50 * time.Millisecond, err: fmt.Errorf("peer down"), cancelled: make(chan struct{})}}
+	if _, err := g.Get("missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expect not found, got %v", err)
+	}
+
+	if st := g.Stats(); st.Hedges != 2 || st.HedgeWins != 1 || st.PeerLoads != 1 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+}
+
+func TestPeerNotFound(t *testing.T) {
+	for _, hedging := range []bool{false, true} {
+		loads, errs := 0, 0
+		opts := []GroupOption{WithOnError(func(key string, err error) { errs++ })}
+		if hedging {
+			opts = append(opts, WithHedging(0.95, time.Second))
+		}
+		g := NewGroup("peer-not-found", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+			loads++
+			return []byte("db"), nil
+		}), opts...)
+		if hedging {
+			for i := 0; i < hedgeMinSamples; i++ {
+				g.hedge.observe(time.Millisecond)
+			}
+		}
+		// the owner looked the key up in the database, asking it again would say the same
+		g.peers = fakeReplicas{&slowPeer{err: fmt.Errorf("server returned 404: %w", ErrNotFound), cancelled: make(chan struct{})}}
+		if _, err := g.Get("missing"); !errors.Is(err, ErrNotFound) || loads != 0 || errs != 0 {
+			t.Fatalf("hedging %v: expect ErrNotFound from the peer alone, got %v after %d loads and %d errors", hedging, err, loads, errs)
+		}
+	}
+}
+
+// database that blocks until its load is cancelled
+type blockingGetter struct {
+	cancelled chan struct{}
+}
+
+func (b *blockingGetter) Get(key string) ([]byte, error) {
+	return b.GetContext(context.Background(), key)
+}
+
+func (b *blockingGetter) GetContext(ctx context.Context, key string) ([]byte, error) {
+	<-ctx.Done()
+	defer close(b.cancelled)
+	return nil, ctx.Err()
+}
+
+func TestHedgeLostIsNoLoadError(t *testing.T) {
+	errs := 0
+	db := &blockingGetter{cancelled: make(chan struct{})}
+	g := NewGroup("hedge-lost", 2<<10, db, WithHedging(0.95, 10*time.Millisecond), WithOnError(func(key string, err error) { errs++ }))
+	for i := 0; i < hedgeMinSamples; i++ {
+		g.hedge.observe(time.Millisecond)
+	}
+	// the peer answers after the hedge started, the load of the database is cancelled
+	g.peers = fakeReplicas{&slowPeer{delay: 50 * time.Millisecond, cancelled: make(chan struct{})}}
+	if v, err := g.Get("key"); err != nil || v.String() != "peer" {
+		t.Fatalf("expect value from peer, got %q %v", v.String(), err)
+	}
+	select {
+	case <-db.cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("expect the database load to be cancelled")
+	}
+	// the cancelled load returns right after the getter
+	time.Sleep(10 * time.Millisecond)
+	if st := g.Stats(); st.Hedges != 1 || st.LocalLoadErrs != 0 || errs != 0 {
+		t.Fatalf("expect a lost hedge not to count as a load error, got %+v and %d errors", st, errs)
+	}
+}
@@ -0,0 +1,118 @@
+package cache
+
+import (
+	"cache/lru"
+	"cache/slab"
+	"log"
+	"time"
+)
+
+// EvictReason tells why an entry left the cache of a group
+type EvictReason int
+
+const (
+	// evicted to make room, for the cacheBytes of the group or the memory budget of the node
+	EvictCapacity EvictReason = iota
+	// found expired
+	EvictExpired
+	// removed with Delete, or by a peer
+	EvictExplicit
+)
+
+func (r EvictReason)String()string{
+	switch r{
+	case EvictExpired:
+		return "expired"
+	case EvictExplicit:
+		return "explicit"
+	}
+	return "capacity"
+}
+
+var evictReasons = map[lru.Reason]EvictReason{
+	lru.Capacity: EvictCapacity,
+	lru.Expired: EvictExpired,
+	lru.Removed: EvictExplicit,
+}
+
+var slabEvictReasons = map[slab.Reason]EvictReason{
+	slab.Capacity: EvictCapacity,
+	slab.Expired: EvictExpired,
+	slab.Removed: EvictExplicit,
+}
+
+// hooks of a group, every option appends one so auditing and metrics can register their own
+// hooks run after the cache lock is released, so they may use the group, and a panicking hook is logged instead of failing the caller
+type groupHooks struct{
+	onEvict []func(key string,value ByteView,reason EvictReason)
+	onLoad []func(key string,value ByteView,took time.Duration)
+	onPeerLoad []func(key string,value ByteView,took time.Duration)
+	onError []func(key string,err error)
+}
+
+// call fn with every entry that leaves the cache of the group in this node and why, values are decompressed
+// values replaced by a new value of their key are not reported
+func WithOnEvict(fn func(key string,value ByteView,reason EvictReason))GroupOption{
+	return func(g *Group){
+		g.hooks.onEvict = append(g.hooks.onEvict, fn)
+		g.mainCache.onEvict = g.evicted
+	}
+}
+
+// call fn with every value this node loads from the database and how long the getter took
+func WithOnLoad(fn func(key string,value ByteView,took time.Duration))GroupOption{
+	return func(g *Group){
+		g.hooks.onLoad = append(g.hooks.onLoad, fn)
+	}
+}
+
+// call fn with every value fetched from a peer and how long the fetch took
+func WithOnPeerLoad(fn func(key string,value ByteView,took time.Duration))GroupOption{
+	return func(g *Group){
+		g.hooks.onPeerLoad = append(g.hooks.onPeerLoad, fn)
+	}
+}
+
+// call fn with every failed database load and peer fetch, a failed peer fetch is followed by a load from the database
+func WithOnError(fn func(key string,err error))GroupOption{
+	return func(g *Group){
+		g.hooks.onError = append(g.hooks.onError, fn)
+	}
+}
+
+func (g *Group)evicted(key string,value ByteView,reason EvictReason){
+	if v,err := value.decompressed();err == nil{
+		value = v
+	}
+	for _,fn := range g.hooks.onEvict{
+		g.runHook("evict",func(){ fn(key,value,reason) })
+	}
+}
+
+func (g *Group)loaded(key string,value ByteView,took time.Duration){
+	for _,fn := range g.hooks.onLoad{
+		g.runHook("load",func(){ fn(key,value,took) })
+	}
+}
+
+func (g *Group)peerLoaded(key string,value ByteView,took time.Duration){
+	for _,fn := range g.hooks.onPeerLoad{
+		g.runHook("peer load",func(){ fn(key,value,took) })
+	}
+}
+
+func (g *Group)failed(key string,err error){
+	for _,fn := range g.hooks.onError{
+		g.runHook("error",func(){ fn(key,err) })
+	}
+}
+
+// run a hook, a panic in it is logged so it can not break a load other callers wait on
+func (g *Group)runHook(name string,fn func()){
+	defer func(){
+		if r := recover();r != nil{
+			log.Printf("[GeeCache] %s hook of group %s panicked: %v",name,g.name,r)
+		}
+	}()
+	fn()
+}
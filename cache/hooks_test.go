@@ -0,0 +1,105 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestOnEvict(t *testing.T) {
+	for _, storage := range []struct {
+		name  string
+		bytes int64 // room for two entries of 2 bytes of key and 2 of value
+		opts  []GroupOption
+	}{
+		{"heap", 10, nil},
+		{"slab", 2*(26+4) + 10, []GroupOption{WithSlabStorage()}},
+	} {
+		t.Run(storage.name, func(t *testing.T) {
+			var g *Group
+			var evicted []string
+			onEvict := WithOnEvict(func(key string, value ByteView, reason EvictReason) {
+				// hooks run outside the cache lock, so they may use the group
+				if g.Cached(key) {
+					t.Errorf("expect %s gone when its hook runs", key)
+				}
+				evicted = append(evicted, fmt.Sprintf("%s=%s %v", key, value, reason))
+			})
+			g = NewGroup("evict-"+storage.name, storage.bytes, GetterFunc(func(key string) ([]byte, error) {
+				return []byte("v" + key[1:]), nil
+			}), append(storage.opts, WithEntryOverhead(0), onEvict)...)
+
+			g.Set("k1", []byte("v1"))
+			g.Set("k1", []byte("v2"))
+			g.Set("k2", []byte("v2"))
+			g.Set("k3", []byte("v3"))
+			g.SetWithTTL("k4", []byte("v4"), time.Millisecond)
+			g.Delete("k3")
+			time.Sleep(5 * time.Millisecond)
+			g.Get("k4")
+			expect := []string{"k1=v2 capacity", "k2=v2 capacity", "k3=v3 explicit", "k4=v4 expired"}
+			if fmt.Sprint(evicted) != fmt.Sprint(expect) {
+				t.Fatalf("expect evictions %v, got %v", expect, evicted)
+			}
+		})
+	}
+}
+
+func TestOnLoad(t *testing.T) {
+	var loads, errs []string
+	g := NewGroup("onload", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		if v, ok := db[key]; ok {
+			return []byte(v), nil
+		}
+		return nil, fmt.Errorf("%s not exist", key)
+	}), WithOnLoad(func(key string, value ByteView, took time.Duration) {
+		loads = append(loads, key+"="+value.String())
+	}), WithOnError(func(key string, err error) {
+		errs = append(errs, key)
+	}))
+	g.Get("Tom")
+	g.Get("Tom")
+	g.Get("unknown")
+	if fmt.Sprint(loads) != "[Tom=630]" || fmt.Sprint(errs) != "[unknown]" {
+		t.Fatalf("expect one load of Tom and one error, got loads %v errors %v", loads, errs)
+	}
+}
+
+func TestOnPeerLoad(t *testing.T) {
+	var peerLoads, loads, errs []string
+	peer := &fakePeer{values: map[string]string{"Tom": "630"}, pushed: make(chan string, 10)}
+	g := NewGroup("onpeerload", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		return []byte(db[key]), nil
+	}), WithOnPeerLoad(func(key string, value ByteView, took time.Duration) {
+		peerLoads = append(peerLoads, key+"="+value.String())
+	}), WithOnLoad(func(key string, value ByteView, took time.Duration) {
+		loads = append(loads, key)
+	}), WithOnError(func(key string, err error) {
+		errs = append(errs, key)
+	}))
+	g.RegisterPeers(fakeReplicas{peer})
+	g.Get("Tom")
+	// the peer does not have Jack, so it is loaded from the database
+	g.Get("Jack")
+	if fmt.Sprint(peerLoads) != "[Tom=630]" || fmt.Sprint(loads) != "[Jack]" || fmt.Sprint(errs) != "[Jack]" {
+		t.Fatalf("expect Tom from the peer and Jack from the database, got peer loads %v loads %v errors %v", peerLoads, loads, errs)
+	}
+}
+
+func TestHookPanic(t *testing.T) {
+	calls := 0
+	g := NewGroup("hookpanic", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		return nil, errors.New("down")
+	}), WithOnError(func(key string, err error) {
+		panic("broken hook")
+	}), WithOnError(func(key string, err error) {
+		calls++
+	}))
+	if _, err := g.Get("Tom"); err == nil || err.Error() != "down" {
+		t.Fatalf("expect the error of the getter, got %v", err)
+	}
+	if calls != 1 {
+		t.Fatalf("expect the hooks after a panicking one to run, got %d calls", calls)
+	}
+}
@@ -0,0 +1,146 @@
+package jumphash
+
+import (
+	"hash/fnv"
+)
+
+// largest weight of a server, a larger one is treated as MaxWeight so the buckets stay bounded
+const MaxWeight = 100
+
+// derives the keys of further jumps, so a key whose bucket is down lands on another one
+const golden = 0x9e3779b97f4a7c15
+
+// Map picks the server of a key with jump consistent hashing (Lamping, Veach 2014)
+// it needs no ring and no memory per key, but servers are numbered buckets:
+// buckets are numbered in the order servers were added, so a new server is appended and only 1/n of the keys move
+// a removed server keeps its buckets, keys jumping into them jump again, so only its keys move
+// and adding it again gives them back. every node has to add servers in the same order, like the order of a config file
+type Map struct{
+	buckets []string // server of every bucket, a server with weight w owns w buckets in a row
+	live map[string]bool // servers that were added and not removed
+}
+
+// constructor of jump consistent hashing
+func New()*Map{
+	return &Map{live: make(map[string]bool)}
+}
+
+// add servers with weight 1
+func (m *Map)Add(names ...string){
+	for _,name := range names{
+		m.AddWeighted(name,1)
+	}
+}
+
+// add a server that owns weight buckets, weight < 1 is treated as 1 and weight > MaxWeight as MaxWeight
+// a new server is appended, a server added again keeps its buckets, a new weight renumbers the buckets after it
+func (m *Map)AddWeighted(name string,weight int){
+	if weight < 1{
+		weight = 1
+	}else if weight > MaxWeight{
+		weight = MaxWeight
+	}
+	m.live[name] = true
+	idx,n := m.find(name)
+	if n == weight{
+		return
+	}
+	if n == 0{
+		idx = len(m.buckets)
+	}
+	buckets := make([]string,0,len(m.buckets)-n+weight)
+	buckets = append(buckets, m.buckets[:idx]...)
+	for i := 0;i < weight;i++{
+		buckets = append(buckets, name)
+	}
+	m.buckets = append(buckets, m.buckets[idx+n:]...)
+}
+
+// first bucket of a server and how many it owns
+func (m *Map)find(name string)(int,int){
+	for i,b := range m.buckets{
+		if b == name{
+			n := 1
+			for i+n < len(m.buckets) && m.buckets[i+n] == name{
+				n++
+			}
+			return i,n
+		}
+	}
+	return 0,0
+}
+
+// remove a server, its buckets stay numbered so the buckets of the others do not shift
+func (m *Map)Remove(name string){
+	delete(m.live,name)
+}
+
+// remove a server with its buckets, the buckets after it shift down and most keys move
+// for a server that will not come back, so the numbers match a map it was never added to
+func (m *Map)Forget(name string){
+	delete(m.live,name)
+	idx,n := m.find(name)
+	m.buckets = append(m.buckets[:idx], m.buckets[idx+n:]...)
+}
+
+// given a key, return the server of its bucket
+func (m *Map)Get(key string)string{
+	if len(m.live) == 0{
+		return ""
+	}
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	k := h.Sum64()
+	b := Hash(k,len(m.buckets))
+	// a key in the bucket of a removed server jumps again, every key jumps its own way so the keys spread evenly
+	for i := 1;!m.live[m.buckets[b]] && i <= 4*len(m.buckets);i++{
+		b = Hash(k+uint64(i)*golden,len(m.buckets))
+	}
+	for !m.live[m.buckets[b]]{
+		b = (b+1)%len(m.buckets)
+	}
+	return m.buckets[b]
+}
+
+// return up to n distinct servers for key, the first one is the server Get returns
+// the others are found by jumping again with a derived key, skipping servers already chosen
+func (m *Map)GetN(key string,n int)[]string{
+	if len(m.live) == 0 || n <= 0{
+		return nil
+	}
+	first := m.Get(key)
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	k := h.Sum64()
+	servers := append(make([]string,0,n),first)
+	seen := map[string]bool{first: true}
+	// derived keys find new servers quickly, the bucket scan below only fills up what they missed
+	for i := 0;i < 4*len(m.buckets) && len(servers) < n;i++{
+		server := m.buckets[Hash(k+uint64(i)*golden,len(m.buckets))]
+		if m.live[server] && !seen[server]{
+			seen[server] = true
+			servers = append(servers, server)
+		}
+	}
+	for _,server := range m.buckets{
+		if len(servers) == n{
+			break
+		}
+		if m.live[server] && !seen[server]{
+			seen[server] = true
+			servers = append(servers, server)
+		}
+	}
+	return servers
+}
+
+// Hash maps key into one of n buckets, when n grows to n+1 only 1/(n+1) of the keys move
+func Hash(key uint64,n int)int{
+	b,j := int64(-1),int64(0)
+	for j < int64(n){
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1)*(float64(int64(1)<<31)/float64((key>>33)+1)))
+	}
+	return int(b)
+}
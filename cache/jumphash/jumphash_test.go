@@ -0,0 +1,93 @@
+package jumphash
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestHash(t *testing.T) {
+	// adding a bucket only moves keys into the new bucket
+	for key := uint64(0); key < 10000; key++ {
+		before := Hash(key, 10)
+		after := Hash(key, 11)
+		if before < 0 || before >= 10 {
+			t.Fatalf("bucket %d out of range", before)
+		}
+		if after != before && after != 10 {
+			t.Fatalf("key %d moved from bucket %d to %d", key, before, after)
+		}
+	}
+}
+
+func TestGet(t *testing.T) {
+	m := New()
+	if m.Get("key") != "" {
+		t.Fatal("empty map should return no server")
+	}
+	m.Add("a", "b")
+	m.AddWeighted("c", 2)
+	counts := make(map[string]int)
+	total := 40000
+	for i := 0; i < total; i++ {
+		counts[m.Get("key"+strconv.Itoa(i))]++
+	}
+	if got := float64(counts["c"]) / float64(total); got < 0.45 || got > 0.55 {
+		t.Fatalf("server c owns 2 of 4 buckets and should get half the keys, got %.2f", got)
+	}
+
+	owners := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		key := "key" + strconv.Itoa(i)
+		owners[key] = m.Get(key)
+	}
+	m.Remove("c")
+	for key, owner := range owners {
+		if got := m.Get(key); got == "c" || (owner != "c" && got != owner) {
+			t.Fatalf("only keys of the removed server should move, %s moved from %s to %s", key, owner, got)
+		}
+	}
+	// a server added again gets its keys back
+	m.AddWeighted("c", 2)
+	for key, owner := range owners {
+		if got := m.Get(key); got != owner {
+			t.Fatalf("key %s owned by %s, expect %s", key, got, owner)
+		}
+	}
+
+	m.Forget("c")
+	fresh := New()
+	fresh.Add("a", "b")
+	for key := range owners {
+		if got, expect := m.Get(key), fresh.Get(key); got != expect {
+			t.Fatalf("a forgotten server should leave no buckets, %s owned by %s, expect %s", key, got, expect)
+		}
+	}
+	m.Remove("a")
+	m.Remove("b")
+	if m.Get("key1") != "" || m.GetN("key1", 2) != nil {
+		t.Fatal("map without servers should return no server")
+	}
+}
+
+func TestJoinOrder(t *testing.T) {
+	// servers are numbered in the order they were added, not by name
+	before, after := New(), New()
+	for i := 1; i <= 9; i++ {
+		before.Add("10.0.0." + strconv.Itoa(i))
+		after.Add("10.0.0." + strconv.Itoa(i))
+	}
+	after.Add("10.0.0.10")
+	moved := 0
+	for i := 0; i < 10000; i++ {
+		key := "key" + strconv.Itoa(i)
+		if b, a := before.Get(key), after.Get(key); b != a {
+			if a != "10.0.0.10" {
+				t.Fatalf("key %s moved from %s to %s, expect only moves to the new server", key, b, a)
+			}
+			moved++
+		}
+	}
+	if share := float64(moved) / 10000; share < 0.07 || share > 0.13 {
+		t.Fatalf("expect about 1/10 of the keys to move, got %.3f", share)
+	}
+}
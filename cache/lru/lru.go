@@ -1,19 +1,40 @@
 package lru
 
-import "container/list"
+import (
+	"container/list"
+	"time"
+)
 
 type Cache struct{
 	maxBytes int64 //max cache capacity in bytes
-	nBytes int64 // used capacity
+	nBytes int64 // key and value bytes of entries
+	overhead int64 // bytes charged per entry on top of its key and value
 	ll *list.List // a double linked list
 	cache map[string]*list.Element // hash map to store key and linkedlist node
 	onEvicted func(key string,value Value) // onEvicted function
+	onRemoved func(key string,value Value,reason Reason) // like onEvicted, with the reason
 }
 
+// why an entry left the cache
+type Reason int
+
+const (
+	Capacity Reason = iota // evicted to make room
+	Expired // found expired
+	Removed // removed with Remove
+)
+
 // entry is the value we store in linked list element
 type entry struct{
 	key string
 	value Value
+	expire time.Time // zero means the entry never expires
+	used int64 // unix nanoseconds of the last add or get
+}
+
+// check if entry has passed its expire time
+func(e *entry)expired(now time.Time)bool{
+	return !e.expire.IsZero() && now.After(e.expire)
 }
 
 // we have a value interface
@@ -35,31 +56,54 @@ func New(maxBytes int64, onEvicted func(key string, value Value))*Cache{
 func(c *Cache)Get(key string)(value Value,ok bool){
 	// if we can find it in cache, move it to the front of the ll
 	if ele,ok := c.cache[key];ok{
-		c.ll.MoveToFront(ele)
 		kv := ele.Value.(*entry)
+		now := time.Now()
+		// expired entries are removed lazily when they are read
+		if kv.expired(now){
+			c.removeElement(ele,Expired)
+			return nil,false
+		}
+		kv.used = now.UnixNano()
+		c.ll.MoveToFront(ele)
 		return kv.value,true
 	}
 	return
 }
 
+// check if key is cached without changing its position in the list
+func(c *Cache)Contains(key string)bool{
+	ele,ok := c.cache[key]
+	return ok && !ele.Value.(*entry).expired(time.Now())
+}
+
 // remove oldest node
 func(c *Cache)RemoveOldest(){
 	ele := c.ll.Back()
 	if ele != nil{
-		c.ll.Remove(ele)
-		kv := ele.Value.(*entry)
-		delete(c.cache,kv.key)
-		// update size
-		c.nBytes -= (int64(len(kv.key))+ int64(kv.value.Len()))
-		// trigger onEvicted function
-		if c.onEvicted != nil{
-			c.onEvicted(kv.key,kv.value)
+		reason := Capacity
+		if ele.Value.(*entry).expired(time.Now()){
+			reason = Expired
 		}
+		c.removeElement(ele,reason)
+	}
+}
+
+// last time the entry that is evicted next was added or read, false if the cache is empty
+func(c *Cache)OldestUse()(time.Time,bool){
+	ele := c.ll.Back()
+	if ele == nil{
+		return time.Time{},false
 	}
+	return time.Unix(0,ele.Value.(*entry).used),true
 }
 
 // add new kv into cache
 func(c *Cache)Add(key string,value Value){
+	c.AddWithExpire(key,value,time.Time{})
+}
+
+// add new kv into cache which expires at given time, zero time means never expire
+func(c *Cache)AddWithExpire(key string,value Value,expire time.Time){
 	// if current key existed
 	if ele,ok := c.cache[key];ok{
 		c.ll.MoveToFront(ele)
@@ -67,16 +111,102 @@ func(c *Cache)Add(key string,value Value){
 		// update size and value
 		c.nBytes += int64(value.Len()) - int64(kv.value.Len())
 		kv.value = value
+		kv.expire = expire
+		kv.used = time.Now().UnixNano()
 	}else{
 		// add new entry
-		ele := c.ll.PushFront(&entry{key: key,value: value})
+		ele := c.ll.PushFront(&entry{key: key,value: value,expire: expire,used: time.Now().UnixNano()})
 		c.cache[key] = ele
 		c.nBytes += int64(len(key)) + int64(value.Len())
 	}
 	// if size is reached, remove oldest entry
-	for c.maxBytes != 0 && c.maxBytes < c.nBytes{
+	for c.maxBytes != 0 && c.maxBytes < c.Bytes(){
 		c.RemoveOldest()
 	}
 }
 
+// remove the entry with given key, return true if it existed
+func(c *Cache)Remove(key string)bool{
+	if ele,ok := c.cache[key];ok{
+		c.removeElement(ele,Removed)
+		return true
+	}
+	return false
+}
 
+// change expire time of an existing entry, return false if key is not cached
+func(c *Cache)SetExpire(key string,expire time.Time)bool{
+	ele,ok := c.cache[key]
+	if !ok{
+		return false
+	}
+	kv := ele.Value.(*entry)
+	if kv.expired(time.Now()){
+		c.removeElement(ele,Expired)
+		return false
+	}
+	kv.expire = expire
+	return true
+}
+
+// get value and expire time of key without changing its position in the list
+func(c *Cache)Peek(key string)(value Value,expire time.Time,ok bool){
+	ele,ok := c.cache[key]
+	if !ok{
+		return nil,time.Time{},false
+	}
+	kv := ele.Value.(*entry)
+	if kv.expired(time.Now()){
+		return nil,time.Time{},false
+	}
+	return kv.value,kv.expire,true
+}
+
+// keys of all entries, most recently used first
+func(c *Cache)Keys()[]string{
+	keys := make([]string,0,c.ll.Len())
+	for ele := c.ll.Front();ele != nil;ele = ele.Next(){
+		keys = append(keys, ele.Value.(*entry).key)
+	}
+	return keys
+}
+
+// number of entries in cache
+func(c *Cache)Len()int{
+	return c.ll.Len()
+}
+
+// used capacity in bytes, the overhead of every entry included
+func(c *Cache)Bytes()int64{
+	return c.nBytes + c.overhead*int64(c.ll.Len())
+}
+
+// charge every entry bytes on top of its key and value, like the list element and map slot it takes
+// entries are evicted right away if the cache no longer fits
+func(c *Cache)SetOverhead(bytes int64){
+	c.overhead = bytes
+	for c.maxBytes != 0 && c.maxBytes < c.Bytes(){
+		c.RemoveOldest()
+	}
+}
+
+// call fn with every entry that leaves the cache and why, next to onEvicted
+func(c *Cache)SetOnRemoved(fn func(key string,value Value,reason Reason)){
+	c.onRemoved = fn
+}
+
+// unlink an element from list and map and trigger onEvicted function
+func(c *Cache)removeElement(ele *list.Element,reason Reason){
+	c.ll.Remove(ele)
+	kv := ele.Value.(*entry)
+	delete(c.cache,kv.key)
+	// update size
+	c.nBytes -= (int64(len(kv.key))+ int64(kv.value.Len()))
+	// trigger onEvicted function
+	if c.onEvicted != nil{
+		c.onEvicted(kv.key,kv.value)
+	}
+	if c.onRemoved != nil{
+		c.onRemoved(kv.key,kv.value,reason)
+	}
+}
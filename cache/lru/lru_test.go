@@ -3,6 +3,7 @@ package lru
 import (
 	"reflect"
 	"testing"
+	"time"
 )
 
 type String string
@@ -61,4 +62,50 @@ func TestAdd(t *testing.T) {
 	if lru.nBytes != int64(len("key")+len("111")) {
 		t.Fatal("expected 6 but got", lru.nBytes)
 	}
-}
\ No newline at end of file
+}
+func TestExpire(t *testing.T) {
+	lru := New(int64(0), nil)
+	lru.AddWithExpire("key1", String("1"), time.Now().Add(-time.Second))
+	lru.AddWithExpire("key2", String("2"), time.Now().Add(time.Hour))
+	if _, ok := lru.Get("key1"); ok || lru.Len() != 1 {
+		t.Fatal("expired key1 should be removed on read")
+	}
+	if !lru.SetExpire("key2", time.Now().Add(-time.Second)) {
+		t.Fatal("SetExpire on key2 failed")
+	}
+	if lru.Contains("key2") {
+		t.Fatal("key2 should have expired")
+	}
+	if lru.SetExpire("key3", time.Time{}) {
+		t.Fatal("SetExpire on missing key3 should fail")
+	}
+}
+
+func TestOverhead(t *testing.T) {
+	lru := New(int64(90), nil)
+	lru.Add("key1", String("1234"))
+	lru.Add("key2", String("1234"))
+	lru.SetOverhead(40)
+	if lru.Len() != 1 || lru.Bytes() != 48 {
+		t.Fatalf("expect one entry of 8+40 bytes, got %d entries of %d bytes", lru.Len(), lru.Bytes())
+	}
+	if _, ok := lru.Get("key2"); !ok {
+		t.Fatal("expect the newest entry to stay")
+	}
+}
+
+func TestOnRemoved(t *testing.T) {
+	var reasons []Reason
+	lru := New(int64(16), nil)
+	lru.SetOnRemoved(func(key string, value Value, reason Reason) {
+		reasons = append(reasons, reason)
+	})
+	lru.Add("key1", String("1234"))
+	lru.AddWithExpire("key2", String("1234"), time.Now().Add(-time.Second))
+	lru.Add("key3", String("1234"))
+	lru.Get("key2")
+	lru.Remove("key3")
+	if !reflect.DeepEqual(reasons, []Reason{Capacity, Expired, Removed}) {
+		t.Fatalf("expect capacity, expired and removed, got %v", reasons)
+	}
+}
@@ -0,0 +1,399 @@
+package cache
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MemcachedServer is a tcp front end that speaks the memcached ascii protocol for one group
+// flags and cas values are not part of the group, so they are kept by the server next to the cache
+type MemcachedServer struct{
+	group *Group // group every command is translated to
+	started time.Time
+	mu sync.Mutex // lock for listener, connections and item meta
+	listener net.Listener
+	conns map[net.Conn]struct{}
+	closed bool
+	meta map[string]memcachedMeta // flags and cas of keys stored through this server
+	casSeq atomic.Uint64 // source of cas unique values
+	cmdGet atomic.Int64
+	cmdSet atomic.Int64
+	cmdTouch atomic.Int64
+	getHits atomic.Int64
+	getMisses atomic.Int64
+}
+
+// item data that memcached clients expect back but a ByteView does not carry
+type memcachedMeta struct{
+	flags uint32
+	cas uint64
+}
+
+const (
+	// exptime larger than this is an absolute unix timestamp instead of seconds from now
+	memcachedMaxRelativeExptime = 60*60*24*30
+	memcachedMaxValue = 1<<20
+	memcachedVersion = "1.6.0-gocache"
+)
+
+var errMemcachedClosed = errors.New("memcached server closed")
+
+// constructor of MemcachedServer
+func NewMemcachedServer(group *Group)*MemcachedServer{
+	if group == nil{
+		panic("nil group")
+	}
+	return &MemcachedServer{
+		group: group,
+		started: time.Now(),
+		conns: make(map[net.Conn]struct{}),
+		meta: make(map[string]memcachedMeta),
+	}
+}
+
+// listen on addr and serve memcached clients until Close is called, a closed server returns nil
+func (s *MemcachedServer)ListenAndServe(addr string)error{
+	l,err := net.Listen("tcp",addr)
+	if err != nil{
+		return err
+	}
+	return s.Serve(l)
+}
+
+// accept connections on l, each connection is handled in its own goroutine
+func (s *MemcachedServer)Serve(l net.Listener)error{
+	s.mu.Lock()
+	if s.closed{
+		s.mu.Unlock()
+		l.Close()
+		return errMemcachedClosed
+	}
+	s.listener = l
+	s.mu.Unlock()
+
+	for{
+		conn,err := l.Accept()
+		if err != nil{
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			// closed on purpose, not an error
+			if closed{
+				return nil
+			}
+			return err
+		}
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		go s.serveConn(conn)
+	}
+}
+
+// stop listening and close all client connections
+func (s *MemcachedServer)Close()error{
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	var err error
+	if s.listener != nil{
+		err = s.listener.Close()
+	}
+	for conn := range s.conns{
+		conn.Close()
+	}
+	return err
+}
+
+// read commands from one client until it quits or the connection breaks
+func (s *MemcachedServer)serveConn(conn net.Conn){
+	defer func(){
+		s.mu.Lock()
+		delete(s.conns,conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	for{
+		line,err := readRESPLine(r)
+		if err != nil{
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0{
+			w.WriteString("ERROR\r\n")
+		}else if quit := s.dispatch(fields,r,w);quit{
+			w.Flush()
+			return
+		}
+		// only flush when client is not pipelining more commands
+		if r.Buffered() == 0{
+			if err := w.Flush();err != nil{
+				return
+			}
+		}
+	}
+}
+
+// execute one command, return true if the connection should be closed
+func (s *MemcachedServer)dispatch(fields []string,r *bufio.Reader,w *bufio.Writer)bool{
+	args := fields[1:]
+	switch strings.ToLower(fields[0]){
+	case "get":
+		s.get(args,false,w)
+	case "gets":
+		s.get(args,true,w)
+	case "set":
+		// a broken set line leaves an unknown amount of data behind, so we hang up
+		return !s.set(args,r,w)
+	case "delete":
+		s.delete(args,w)
+	case "touch":
+		s.touch(args,w)
+	case "stats":
+		s.stats(w)
+	case "version":
+		w.WriteString("VERSION "+memcachedVersion+"\r\n")
+	case "quit":
+		return true
+	default:
+		w.WriteString("ERROR\r\n")
+	}
+	return false
+}
+
+// get <key>*, gets also returns the cas unique of every item
+func (s *MemcachedServer)get(keys []string,withCas bool,w *bufio.Writer){
+	if len(keys) == 0{
+		w.WriteString("ERROR\r\n")
+		return
+	}
+	for _,key := range keys{
+		s.cmdGet.Add(1)
+		view,err := s.group.Get(key)
+		if err != nil{
+			// missing keys are simply left out of the response
+			s.getMisses.Add(1)
+			if !errors.Is(err,ErrNotFound){
+				log.Println("[Memcached] load failed:",err)
+			}
+			continue
+		}
+		s.getHits.Add(1)
+		meta := s.itemMeta(key)
+		if withCas{
+			fmt.Fprintf(w,"VALUE %s %d %d %d\r\n",key,meta.flags,view.Len(),meta.cas)
+		}else{
+			fmt.Fprintf(w,"VALUE %s %d %d\r\n",key,meta.flags,view.Len())
+		}
+		w.Write(view.b)
+		w.WriteString("\r\n")
+	}
+	w.WriteString("END\r\n")
+}
+
+// set <key> <flags> <exptime> <bytes> [noreply], return false if the data block could not be consumed
+func (s *MemcachedServer)set(args []string,r *bufio.Reader,w *bufio.Writer)bool{
+	if len(args) != 4 && len(args) != 5{
+		w.WriteString("ERROR\r\n")
+		return true
+	}
+	noreply := len(args) == 5 && args[4] == "noreply"
+	key := args[0]
+	flags,err1 := strconv.ParseUint(args[1],10,32)
+	exptime,err2 := strconv.ParseInt(args[2],10,64)
+	size,err3 := strconv.Atoi(args[3])
+	if err3 != nil || size < 0{
+		w.WriteString("CLIENT_ERROR bad data chunk\r\n")
+		return false
+	}
+	// always consume the data block, even if the command line is invalid
+	// a block too large to cache is skipped without buffering it
+	if size > memcachedMaxValue{
+		if _,err := io.CopyN(io.Discard,r,int64(size));err != nil{
+			return false
+		}
+		var end [2]byte
+		if _,err := io.ReadFull(r,end[:]);err != nil || end != [2]byte{'\r','\n'}{
+			w.WriteString("CLIENT_ERROR bad data chunk\r\n")
+			return false
+		}
+		w.WriteString("SERVER_ERROR object too large for cache\r\n")
+		return true
+	}
+	data := make([]byte,size+2)
+	if _,err := io.ReadFull(r,data);err != nil{
+		return false
+	}
+	if data[size] != '\r' || data[size+1] != '\n'{
+		w.WriteString("CLIENT_ERROR bad data chunk\r\n")
+		return false
+	}
+	data = data[:size]
+	s.cmdSet.Add(1)
+	if err1 != nil || err2 != nil || len(key) == 0 || len(key) > 250{
+		w.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return true
+	}
+	ttl,expired := memcachedTTL(exptime,time.Now())
+	if expired{
+		// memcached accepts the item but it is gone right away
+		s.group.Delete(key)
+		s.forget(key)
+	}else{
+		if err := s.group.SetWithTTL(key,data,ttl);err != nil{
+			w.WriteString("SERVER_ERROR "+err.Error()+"\r\n")
+			return true
+		}
+		s.mu.Lock()
+		s.meta[key] = memcachedMeta{flags: uint32(flags),cas: s.casSeq.Add(1)}
+		s.pruneLocked()
+		s.mu.Unlock()
+	}
+	if !noreply{
+		w.WriteString("STORED\r\n")
+	}
+	return true
+}
+
+// delete <key> [noreply]
+func (s *MemcachedServer)delete(args []string,w *bufio.Writer){
+	if len(args) != 1 && len(args) != 2{
+		w.WriteString("ERROR\r\n")
+		return
+	}
+	noreply := len(args) == 2 && args[1] == "noreply"
+	deleted := s.group.Delete(args[0])
+	s.forget(args[0])
+	if noreply{
+		return
+	}
+	if deleted{
+		w.WriteString("DELETED\r\n")
+	}else{
+		w.WriteString("NOT_FOUND\r\n")
+	}
+}
+
+// touch <key> <exptime> [noreply]
+func (s *MemcachedServer)touch(args []string,w *bufio.Writer){
+	if len(args) != 2 && len(args) != 3{
+		w.WriteString("ERROR\r\n")
+		return
+	}
+	noreply := len(args) == 3 && args[2] == "noreply"
+	exptime,err := strconv.ParseInt(args[1],10,64)
+	if err != nil{
+		w.WriteString("CLIENT_ERROR invalid exptime argument\r\n")
+		return
+	}
+	s.cmdTouch.Add(1)
+	key := args[0]
+	ttl,expired := memcachedTTL(exptime,time.Now())
+	var touched bool
+	if expired{
+		touched = s.group.Delete(key)
+		s.forget(key)
+	}else{
+		touched = s.group.Touch(key,ttl)
+	}
+	if noreply{
+		return
+	}
+	if touched{
+		w.WriteString("TOUCHED\r\n")
+	}else{
+		w.WriteString("NOT_FOUND\r\n")
+	}
+}
+
+// general purpose statistics, names follow the memcached protocol
+func (s *MemcachedServer)stats(w *bufio.Writer){
+	st := s.group.Stats()
+	now := time.Now()
+	stat := func(name string,value interface{}){
+		fmt.Fprintf(w,"STAT %s %v\r\n",name,value)
+	}
+	stat("pid",os.Getpid())
+	stat("uptime",int64(now.Sub(s.started).Seconds()))
+	stat("time",now.Unix())
+	stat("version",memcachedVersion)
+	stat("curr_connections",s.connCount())
+	stat("cmd_get",s.cmdGet.Load())
+	stat("cmd_set",s.cmdSet.Load())
+	stat("cmd_touch",s.cmdTouch.Load())
+	stat("get_hits",s.getHits.Load())
+	stat("get_misses",s.getMisses.Load())
+	stat("curr_items",st.Items)
+	stat("bytes",st.Bytes)
+	stat("limit_maxbytes",s.group.mainCache.cacheByte)
+	w.WriteString("END\r\n")
+}
+
+func (s *MemcachedServer)connCount()int{
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+// flags and cas of key, values loaded from the database get flags 0 and a fresh cas
+func (s *MemcachedServer)itemMeta(key string)memcachedMeta{
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	meta,ok := s.meta[key]
+	if !ok{
+		meta = memcachedMeta{cas: s.casSeq.Add(1)}
+		s.meta[key] = meta
+		s.pruneLocked()
+	}
+	return meta
+}
+
+func (s *MemcachedServer)forget(key string){
+	s.mu.Lock()
+	delete(s.meta,key)
+	s.mu.Unlock()
+}
+
+// drop meta of keys that are no longer cached, once meta grows well past the cached items
+func (s *MemcachedServer)pruneLocked(){
+	items,_ := s.group.mainCache.stats()
+	if len(s.meta) <= 2*items+1024{
+		return
+	}
+	for key := range s.meta{
+		if !s.group.Cached(key){
+			delete(s.meta,key)
+		}
+	}
+}
+
+// convert memcached exptime into a ttl
+// 0 never expires, up to 30 days it is relative seconds, above that an absolute unix time
+// a negative or past exptime means the item is expired immediately
+func memcachedTTL(exptime int64,now time.Time)(ttl time.Duration,expired bool){
+	switch{
+	case exptime == 0:
+		return 0,false
+	case exptime < 0:
+		return 0,true
+	case exptime <= memcachedMaxRelativeExptime:
+		return time.Duration(exptime)*time.Second,false
+	}
+	ttl = time.Unix(exptime,0).Sub(now)
+	if ttl <= 0{
+		return 0,true
+	}
+	return ttl,false
+}
@@ -0,0 +1,137 @@
+package cache
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// start a memcached server for group on a random port and return a connected client
+func newMemcachedClient(t *testing.T, group *Group) (net.Conn, *bufio.Reader) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewMemcachedServer(group)
+	go server.Serve(l)
+	t.Cleanup(func() { server.Close() })
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, bufio.NewReader(conn)
+}
+
+// send raw request and read reply lines until one of the terminators
+func memcachedDo(t *testing.T, conn net.Conn, r *bufio.Reader, req string) string {
+	if _, err := conn.Write([]byte(req)); err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		lines = append(lines, line)
+		switch {
+		case line == "END", line == "STORED", line == "DELETED", line == "NOT_FOUND",
+			line == "TOUCHED", line == "ERROR", strings.HasPrefix(line, "CLIENT_ERROR"),
+			strings.HasPrefix(line, "SERVER_ERROR"):
+			return strings.Join(lines, "|")
+		}
+	}
+}
+
+func TestMemcachedCommands(t *testing.T) {
+	g := NewGroup("memcached", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		if v, ok := db[key]; ok {
+			return []byte(v), nil
+		}
+		return nil, fmt.Errorf("%s: %w", key, ErrNotFound)
+	}))
+	conn, r := newMemcachedClient(t, g)
+
+	cases := []struct {
+		req    string
+		expect string
+	}{
+		{"get Tom unknown\r\n", "VALUE Tom 0 3|630|END"},
+		{"set k 42 0 5\r\nhello\r\n", "STORED"},
+		{"get k\r\n", "VALUE k 42 5|hello|END"},
+		{"touch k 100\r\n", "TOUCHED"},
+		{"touch nope 100\r\n", "NOT_FOUND"},
+		{"delete k\r\n", "DELETED"},
+		{"delete k\r\n", "NOT_FOUND"},
+		{"set k 1 -1 1\r\nx\r\n", "STORED"},
+		{"get k\r\n", "END"},
+		{"bogus\r\n", "ERROR"},
+	}
+	for _, c := range cases {
+		if got := memcachedDo(t, conn, r, c.req); got != c.expect {
+			t.Fatalf("%q: expect %q, got %q", c.req, c.expect, got)
+		}
+	}
+
+	// cas changes every time the item is stored
+	memcachedDo(t, conn, r, "set c 0 0 1\r\na\r\n")
+	first := memcachedDo(t, conn, r, "gets c\r\n")
+	memcachedDo(t, conn, r, "set c 0 0 1\r\nb\r\n")
+	second := memcachedDo(t, conn, r, "gets c\r\n")
+	if !strings.HasPrefix(first, "VALUE c 0 1 ") || first == second {
+		t.Fatalf("expect different cas values, got %q and %q", first, second)
+	}
+
+	if stats := memcachedDo(t, conn, r, "stats\r\n"); !strings.Contains(stats, "STAT curr_items") {
+		t.Fatalf("stats missing curr_items: %q", stats)
+	}
+}
+
+func TestMemcachedTooLarge(t *testing.T) {
+	g := NewGroup("memcached-large", 4<<20, GetterFunc(func(key string) ([]byte, error) {
+		return nil, ErrNotFound
+	}))
+	conn, r := newMemcachedClient(t, g)
+	big := strings.Repeat("x", memcachedMaxValue+1)
+	if got := memcachedDo(t, conn, r, fmt.Sprintf("set k 0 0 %d\r\n%s\r\n", len(big), big)); got != "SERVER_ERROR object too large for cache" {
+		t.Fatalf("expect too large, got %q", got)
+	}
+	// the data block was skipped, so the connection still works
+	if got := memcachedDo(t, conn, r, "set k 0 0 1\r\nx\r\n"); got != "STORED" {
+		t.Fatalf("expect STORED, got %q", got)
+	}
+	// a size that does not fit in memory is not allocated
+	conn.Write([]byte("set k 0 0 9223372036854775807\r\nabc"))
+	conn.(*net.TCPConn).CloseWrite()
+	if line, err := r.ReadString('\n'); err != io.EOF {
+		t.Fatalf("expect the connection closed, got %q %v", line, err)
+	}
+}
+
+func TestMemcachedTTL(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	cases := []struct {
+		exptime int64
+		ttl     time.Duration
+		expired bool
+	}{
+		{0, 0, false},
+		{-1, 0, true},
+		{60, time.Minute, false},
+		{now.Unix() + 120, 2 * time.Minute, false},
+		{now.Unix() - 10, 0, true},
+	}
+	for _, c := range cases {
+		ttl, expired := memcachedTTL(c.exptime, now)
+		if ttl != c.ttl || expired != c.expired {
+			t.Fatalf("exptime %d: expect (%v,%v), got (%v,%v)", c.exptime, c.ttl, c.expired, ttl, expired)
+		}
+	}
+}
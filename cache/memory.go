@@ -0,0 +1,176 @@
+package cache
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// MemoryPolicy picks the group that gives an entry back when the groups of a node are over the memory budget
+type MemoryPolicy int32
+
+const (
+	// evict from the group whose next entry to evict was used longest ago, so hot groups keep their entries
+	ColdestFirst MemoryPolicy = iota
+	// evict from the group that uses the most bytes over its minimum
+	LargestFirst
+)
+
+func (p MemoryPolicy)String()string{
+	if p == LargestFirst{
+		return "largest"
+	}
+	return "coldest"
+}
+
+// policy of a name in the config, "coldest" is the default
+func MemoryPolicyByName(name string)(MemoryPolicy,error){
+	switch name{
+	case "","coldest":
+		return ColdestFirst,nil
+	case "largest":
+		return LargestFirst,nil
+	}
+	return 0,fmt.Errorf("unknown memory policy %q",name)
+}
+
+// the memory manager of the node, every group takes part in it once it is created
+var memory struct{
+	budget atomic.Int64 // bytes of all groups together, 0 means no limit
+	policy atomic.Int32 // MemoryPolicy
+	evictions atomic.Int64 // entries evicted to keep the budget
+}
+
+// keep bytes of the group cached however much the other groups need, the memory budget never evicts below it
+// the maximum of the group is its cacheBytes
+func WithMinBytes(bytes int64)GroupOption{
+	return func(g *Group){
+		g.minBytes = bytes
+	}
+}
+
+// limit the bytes cached by all groups of this process together, entry overhead included, bytes <= 0 removes the limit
+// an entry that takes the groups over the budget evicts entries of the group the memory policy picks until they fit again,
+// groups at their minimum are never picked, and cacheBytes of every group still applies on its own
+// a group with slab storage is charged its whole slab once it caches something and never picked, evicting frees nothing of it
+func SetMemoryBudget(bytes int64){
+	memory.budget.Store(bytes)
+	enforceMemoryBudget()
+}
+
+// the limit set by SetMemoryBudget, 0 if there is none
+func MemoryBudget()int64{
+	if b := memory.budget.Load();b > 0{
+		return b
+	}
+	return 0
+}
+
+// change which group gives entries back when the budget is reached, ColdestFirst by default
+func SetMemoryPolicy(p MemoryPolicy){
+	memory.policy.Store(int32(p))
+	enforceMemoryBudget()
+}
+
+// bytes cached by all groups of this process, entry overhead included
+func MemoryUsed()int64{
+	mu.RLock()
+	defer mu.RUnlock()
+	var used int64
+	for _,g := range groups{
+		used += g.mainCache.used.Load()
+	}
+	return used
+}
+
+// MemoryStats is a snapshot of the memory budget of the node and how its groups use it
+type MemoryStats struct{
+	Budget int64 `json:"budget"` // 0 means no limit
+	Used int64 `json:"used"`
+	Policy string `json:"policy"`
+	Evictions int64 `json:"evictions"` // entries evicted to keep the budget
+	Groups map[string]GroupMemory `json:"groups"`
+}
+
+// GroupMemory is what one group takes of the memory of the node
+type GroupMemory struct{
+	Bytes int64 `json:"bytes"` // the whole slab for slab storage
+	MinBytes int64 `json:"min_bytes"` // never evicted for the budget
+	MaxBytes int64 `json:"max_bytes"` // cacheBytes of the group, 0 means no limit
+	Evictions int64 `json:"evictions"` // entries of this group evicted for the budget
+	OldestUse time.Time `json:"oldest_use,omitempty"` // last use of the entry evicted next
+}
+
+func GetMemoryStats()MemoryStats{
+	mu.RLock()
+	defer mu.RUnlock()
+	stats := MemoryStats{
+		Budget: MemoryBudget(),
+		Policy: MemoryPolicy(memory.policy.Load()).String(),
+		Evictions: memory.evictions.Load(),
+		Groups: make(map[string]GroupMemory,len(groups)),
+	}
+	for name,g := range groups{
+		used := g.mainCache.used.Load()
+		oldest,_ := g.mainCache.oldestUse()
+		stats.Used += used
+		stats.Groups[name] = GroupMemory{
+			Bytes: used,
+			MinBytes: g.minBytes,
+			MaxBytes: g.mainCache.cacheByte,
+			Evictions: g.stats.budgetEvictions.Load(),
+			OldestUse: oldest,
+		}
+	}
+	return stats
+}
+
+// evict from the groups the policy picks until all groups fit in the budget
+func enforceMemoryBudget(){
+	limit := memory.budget.Load()
+	if limit <= 0{
+		return
+	}
+	for{
+		victim := pickVictim(limit,MemoryPolicy(memory.policy.Load()))
+		if victim == nil || !victim.mainCache.removeOldest(){
+			return
+		}
+		victim.stats.budgetEvictions.Add(1)
+		memory.evictions.Add(1)
+	}
+}
+
+// the group to evict from, nil if the groups fit or all of them are at their minimum
+func pickVictim(limit int64,policy MemoryPolicy)*Group{
+	mu.RLock()
+	defer mu.RUnlock()
+	var used int64
+	for _,g := range groups{
+		used += g.mainCache.used.Load()
+	}
+	if used <= limit{
+		return nil
+	}
+	var victim *Group
+	var victimOver int64
+	var victimUse time.Time
+	for _,g := range groups{
+		over := g.mainCache.used.Load()-g.minBytes
+		// a slab keeps its bytes however many entries it holds
+		if over <= 0 || g.mainCache.preallocated.Load(){
+			continue
+		}
+		if policy == LargestFirst{
+			if victim == nil || over > victimOver{
+				victim,victimOver = g,over
+			}
+			continue
+		}
+		oldest,ok := g.mainCache.oldestUse()
+		if ok && (victim == nil || oldest.Before(victimUse)){
+			victim,victimUse = g,oldest
+		}
+	}
+	return victim
+}
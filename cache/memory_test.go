@@ -0,0 +1,224 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestEntryOverhead(t *testing.T) {
+	getter := GetterFunc(func(key string) ([]byte, error) { return []byte("630"), nil })
+	for name, c := range map[string]struct {
+		opts     []GroupOption
+		overhead int64
+	}{
+		"heap":    {nil, DefaultHeapEntryOverhead},
+		"slab":    {[]GroupOption{WithSlabStorage()}, DefaultSlabEntryOverhead},
+		"custom":  {[]GroupOption{WithEntryOverhead(10)}, 10},
+		"no-over": {[]GroupOption{WithEntryOverhead(0)}, 0},
+	} {
+		g := NewGroup("overhead-"+name, 2<<10, getter, c.opts...)
+		g.Get("Tom")
+		g.Get("Jack")
+		if stats := g.Stats(); stats.Bytes != 2*c.overhead+int64(len("Tom630Jack630")) {
+			t.Errorf("%s: expect %d bytes per entry on top, got %d bytes", name, c.overhead, stats.Bytes)
+		}
+	}
+	// the overhead counts against cacheBytes
+	g := NewGroup("overhead-small", 2*DefaultHeapEntryOverhead, getter)
+	for _, key := range []string{"a", "b", "c"} {
+		g.Get(key)
+	}
+	if stats := g.Stats(); stats.Items != 1 {
+		t.Fatalf("expect one entry to fit, got %d", stats.Items)
+	}
+}
+
+// run fn with only the groups it creates registered
+func withoutGroups(fn func()) {
+	mu.Lock()
+	saved := groups
+	groups = make(map[string]*Group)
+	mu.Unlock()
+	defer func() {
+		mu.Lock()
+		groups = saved
+		mu.Unlock()
+	}()
+	fn()
+}
+
+func TestMemoryBudget(t *testing.T) {
+	withoutGroups(func() { testMemoryBudget(t) })
+}
+
+func testMemoryBudget(t *testing.T) {
+	value := []byte(strings.Repeat("x", 100))
+	getter := GetterFunc(func(key string) ([]byte, error) { return value, nil })
+	large := NewGroup("budget-large", 1<<20, getter)
+	small := NewGroup("budget-small", 1<<20, getter)
+	for i := 0; i < 100; i++ {
+		large.Get(fmt.Sprintf("key%d", i))
+	}
+	for i := 0; i < 10; i++ {
+		small.Get(fmt.Sprintf("key%d", i))
+	}
+	// leave room for 10 of the 110 entries
+	entry := DefaultHeapEntryOverhead + int64(len(value)+len("key00"))
+	budget := 10 * entry
+	SetMemoryBudget(budget)
+	defer SetMemoryBudget(0)
+
+	if used := MemoryUsed(); used > budget {
+		t.Fatalf("expect at most %d bytes used, got %d", budget, used)
+	}
+	if stats := large.Stats(); stats.BudgetEvictions == 0 || stats.Items >= 100 {
+		t.Fatalf("expect the group with the older entries to give them back, got %+v", stats)
+	}
+	// every add keeps the budget
+	for i := 10; i < 50; i++ {
+		small.Get(fmt.Sprintf("key%d", i))
+		if used := MemoryUsed(); used > budget {
+			t.Fatalf("expect at most %d bytes used, got %d", budget, used)
+		}
+	}
+	if large.Stats().Items+small.Stats().Items > 11 {
+		t.Fatalf("expect the groups to share room for 10 entries, got %d and %d", large.Stats().Items, small.Stats().Items)
+	}
+}
+
+func TestMemoryPolicies(t *testing.T) {
+	withoutGroups(func() { testMemoryPolicies(t) })
+}
+
+func testMemoryPolicies(t *testing.T) {
+	value := []byte(strings.Repeat("x", 100))
+	getter := GetterFunc(func(key string) ([]byte, error) { return value, nil })
+	entry := DefaultHeapEntryOverhead + int64(len(value)+len("key00"))
+	defer SetMemoryBudget(0)
+	defer SetMemoryPolicy(ColdestFirst)
+	for _, c := range []struct {
+		policy      MemoryPolicy
+		evictedFrom string
+	}{
+		{ColdestFirst, "cold"},
+		{LargestFirst, "hot"},
+	} {
+		SetMemoryBudget(0)
+		SetMemoryPolicy(c.policy)
+		cold := NewGroup("cold", 1<<20, getter)
+		hot := NewGroup("hot", 1<<20, getter)
+		for i := 0; i < 10; i++ {
+			cold.Get(fmt.Sprintf("key%02d", i))
+		}
+		for i := 0; i < 20; i++ {
+			hot.Get(fmt.Sprintf("key%02d", i))
+		}
+		// the smaller group is the colder one
+		for i := 0; i < 20; i++ {
+			hot.Get(fmt.Sprintf("key%02d", i))
+		}
+		SetMemoryBudget(25 * entry)
+		evicted := map[string]int64{"cold": cold.Stats().BudgetEvictions, "hot": hot.Stats().BudgetEvictions}
+		if evicted[c.evictedFrom] != 5 || evicted["cold"]+evicted["hot"] != 5 {
+			t.Errorf("%s: expect 5 entries evicted from %s, got %v", c.policy, c.evictedFrom, evicted)
+		}
+	}
+
+	// a group at its minimum keeps it
+	SetMemoryBudget(0)
+	SetMemoryPolicy(ColdestFirst)
+	kept := NewGroup("cold", 1<<20, getter, WithMinBytes(8*entry))
+	other := NewGroup("hot", 1<<20, getter)
+	for i := 0; i < 10; i++ {
+		kept.Get(fmt.Sprintf("key%02d", i))
+	}
+	for i := 0; i < 10; i++ {
+		other.Get(fmt.Sprintf("key%02d", i))
+	}
+	SetMemoryBudget(12 * entry)
+	if kept.Stats().Items != 8 || other.Stats().Items != 4 {
+		t.Fatalf("expect 8 entries kept by the minimum and 4 of the other group, got %d and %d", kept.Stats().Items, other.Stats().Items)
+	}
+	stats := GetMemoryStats()
+	if stats.Budget != 12*entry || stats.Used > stats.Budget || stats.Policy != "coldest" || stats.Evictions == 0 {
+		t.Fatalf("unexpected memory stats %+v", stats)
+	}
+	if g := stats.Groups["cold"]; g.MinBytes != 8*entry || g.MaxBytes != 1<<20 || g.Evictions != 2 || g.OldestUse.IsZero() {
+		t.Fatalf("unexpected group memory %+v", g)
+	}
+
+	w := httptest.NewRecorder()
+	server, err := NewAPIServer("", ":0", kept)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.httpServer.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/memory", nil))
+	var served MemoryStats
+	if err := json.Unmarshal(w.Body.Bytes(), &served); err != nil || served.Budget != stats.Budget || len(served.Groups) != 2 {
+		t.Fatalf("expect the memory stats served, got %s %v", w.Body.String(), err)
+	}
+}
+
+func TestMemoryBudgetSlab(t *testing.T) {
+	withoutGroups(func() { testMemoryBudgetSlab(t) })
+}
+
+func testMemoryBudgetSlab(t *testing.T) {
+	value := []byte(strings.Repeat("x", 100))
+	getter := GetterFunc(func(key string) ([]byte, error) { return value, nil })
+	entry := DefaultHeapEntryOverhead + int64(len(value)+len("key00"))
+	defer SetMemoryBudget(0)
+	slab := NewGroup("budget-slab", 64<<10, getter, WithSlabStorage())
+	heap := NewGroup("budget-heap", 1<<20, getter)
+	slab.Get("key00")
+	// the slab is allocated whole, one entry in it already takes all of it
+	if used := MemoryUsed(); used != 64<<10 {
+		t.Fatalf("expect the slab charged its capacity, got %d bytes", used)
+	}
+	for i := 0; i < 10; i++ {
+		heap.Get(fmt.Sprintf("key%02d", i))
+	}
+	// evicting from the slab frees nothing, so the heap group makes room
+	SetMemoryBudget(64<<10 + 4*entry)
+	if slab.Stats().BudgetEvictions != 0 || slab.Stats().Items != 1 || heap.Stats().Items != 4 {
+		t.Fatalf("expect only the heap group to give entries back, got %+v and %+v", slab.Stats(), heap.Stats())
+	}
+	if stats := GetMemoryStats(); stats.Used > stats.Budget || stats.Groups["budget-slab"].Bytes != 64<<10 {
+		t.Fatalf("unexpected memory stats %+v", stats)
+	}
+}
+
+// the accounted bytes of a group follow what it takes in the heap
+func TestAccountedHeap(t *testing.T) {
+	if testing.Short() {
+		t.Skip("measures the heap")
+	}
+	withoutGroups(func() { testAccountedHeap(t) })
+}
+
+func testAccountedHeap(t *testing.T) {
+	for _, size := range []int{8, 100, 1000} {
+		value := []byte(strings.Repeat("x", size))
+		g := NewGroup(fmt.Sprintf("accounted-%d", size), 1<<30, GetterFunc(func(key string) ([]byte, error) { return value, nil }))
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		// about 20MB each, so the garbage of other tests is lost in the noise
+		for i := 0; i < 20<<20/(size+DefaultHeapEntryOverhead); i++ {
+			g.Set(fmt.Sprintf("key%08d", i), value)
+		}
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		measured := float64(after.HeapAlloc) - float64(before.HeapAlloc)
+		accounted := float64(g.Stats().Bytes)
+		if ratio := accounted / measured; ratio < 0.8 || ratio > 1.2 {
+			t.Errorf("%d byte values: accounted %.0f bytes for %.0f in the heap", size, accounted, measured)
+		}
+		runtime.KeepAlive(g)
+	}
+}
@@ -1,21 +1,37 @@
 package cache
 
 import (
-	"cache/consistenthash"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
 	"net/http"
 	"net/url"
 	"strings"
 	"sync"
+	"time"
 )
 
 // this path will be used in node communication
 const defaultBasePath = "/_gocache/"
-const defaultReplicas = 5
+// peers leaving the cluster delete themselves under this path of every other node, and add themselves back when they start
+const peersPath = "_peers"
+// a peer that failed to answer is tried last by replicated groups for this long
+const peerCooldown = 5*time.Second
 var _PeerPicker = (*NetworkController)(nil)
+var _ReplicaPicker = (*NetworkController)(nil)
 var _PeerGetter = (*httpGetter)(nil)
+var _PeerSetter = (*httpGetter)(nil)
+var _ContextPeerGetter = (*httpGetter)(nil)
+
+// a peer asked to join that was never one of the configured peers
+var ErrUnknownPeer = errors.New("unknown peer")
+
+// peers only take pushed values from authenticated peers, see WithPeerKeys and WithTLS
+var ErrPeerWritesOff = errors.New("peer writes need peer keys or mutual tls")
 
 
 // HttpPool is a struct implementted hanlder, PeerPicker interface
@@ -23,8 +39,22 @@ type NetworkController struct{
 	self string // address and port for current node
 	basePath string // base url for cache api
 	mu sync.Mutex // mutex lock for register peer
-	peers *consistenthash.Map // a consistant hash object to add and map peers
+	peers PeerSelector // a consistant hash object to add and map peers
+	newSelector func()PeerSelector // creates an empty selector whenever the peers change
 	httpGetters map[string]*httpGetter // a hash map that map peer name to its getter function
+	weights map[string]int // weight of every peer on the ring
+	known map[string]int // last weight of every configured peer, only they may join the ring again
+	order []string // configured peers in the order they were first set, selectors number peers in it
+	authenticated bool // peers are authenticated by keys or mutual tls, only then they change the ring and write our caches
+	loadBound float64 // epsilon of bounded load peer selection, 0 means plain consistent hashing
+	client *http.Client // http client shared by all getters
+	downUntil map[string]time.Time // peers that recently failed and until when they are tried last
+	handoffRate int64 // bytes per second of key handoff when the ring changes, 0 turns it off
+	handoffCancel context.CancelFunc // stops the running handoff
+	handoffBefore PeerSelector // ring the running handoff started from
+	handoffSeq int // counts started handoffs, so a finished one knows if it is still the latest
+	keys *peerKeys // secrets peer requests are signed and checked with
+	shed *loadShedder // queues and sheds peer fetches under load, nil serves everything
 }
 
 // consturctor of HTTPPool
@@ -32,7 +62,83 @@ func NewNetworkController(self string)*NetworkController{
 	return &NetworkController{
 		self: self,
 		basePath: defaultBasePath,
+		client: &http.Client{},
+		newSelector: NewRingSelector,
+		keys: &peerKeys{},
+	}
+}
+
+// choose how keys are mapped to peers, like NewRingSelector, NewRendezvousSelector or NewJumpSelector
+// call it before Set, the current peers are kept
+func (p *NetworkController)SetSelector(newSelector func()PeerSelector){
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.newSelector = newSelector
+	if p.peers != nil{
+		p.rebuildLocked()
+	}
+}
+
+// create a fresh selector with every known peer, caller holds the lock
+func (p *NetworkController)rebuildLocked(){
+	p.peers = p.newSelector()
+	if b,ok := p.peers.(boundedSelector);ok{
+		b.SetLoadBound(p.loadBound)
+	}else if p.loadBound > 0{
+		p.Log("Selector does not support bounded loads, using plain selection")
 	}
+	p.fillLocked(p.peers,"")
+}
+
+// add the configured peers to s in the order they were set, peers not on the ring are added and removed again,
+// so a selector that numbers peers in that order, like jump hashing, numbers them like the live one
+func (p *NetworkController)fillLocked(s PeerSelector,without string){
+	for _,peer := range p.order{
+		s.AddWeighted(peer,p.known[peer])
+	}
+	for _,peer := range p.order{
+		if _,ok := p.weights[peer];!ok || peer == without{
+			s.Remove(peer)
+		}
+	}
+}
+
+// set the time limit of every request sent to a peer, 0 means no limit
+// call it before the controller starts serving
+func (p *NetworkController)SetTimeout(timeout time.Duration){
+	p.client.Timeout = timeout
+}
+
+// talk to peers over tls with the given config, like the client config of a cache server with mutual tls
+// call it before the controller starts serving
+func (p *NetworkController)SetTLS(config *tls.Config){
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	p.client.Transport = transport
+}
+
+// sign peer requests with the first key and accept requests signed with any of them, no keys turns it off
+// to rotate keys, add the new key after the old one on every node, then move it first, then drop the old one
+func (p *NetworkController)SetPeerKeys(keys ...PeerKey){
+	p.keys.set(keys)
+}
+
+// serve at most maxInFlight peer fetches at once and shed them once they queue longer than target, see WithLoadShedding
+// call it before serving
+func (p *NetworkController)SetLoadShedding(maxInFlight int,target time.Duration){
+	p.shed = newLoadShedder(maxInFlight,target)
+}
+
+// wait for a slot to serve a peer fetch, ok is false if the fetch is shed and should be retried after retryAfter
+func (p *NetworkController)admit(ctx context.Context)(release func(),retryAfter time.Duration,ok bool){
+	return p.shed.admit(ctx)
+}
+
+// check a request to the cache server comes from a peer holding one of our keys
+func (p *NetworkController)VerifyPeer(r *http.Request)error{
+	// key transfers are the only requests with a body too large to hash up front
+	streamed := r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path,p.basePath+transferPath+"/")
+	return p.keys.verify(r,time.Now(),streamed)
 }
 
 // Log function
@@ -47,6 +153,14 @@ func(p *NetworkController)ServeHTTP(w http.ResponseWriter,r *http.Request){
 		panic("HTTPPOOL serving unexpected path:" + r.URL.Path)
 	}
 	p.Log("%s,%s",r.Method,r.URL.Path)
+	release,retryAfter,ok := p.admit(r.Context())
+	if !ok{
+		setRetryAfter(w.Header(),retryAfter)
+		http.Error(w,"overloaded",http.StatusServiceUnavailable)
+		return
+	}
+	defer release()
+	defer p.trackServe()()
 	// split path to get group and key name
 	parts := strings.SplitN(r.URL.Path[len(p.basePath):],"/",2)
 	if len(parts) != 2{
@@ -59,37 +173,199 @@ func(p *NetworkController)ServeHTTP(w http.ResponseWriter,r *http.Request){
 	// get group in cache
 	group := GetGroup(groupName)
 	if group == nil{
-		http.Error(w,"no such group",http.StatusNotFound)
+		http.Error(w,"no such group",statusNoSuchGroup)
 		return
 	}
 	
-	// fetch data in current group
-	view, err := group.Get(key)
-	if err != nil{
-		http.Error(w,err.Error(),http.StatusInternalServerError)
-		return
-	}
-	// write response
-	w.Header().Set("Content-Type","application/octet-stream")
-	w.Write(view.ByteSlice())
+	servePeerValue(w,r,group,key)
 }
 
 // function to set peers for current node
 func (p *NetworkController)Set(peers ...string){
+	weighted := make([]Peer,len(peers))
+	for i,peer := range peers{
+		weighted[i] = Peer{Addr: peer,Weight: 1}
+	}
+	p.SetPeers(weighted...)
+}
+
+// function to set peers with their weights, a peer with weight 2 owns about twice the keys of weight 1
+func (p *NetworkController)SetPeers(peers ...Peer){
 	// lock to prevent conflict
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	// create consistant hash object
-	p.peers = consistenthash.New(defaultReplicas,nil)
-	// add all peers into the hashring and create mapping
-	p.peers.Add(peers...)
-	// for each peer, we create its mapping between its name and its getter function
-	p.httpGetters = make(map[string]*httpGetter,len(peers))
-	// create getter function for each peer
-	// the base url for the getter function is the name of the peer with base path
+	weights := make(map[string]int,len(peers))
 	for _,peer:= range peers{
-		p.httpGetters[peer] = &httpGetter{baseUrl: peer+p.basePath}
+		weights[peer.Addr] = peer.Weight
+	}
+	if p.known == nil{
+		p.known = make(map[string]int,len(peers))
 	}
+	// keys of the first set of peers have nowhere to come from
+	if p.peers != nil && p.handoffRate > 0{
+		defer p.startHandoffLocked(p.snapshotLocked(""))
+	}
+	if p.peers == nil{
+		// first call, start from an empty selector
+		p.weights = nil
+		p.rebuildLocked()
+		p.httpGetters = make(map[string]*httpGetter,len(peers))
+	}
+	// only peers that left, joined or changed weight are touched, the selector keeps the others as they are
+	// a peer that is no longer configured will not come back, a selector numbering peers gives its numbers up
+	order := make([]string,0,len(peers))
+	for _,peer := range p.order{
+		if _,ok := weights[peer];ok{
+			order = append(order, peer)
+			continue
+		}
+		if f,ok := p.peers.(forgetSelector);ok{
+			f.Forget(peer)
+		}else{
+			p.peers.Remove(peer)
+		}
+		delete(p.known,peer)
+		delete(p.httpGetters,peer)
+	}
+	p.order = order
+	// new peers join in the order given, so nodes with the same peers in their config number them the same way
+	for _,each := range peers{
+		peer,weight := each.Addr,weights[each.Addr]
+		if _,ok := p.known[peer];!ok{
+			p.order = append(p.order, peer)
+		}
+		p.known[peer] = weight
+		if old,ok := p.weights[peer];ok && old == weight{
+			continue
+		}
+		// share of keys scaled by weight, adding a peer again updates its weight
+		p.peers.AddWeighted(peer,weight)
+		// create getter function for each peer
+		// the base url for the getter function is the name of the peer with base path
+		if _,ok := p.httpGetters[peer];!ok{
+			p.httpGetters[peer] = p.newGetter(peer)
+		}
+	}
+	p.weights = weights
+}
+
+// create the getter of peer, it reports failed requests so replicas can skip the peer for a while
+func (p *NetworkController)newGetter(peer string)*httpGetter{
+	return &httpGetter{baseUrl: peer+p.basePath,client: p.client,keys: p.keys,writes: p.authenticated,failed: func(){p.markDown(peer)}}
+}
+
+// function to remove a peer from the ring, used when the peer leaves the cluster
+func (p *NetworkController)Remove(peer string){
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _,ok := p.httpGetters[peer];!ok{
+		return
+	}
+	if p.handoffRate > 0{
+		// nothing to hand over from a peer that is gone, but with replicas our copies gain new replicas
+		// the ring before is taken while the peer is still on it
+		defer p.startHandoffLocked(p.snapshotLocked(""))
+	}
+	delete(p.httpGetters,peer)
+	delete(p.weights,peer)
+	delete(p.downUntil,peer)
+	// only the keys of the leaving peer move
+	p.peers.Remove(peer)
+	p.Log("Removed peer %s",peer)
+}
+
+// function to add a peer to the ring, or change its weight, used when a peer that left comes back
+// only a peer set before may come back, a weight out of 1..MaxPeerWeight is clamped
+func (p *NetworkController)Add(peer string,weight int)error{
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _,ok := p.known[peer];!ok{
+		return ErrUnknownPeer
+	}
+	if weight < 1{
+		weight = 1
+	}else if weight > MaxPeerWeight{
+		weight = MaxPeerWeight
+	}
+	if old,ok := p.weights[peer];ok && old == weight{
+		return nil
+	}
+	if p.peers == nil{
+		p.weights = nil
+		p.rebuildLocked()
+		p.httpGetters = make(map[string]*httpGetter)
+	}else if p.handoffRate > 0{
+		defer p.startHandoffLocked(p.snapshotLocked(""))
+	}
+	if p.weights == nil{
+		p.weights = make(map[string]int)
+	}
+	p.weights[peer] = weight
+	p.known[peer] = weight
+	p.peers.AddWeighted(peer,weight)
+	if _,ok := p.httpGetters[peer];!ok{
+		p.httpGetters[peer] = p.newGetter(peer)
+	}
+	p.Log("Added peer %s",peer)
+	return nil
+}
+
+// tell every other peer that current node is leaving, so they stop picking it
+func (p *NetworkController)Deregister(ctx context.Context)error{
+	return p.announce(ctx,http.MethodDelete)
+}
+
+// tell every other peer that current node is serving, so peers that dropped it when it left pick it again
+func (p *NetworkController)Register(ctx context.Context)error{
+	return p.announce(ctx,http.MethodPost)
+}
+
+// send our address and weight to the peers path of every other peer with method
+// without peer auth the peers do not serve the path, so there is nobody to tell
+func (p *NetworkController)announce(ctx context.Context,method string)error{
+	p.mu.Lock()
+	if !p.authenticated{
+		p.mu.Unlock()
+		return nil
+	}
+	peers := make([]string,0,len(p.httpGetters))
+	for peer := range p.httpGetters{
+		if peer != p.self{
+			peers = append(peers, peer)
+		}
+	}
+	weight,ok := p.weights[p.self]
+	p.mu.Unlock()
+	if !ok{
+		weight = 1
+	}
+
+	var first error
+	for _,peer := range peers{
+		u := fmt.Sprintf("%v%v%v?peer=%v&weight=%d",peer,p.basePath,peersPath,url.QueryEscape(p.self),weight)
+		req,err := http.NewRequestWithContext(ctx,method,u,nil)
+		if err == nil{
+			err = p.keys.sign(req)
+		}
+		if err != nil{
+			return err
+		}
+		res,err := p.client.Do(req)
+		if err == nil{
+			res.Body.Close()
+			if res.StatusCode != http.StatusOK{
+				err = fmt.Errorf("server returned %v",res.Status)
+			}
+		}
+		// a peer that is down does not need to be told, it has us in its peers when it starts again
+		if err != nil{
+			p.Log("%s %s at %s failed: %v",method,peersPath,peer,err)
+			if first == nil{
+				first = err
+			}
+		}
+	}
+	return first
 }
 
 // function to implement PeerPicker interface, then we can inject this object into our maincache
@@ -97,6 +373,9 @@ func(p *NetworkController)PickPeer(key string)(PeerGetter,bool){
 	// lock to prevent conflict
 	p.mu.Lock()
 	defer p.mu.Unlock()
+	if b,ok := p.peers.(boundedSelector);ok && p.loadBound > 0{
+		return p.pickBounded(b,key)
+	}
 	// in the consistant hash , we find the peer that store the val of given key
 	if peer := p.peers.Get(key);peer != "" && peer != p.self{
 		// if peer is found, return its getter function
@@ -106,33 +385,233 @@ func(p *NetworkController)PickPeer(key string)(PeerGetter,bool){
 	return nil,false
 }
 
+// pick the first peer clockwise that is under its load limit, caller holds the lock
+// the load of a peer is the number of our requests it is still answering
+func (p *NetworkController)pickBounded(b boundedSelector,key string)(PeerGetter,bool){
+	peer := b.GetLeast(key)
+	if peer == "" || peer == p.self{
+		return nil,false
+	}
+	p.Log("Pick peer %s (load %d)",peer,b.Load(peer))
+	b.Inc(peer)
+	return &trackedGetter{PeerGetter: p.httpGetters[peer],done: func(){p.done(peer)}},true
+}
+
+// switch peer selection to consistent hashing with bounded loads, epsilon <= 0 turns it off
+// no peer is sent more than (1+epsilon) times its share of the requests in flight
+func (p *NetworkController)SetLoadBound(epsilon float64){
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.loadBound = epsilon
+	if b,ok := p.peers.(boundedSelector);ok{
+		b.SetLoadBound(epsilon)
+	}
+}
+
+// count a request from a peer that this node is serving, call the returned function when it is answered
+// so that keys owned by a busy node spill over to the next one
+func (p *NetworkController)trackServe()func(){
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	b,ok := p.peers.(boundedSelector)
+	if !ok || p.loadBound <= 0{
+		return func(){}
+	}
+	b.Inc(p.self)
+	return func(){p.done(p.self)}
+}
+
+// release one unit of load of peer
+func (p *NetworkController)done(peer string){
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if b,ok := p.peers.(boundedSelector);ok{
+		b.Done(peer)
+	}
+}
+
+// a peer getter that releases the load of its peer once the request returns
+type trackedGetter struct{
+	PeerGetter
+	done func()
+}
+
+func (t *trackedGetter)Get(group string, key string)([]byte,error){
+	defer t.done()
+	return t.PeerGetter.Get(group,key)
+}
+
+func (t *trackedGetter)GetContext(ctx context.Context,group string, key string)([]byte,error){
+	defer t.done()
+	if cg,ok := t.PeerGetter.(ContextPeerGetter);ok{
+		return cg.GetContext(ctx,group,key)
+	}
+	return t.PeerGetter.Get(group,key)
+}
+
+// return the n replicas of key, peers that failed recently are moved to the end
+// this node is returned as a nil getter, so the caller knows it holds a replica itself
+func (p *NetworkController)PickReplicas(key string,n int)[]PeerGetter{
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.peers == nil{
+		return nil
+	}
+	now := time.Now()
+	var healthy,down []PeerGetter
+	for _,peer := range p.peers.GetN(key,n){
+		switch{
+		case peer == p.self:
+			healthy = append(healthy, nil)
+		case now.Before(p.downUntil[peer]):
+			down = append(down, p.httpGetters[peer])
+		default:
+			healthy = append(healthy, p.httpGetters[peer])
+		}
+	}
+	return append(healthy,down...)
+}
+
+// remember that peer did not answer, it is tried last until the cooldown passes
+func (p *NetworkController)markDown(peer string){
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.downUntil == nil{
+		p.downUntil = make(map[string]time.Time)
+	}
+	p.downUntil[peer] = time.Now().Add(peerCooldown)
+}
+
+// return the peer that owns key on the ring, which may be this node itself
+func (p *NetworkController)Owner(key string)string{
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.peers == nil{
+		return ""
+	}
+	return p.peers.Get(key)
+}
+
 // a getter object to retrieve data from peer node(Implemented peerGetter interface)
 type httpGetter struct{
 	baseUrl string
+	client *http.Client
+	keys *peerKeys // requests are signed with these, nil sends them unsigned
+	writes bool // the peer takes pushed values, only when peers are authenticated
+	failed func() // called when the peer can not be reached
 }
 
 func(h *httpGetter)Get(group string, key string)([]byte,error){
-	// create the url for peer node
-	u := fmt.Sprintf(
-		"%v%v/%v",h.baseUrl,url.QueryEscape(group),url.QueryEscape(key),
-	)
-	// send get request
-	 res, err := http.Get(u)
-	// fetch failed
-	 if err != nil{
+	return h.GetContext(context.Background(),group,key)
+}
+
+// same as Get, the request is aborted when ctx is done
+func(h *httpGetter)GetContext(ctx context.Context,group string, key string)([]byte,error){
+	// set by hand, so the transport does not decompress gzip on its own and every registered compressor is offered
+	res,err := h.fetch(ctx,h.client,group,key,compressorNames())
+	if err != nil{
 		return nil,err
+	}
+	 defer res.Body.Close()
+	 // parse body, with the size known up front the buffer is allocated once
+	 buf := new(bytes.Buffer)
+	 if res.ContentLength > 0{
+		buf.Grow(int(res.ContentLength))
 	 }
-	 // check status
-	 if res.StatusCode != http.StatusOK{
-		return nil,fmt.Errorf("server returned %v",res.Status)
-	 }
-	 // parse body
-	 bytes, err := ioutil.ReadAll(res.Body)
+	 _,err = buf.ReadFrom(&trailerReader{res: res})
 	 // parse error
 	 if err != nil{
 		return nil,fmt.Errorf("reading response body:%v",err)
 	 }
+	 value := buf.Bytes()
+	 // the peer sent the value as it caches it
+	 if encoding := res.Header.Get("Content-Encoding");encoding != ""{
+		c,ok := CompressorByName(encoding)
+		if !ok{
+			return nil,fmt.Errorf("unknown content encoding %q",encoding)
+		}
+		if value,err = c.Decompress(value);err != nil{
+			return nil,fmt.Errorf("decompressing response body:%v",err)
+		}
+	 }
 	 // successfully fetched
-	 return bytes,nil
+	 return value,nil
+}
+
+// stream the value of key from the peer, the caller must close the stream
+// a stream the peer could not finish ends in an error instead of EOF
+func(h *httpGetter)GetStream(ctx context.Context,group string,key string)(io.ReadCloser,error){
+	// a stream may take much longer than a single fetch, so the peer timeout does not apply, ctx does
+	client := *h.client
+	client.Timeout = 0
+	// no Accept-Encoding, the transport asks for gzip and decompresses on the fly
+	res,err := h.fetch(ctx,&client,group,key,"")
+	if err != nil{
+		return nil,err
+	}
+	return &trailerReader{res: res},nil
+}
 
-}
\ No newline at end of file
+// send a fetch of key to the peer, a response without error has status 200 and an open body
+func(h *httpGetter)fetch(ctx context.Context,client *http.Client,group string,key string,acceptEncoding string)(*http.Response,error){
+	// create the url for peer node
+	u := fmt.Sprintf(
+		"%v%v/%v",h.baseUrl,url.QueryEscape(group),url.QueryEscape(key),
+	)
+	req,err := http.NewRequestWithContext(ctx,http.MethodGet,u,nil)
+	if err != nil{
+		return nil,err
+	}
+	if err := h.keys.sign(req);err != nil{
+		return nil,err
+	}
+	if acceptEncoding != ""{
+		req.Header.Set("Accept-Encoding",acceptEncoding)
+	}
+	// send get request
+	res,err := client.Do(req)
+	// fetch failed, a cancelled request says nothing about the peer
+	if err != nil{
+		if ctx.Err() == nil{
+			h.fail()
+		}
+		return nil,err
+	}
+	// check status
+	if res.StatusCode != http.StatusOK{
+		res.Body.Close()
+		return nil,peerStatusError(res)
+	}
+	return res,nil
+}
+
+// store value for key in the cache of the peer, used to populate replicas
+func (h *httpGetter)Set(group string,key string,value []byte)error{
+	if !h.writes{
+		return ErrPeerWritesOff
+	}
+	u := fmt.Sprintf("%v%v/%v",h.baseUrl,url.QueryEscape(group),url.QueryEscape(key))
+	req,err := http.NewRequest(http.MethodPut,u,bytes.NewReader(value))
+	if err != nil{
+		return err
+	}
+	if err := h.keys.sign(req);err != nil{
+		return err
+	}
+	res,err := h.client.Do(req)
+	if err != nil{
+		h.fail()
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNoContent{
+		return fmt.Errorf("server returned %v",res.Status)
+	}
+	return nil
+}
+
+func (h *httpGetter)fail(){
+	if h.failed != nil{
+		h.failed()
+	}
+}
@@ -0,0 +1,194 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestPickPeerBoundedLoad(t *testing.T) {
+	// this node is not on the ring, so every pick goes to a remote peer
+	p := NewNetworkController("http://self")
+	p.Set("http://a", "http://b", "http://c")
+	p.SetLoadBound(0.25)
+
+	// a hot key is spread over the ring while its owner is busy
+	var getters []PeerGetter
+	picked := make(map[string]int)
+	for i := 0; i < 40; i++ {
+		peer, ok := p.PickPeer("hot")
+		if !ok {
+			t.Fatal("expect a remote peer")
+		}
+		getters = append(getters, peer)
+		picked[peer.(*trackedGetter).PeerGetter.(*httpGetter).baseUrl]++
+	}
+	if len(picked) < 2 {
+		t.Fatalf("expect hot key to spill over to other peers, got %v", picked)
+	}
+	// ceil(1.25 * 40 / 3)
+	for peer, n := range picked {
+		if n > 17 {
+			t.Fatalf("peer %s got %d of 40 requests, limit is 17", peer, n)
+		}
+	}
+
+	// answered requests release their load
+	for _, g := range getters {
+		g.(*trackedGetter).done()
+	}
+	for _, peer := range []string{"http://a", "http://b", "http://c"} {
+		if load := p.peers.(boundedSelector).Load(peer); load != 0 {
+			t.Fatalf("expect load of %s to be released, got %d", peer, load)
+		}
+	}
+}
+
+func TestSetPeersIncremental(t *testing.T) {
+	for _, s := range selectors {
+		p := NewNetworkController("http://a")
+		p.SetSelector(s.new)
+		p.Set("http://a", "http://b", "http://c")
+		p.SetPeers(Peer{Addr: "http://a"}, Peer{Addr: "http://c", Weight: 2}, Peer{Addr: "http://d"})
+		p.Remove("http://a")
+
+		// a controller that only ever saw the final peers, and the same peer leaving, must agree on every key
+		fresh := NewNetworkController("http://a")
+		fresh.SetSelector(s.new)
+		fresh.SetPeers(Peer{Addr: "http://a"}, Peer{Addr: "http://c", Weight: 2}, Peer{Addr: "http://d"})
+		fresh.Remove("http://a")
+		for i := 0; i < 1000; i++ {
+			key := "key" + strconv.Itoa(i)
+			if got, expect := p.Owner(key), fresh.Owner(key); got != expect {
+				t.Fatalf("%s: key %s owned by %s, expect %s", s.name, key, got, expect)
+			}
+		}
+		if len(p.httpGetters) != 2 || p.httpGetters["http://b"] != nil {
+			t.Fatalf("%s: expect getters of c and d only, got %v", s.name, p.httpGetters)
+		}
+	}
+}
+
+func TestRegisterAfterLeaving(t *testing.T) {
+	g := NewGroup("rejoin", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		return nil, ErrNotFound
+	}))
+	key := PeerKey{ID: "k1", Secret: []byte("secret")}
+	server, err := NewCacheServer("http://b", ":0", []string{"http://a", "http://b"}, g, WithPeerKeys(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := httptest.NewServer(server.httpServer.Handler)
+	defer b.Close()
+
+	a := NewNetworkController("http://a")
+	a.SetPeerKeys(key)
+	a.authenticated = true
+	a.SetPeers(Peer{Addr: "http://a", Weight: 2}, Peer{Addr: b.URL})
+	owns := func() bool {
+		server.Peers().mu.Lock()
+		defer server.Peers().mu.Unlock()
+		_, ok := server.Peers().httpGetters["http://a"]
+		return ok && server.Peers().weights["http://a"] == 2
+	}
+	if err := a.Deregister(context.Background()); err != nil || owns() {
+		t.Fatalf("expect b to drop a when it leaves, got %v", err)
+	}
+	// a restarted node is picked again, with its weight
+	if err := a.Register(context.Background()); err != nil || !owns() {
+		t.Fatalf("expect b to add a back when it starts, got %v", err)
+	}
+
+	// only configured peers join, with a bounded weight
+	for query, status := range map[string]int{
+		"peer=http://evil:1&weight=1":                           http.StatusForbidden,
+		"peer=http://a&weight=0":                                http.StatusBadRequest,
+		"peer=http://a&weight=" + strconv.Itoa(MaxPeerWeight+1): http.StatusBadRequest,
+		"peer=http://a&weight=" + strconv.Itoa(MaxPeerWeight):   http.StatusOK,
+	} {
+		req, _ := http.NewRequest(http.MethodPost, b.URL+"/_gocache/_peers?"+query, nil)
+		a.keys.sign(req)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != status {
+			t.Fatalf("%s: expect %d, got %d", query, status, res.StatusCode)
+		}
+	}
+	if _, ok := server.Peers().httpGetters["http://evil:1"]; ok {
+		t.Fatal("expect an unknown peer to stay off the ring")
+	}
+}
+
+func TestPeerWritesNeedPeerAuth(t *testing.T) {
+	g := NewGroup("open-peers", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		return nil, ErrNotFound
+	}))
+	server, err := NewCacheServer("http://b", ":0", []string{"http://a", "http://b"}, g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct{ method, path string }{
+		{http.MethodPost, "/_gocache/_peers?peer=http://a"},
+		{http.MethodDelete, "/_gocache/_peers?peer=http://a"},
+		{http.MethodPut, "/_gocache/open-peers/Tom"},
+		{http.MethodPost, "/_gocache/_transfer/open-peers"},
+	} {
+		w := httptest.NewRecorder()
+		server.httpServer.Handler.ServeHTTP(w, httptest.NewRequest(c.method, c.path, strings.NewReader("630")))
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("%s %s: expect the route to be off without peer auth, got %d", c.method, c.path, w.Code)
+		}
+	}
+	if len(server.Peers().httpGetters) != 2 || g.Cached("Tom") {
+		t.Fatalf("expect the peers and the cache untouched, got %v", server.Peers().httpGetters)
+	}
+	// nor does this node push to its peers
+	if err := server.Peers().httpGetters["http://a"].Set("open-peers", "Tom", []byte("630")); !errors.Is(err, ErrPeerWritesOff) {
+		t.Fatalf("expect pushes to be off, got %v", err)
+	}
+}
+
+func TestPeerRequestNotForwarded(t *testing.T) {
+	for _, passthrough := range []bool{false, true} {
+		loads := 0
+		opts := []GroupOption{}
+		if passthrough {
+			opts = append(opts, WithMaxValueBytes(1<<10, true))
+		}
+		g := NewGroup("not-forwarded", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+			loads++
+			return []byte(db[key]), nil
+		}), opts...)
+		// the owner of every key is another peer, as it is for a key that spilled over under bounded loads
+		other := &fakePeer{values: map[string]string{"Tom": "from peer", "Jack": "from peer"}, pushed: make(chan string, 1)}
+		g.RegisterPeers(fakeReplicas{other})
+
+		w := httptest.NewRecorder()
+		servePeerValue(w, httptest.NewRequest(http.MethodGet, "/_gocache/not-forwarded/Tom", nil), g, "Tom")
+		if w.Code != http.StatusOK || w.Body.String() != "630" || loads != 1 {
+			t.Fatalf("passthrough %v: expect Tom loaded here, got %d %q after %d loads", passthrough, w.Code, w.Body.String(), loads)
+		}
+		// callers of this node still ask the owner
+		if v, err := g.Get("Jack"); err != nil || v.String() != "from peer" || loads != 1 {
+			t.Fatalf("passthrough %v: expect Jack from the peer, got %q %v", passthrough, v.String(), err)
+		}
+	}
+}
+
+func TestPeerNoSuchGroup(t *testing.T) {
+	p := NewNetworkController("http://self")
+	p.Set("http://self")
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/_gocache/no-such-group/Tom", nil))
+	// a node without the group is misconfigured, the key may still exist
+	if err := peerStatusError(w.Result()); w.Code != statusNoSuchGroup || errors.Is(err, ErrNotFound) {
+		t.Fatalf("expect a missing group not to look like a missing key, got %d %v", w.Code, err)
+	}
+}
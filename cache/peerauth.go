@@ -0,0 +1,193 @@
+package cache
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// authorization scheme of peer requests: "GOCACHE-PEER <key id>:<signature>"
+	peerAuthScheme = "GOCACHE-PEER "
+	// random value that makes every signed peer request unique
+	peerNonceHeader = "X-Gocache-Nonce"
+	// hex sha256 of the body, or unsignedPayload for streamed bodies
+	peerContentHeader = "X-Gocache-Content-Sha256"
+	// bodies that can not be read twice, like key transfer streams, are not covered by the signature, no other route accepts it
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+	// peer requests signed longer ago than this are rejected, and their nonces forgotten
+	peerMaxSkew = time.Minute
+)
+
+// PeerKey is a secret shared by the nodes of a cluster, peer requests are signed with it
+type PeerKey struct{
+	ID string // sent with every request so the receiver knows which secret to check with
+	Secret []byte
+}
+
+// keys a node signs and checks peer requests with, and the nonces it has seen
+type peerKeys struct{
+	mu sync.Mutex
+	keys []PeerKey // the first key signs, every key is accepted
+	nonces map[string]time.Time // nonces seen recently and when they can be forgotten
+	swept time.Time // last time expired nonces were dropped
+}
+
+// replace the keys, no keys turns signing and checking off
+func (k *peerKeys)set(keys []PeerKey){
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys = append([]PeerKey(nil),keys...)
+}
+
+// the key requests are signed with, false when there is none
+func (k *peerKeys)signingKey()(PeerKey,bool){
+	if k == nil{
+		return PeerKey{},false
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if len(k.keys) == 0{
+		return PeerKey{},false
+	}
+	return k.keys[0],true
+}
+
+// sign r with the current key, if there is one
+func (k *peerKeys)sign(r *http.Request)error{
+	key,ok := k.signingKey()
+	if !ok{
+		return nil
+	}
+	return SignPeerRequest(r,key)
+}
+
+// sign a request to a cache server whose cluster uses key, like a request of gocache-cli -direct
+func SignPeerRequest(r *http.Request,key PeerKey)error{
+	contentHash,err := peerContentHash(r)
+	if err != nil{
+		return err
+	}
+	nonce := make([]byte,16)
+	if _,err := rand.Read(nonce);err != nil{
+		return err
+	}
+	date := strconv.FormatInt(time.Now().Unix(),10)
+	r.Header.Set(hmacDateHeader,date)
+	r.Header.Set(peerNonceHeader,base64.RawURLEncoding.EncodeToString(nonce))
+	r.Header.Set(peerContentHeader,contentHash)
+	r.Header.Set("Authorization",peerAuthScheme+key.ID+":"+signature256(key.Secret,peerCanonical(r)))
+	return nil
+}
+
+// hash of the body of an outgoing request, without consuming it
+func peerContentHash(r *http.Request)(string,error){
+	if r.Body == nil || r.Body == http.NoBody{
+		return hashBody(nil),nil
+	}
+	if r.GetBody == nil{
+		return unsignedPayload,nil
+	}
+	body,err := r.GetBody()
+	if err != nil{
+		return "",err
+	}
+	defer body.Close()
+	data,err := io.ReadAll(body)
+	if err != nil{
+		return "",err
+	}
+	return hashBody(data),nil
+}
+
+// the part of a peer request the signature covers
+func peerCanonical(r *http.Request)string{
+	return canonicalRequest(r.Method,r.URL.RequestURI(),r.Header.Get(hmacDateHeader),r.Header.Get(peerNonceHeader),r.Header.Get(peerContentHeader))
+}
+
+// check r was signed by a peer with one of our keys and is not a replay, every request passes when there are no keys
+// the body must match its signed hash unless streamed is set, only then may it be left unsigned
+func (k *peerKeys)verify(r *http.Request,now time.Time,streamed bool)error{
+	k.mu.Lock()
+	keys := k.keys
+	k.mu.Unlock()
+	if len(keys) == 0{
+		return nil
+	}
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header,peerAuthScheme){
+		return errors.New("missing peer signature")
+	}
+	id,signature,ok := strings.Cut(strings.TrimPrefix(header,peerAuthScheme),":")
+	if !ok{
+		return errors.New("malformed peer signature")
+	}
+	var secret []byte
+	for _,key := range keys{
+		if key.ID == id{
+			secret = key.Secret
+			break
+		}
+	}
+	if secret == nil{
+		return fmt.Errorf("unknown peer key %q",id)
+	}
+	date := r.Header.Get(hmacDateHeader)
+	if err := checkSignedAt(date,now,peerMaxSkew);err != nil{
+		return err
+	}
+	nonce := r.Header.Get(peerNonceHeader)
+	if nonce == ""{
+		return fmt.Errorf("missing %s header",peerNonceHeader)
+	}
+	contentHash := r.Header.Get(peerContentHeader)
+	if contentHash == unsignedPayload && !streamed{
+		return errors.New("unsigned payload is only accepted for streamed bodies")
+	}
+	if contentHash != unsignedPayload{
+		body,err := readBody(r)
+		if err != nil{
+			return err
+		}
+		if !hmac.Equal([]byte(hashBody(body)),[]byte(contentHash)){
+			return errors.New("body does not match its signature")
+		}
+	}
+	if !hmac.Equal([]byte(signature256(secret,peerCanonical(r))),[]byte(signature)){
+		return errors.New("invalid peer signature")
+	}
+	// only checked once the signature is valid, so forged requests can not fill the nonce cache
+	signedAt,_ := strconv.ParseInt(date,10,64)
+	return k.useNonce(nonce,time.Unix(signedAt,0).Add(peerMaxSkew),now)
+}
+
+// remember nonce until expires, fail if it was used before
+func (k *peerKeys)useNonce(nonce string,expires time.Time,now time.Time)error{
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.nonces == nil{
+		k.nonces = make(map[string]time.Time)
+	}
+	// a request older than peerMaxSkew is rejected anyway, so its nonce is not needed any more
+	if now.Sub(k.swept) >= peerMaxSkew{
+		for n,exp := range k.nonces{
+			if now.After(exp){
+				delete(k.nonces,n)
+			}
+		}
+		k.swept = now
+	}
+	if _,ok := k.nonces[nonce];ok{
+		return errors.New("replayed peer request")
+	}
+	k.nonces[nonce] = expires
+	return nil
+}
@@ -0,0 +1,132 @@
+package cache
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPeerAuth(t *testing.T) {
+	g := NewGroup("peerauth", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		return []byte(db[key]), nil
+	}))
+	oldKey := PeerKey{ID: "k1", Secret: []byte("old secret")}
+	newKey := PeerKey{ID: "k2", Secret: []byte("new secret")}
+	// a node in the middle of a rotation accepts both keys
+	server, err := NewCacheServer("http://self", ":0", []string{"http://self"}, g, WithPeerKeys(oldKey, newKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(server.httpServer.Handler)
+	defer ts.Close()
+
+	getter := func(keys ...PeerKey) *httpGetter {
+		k := &peerKeys{}
+		k.set(keys)
+		return &httpGetter{baseUrl: ts.URL + defaultBasePath, client: http.DefaultClient, keys: k, writes: true}
+	}
+	for _, keys := range [][]PeerKey{{oldKey}, {newKey, oldKey}} {
+		if v, err := getter(keys...).Get("peerauth", "Tom"); err != nil || string(v) != "630" {
+			t.Fatalf("signed with %s: expect 630, got %q %v", keys[0].ID, v, err)
+		}
+	}
+	if err := getter(newKey).Set("peerauth", "Jack", []byte("1")); err != nil {
+		t.Fatalf("expect signed push to be accepted, got %v", err)
+	}
+
+	// unsigned, or signed with a key the node does not know
+	for name, h := range map[string]*httpGetter{
+		"unsigned":    getter(),
+		"unknown key": getter(PeerKey{ID: "k1", Secret: []byte("guessed")}),
+	} {
+		if _, err := h.Get("peerauth", "Sam"); err == nil || !strings.Contains(err.Error(), "401") {
+			t.Fatalf("%s: expect 401, got %v", name, err)
+		}
+	}
+	if g.stats.gets.Load() != 2 {
+		t.Fatalf("expect rejected requests not to reach the group, got %d gets", g.stats.gets.Load())
+	}
+}
+
+func TestPeerSignature(t *testing.T) {
+	keys := &peerKeys{}
+	keys.set([]PeerKey{{ID: "k1", Secret: []byte("secret")}})
+	now := time.Now()
+	signed := func(body string) *http.Request {
+		r, _ := http.NewRequest(http.MethodPut, "http://node/_gocache/scores/Tom", strings.NewReader(body))
+		if err := keys.sign(r); err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	r := signed("630")
+	if err := keys.verify(r, now, false); err != nil {
+		t.Fatalf("expect valid signature, got %v", err)
+	}
+	if err := keys.verify(r, now, false); err == nil || !strings.Contains(err.Error(), "replayed") {
+		t.Fatalf("expect replay to be rejected, got %v", err)
+	}
+
+	r = signed("630")
+	r.Body = io.NopCloser(strings.NewReader("999"))
+	if err := keys.verify(r, now, false); err == nil {
+		t.Fatal("expect changed body to be rejected")
+	}
+
+	r = signed("630")
+	r.URL.Path = "/_gocache/scores/Jack"
+	r.RequestURI = ""
+	if err := keys.verify(r, now, false); err == nil {
+		t.Fatal("expect changed key to be rejected")
+	}
+
+	if err := keys.verify(signed(""), now.Add(2*peerMaxSkew), false); err == nil {
+		t.Fatal("expect old request to be rejected")
+	}
+
+	// streamed bodies are not hashed, but the rest of the request is
+	stream, _ := http.NewRequest(http.MethodPost, "http://node/_gocache/_transfer/scores", io.NopCloser(strings.NewReader("entries")))
+	if err := keys.sign(stream); err != nil {
+		t.Fatal(err)
+	}
+	if stream.Header.Get(peerContentHeader) != unsignedPayload {
+		t.Fatalf("expect unsigned payload, got %q", stream.Header.Get(peerContentHeader))
+	}
+	if err := keys.verify(stream, now, true); err != nil {
+		t.Fatalf("expect signed stream to be accepted, got %v", err)
+	}
+	// anywhere else a body that is not hashed could be swapped on the way
+	unhashed, _ := http.NewRequest(http.MethodPut, "http://node/_gocache/scores/Tom", io.NopCloser(strings.NewReader("630")))
+	if err := keys.sign(unhashed); err != nil {
+		t.Fatal(err)
+	}
+	if err := keys.verify(unhashed, now, false); err == nil {
+		t.Fatal("expect unsigned payload to be rejected outside of streams")
+	}
+	p := NewNetworkController("http://node")
+	p.SetPeerKeys(PeerKey{ID: "k1", Secret: []byte("secret")})
+	for _, c := range []struct {
+		method, path string
+		ok           bool
+	}{
+		{http.MethodPost, "/_gocache/_transfer/scores", true},
+		{http.MethodPut, "/_gocache/scores/Tom", false},
+		{http.MethodPost, "/_gocache/_peers", false},
+	} {
+		r, _ := http.NewRequest(c.method, "http://node"+c.path, io.NopCloser(strings.NewReader("body")))
+		keys.sign(r)
+		if err := p.VerifyPeer(r); (err == nil) != c.ok {
+			t.Fatalf("%s %s: expect accepted %v, got %v", c.method, c.path, c.ok, err)
+		}
+	}
+
+	// nonces are forgotten once their requests expired
+	later := now.Add(3 * peerMaxSkew)
+	if err := keys.useNonce("fresh", later.Add(peerMaxSkew), later); err != nil || len(keys.nonces) != 1 {
+		t.Fatalf("expect expired nonces to be dropped, got %d %v", len(keys.nonces), err)
+	}
+}
@@ -1,5 +1,7 @@
 package cache
 
+import "context"
+
 // this picker will return a getter function, directly fetch data from other node
 type PeerPicker interface{
 	PickPeer(key string)(peer PeerGetter, ok bool)
@@ -8,4 +10,59 @@ type PeerPicker interface{
 // function to return data from another node
 type PeerGetter interface{
 	Get(group string, key string)([]byte,error)
-}
\ No newline at end of file
+}
+
+// a PeerGetter whose requests can be cancelled, so the slower of two hedged requests is dropped
+type ContextPeerGetter interface{
+	GetContext(ctx context.Context, group string, key string)([]byte,error)
+}
+
+// a PeerPicker that knows every replica of a key, used by groups with a replication factor
+type ReplicaPicker interface{
+	PeerPicker
+	// return up to n replicas of key, reachable ones first, a nil getter stands for this node
+	PickReplicas(key string, n int)[]PeerGetter
+}
+
+// a PeerGetter that can also store a value in its peer, used to warm up the other replicas of a key
+type PeerSetter interface{
+	Set(group string, key string, value []byte)error
+}
+
+// PeerSelector maps every key to one of the peers added to it
+// implementations do not need to be safe for concurrent use, NetworkController locks around them
+type PeerSelector interface{
+	// add a peer that owns about weight times the keys of a peer with weight 1
+	AddWeighted(peer string, weight int)
+	// remove a peer, only the keys it owned should move
+	Remove(peer string)
+	// return the peer owning key, "" if there are no peers
+	Get(key string)string
+	// return up to n distinct peers for key, the first one is the peer Get returns
+	GetN(key string, n int)[]string
+}
+
+// a selector that keeps the numbers of removed peers, like jump hashing, so they get their keys back when they are added again
+// Forget drops a peer that is no longer configured with its numbers
+type forgetSelector interface{
+	Forget(peer string)
+}
+
+// a selector that can skip peers that are too busy, see consistenthash.Map.SetLoadBound
+type boundedSelector interface{
+	PeerSelector
+	SetLoadBound(epsilon float64)
+	GetLeast(key string)string
+	Inc(peer string)
+	Done(peer string)
+	Load(peer string)int
+}
+
+// Peer is a node of the cluster, its weight scales the share of keys it owns
+type Peer struct{
+	Addr string
+	Weight int // 1 for a normal node, weight < 1 is treated as 1 and weight > MaxPeerWeight as MaxPeerWeight
+}
+
+// largest weight of a peer, every selector builds state that grows with the weight
+const MaxPeerWeight = 100
@@ -0,0 +1,212 @@
+package cache
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// buckets of clients that were quiet this long are dropped, a full bucket is the same as no bucket
+	limiterIdle = 10*time.Minute
+	// most buckets a limiter keeps, so callers making up keys can not grow it without bound
+	limiterMaxBuckets = 100000
+	// shedding starts once requests waited longer than the target for this long
+	shedInterval = 100*time.Millisecond
+)
+
+// token bucket refilled with rate tokens per second, holding at most burst tokens
+type tokenBucket struct{
+	tokens float64
+	last time.Time // last time tokens were added
+}
+
+// take one token, or report how long until one is available
+func (b *tokenBucket)take(now time.Time,rate float64,burst float64)(bool,time.Duration){
+	b.tokens = math.Min(burst,b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens >= 1{
+		b.tokens--
+		return true,0
+	}
+	return false,time.Duration((1-b.tokens)/rate*float64(time.Second))
+}
+
+// token buckets by key, like client address or group name
+type rateLimiter struct{
+	rate float64 // tokens per second
+	burst float64
+	mu sync.Mutex
+	buckets map[string]*tokenBucket
+	swept time.Time // last time idle buckets were dropped
+}
+
+// allow rate requests per second per key with bursts of burst, nil if rate <= 0
+func newRateLimiter(rate float64,burst int)*rateLimiter{
+	if rate <= 0{
+		return nil
+	}
+	if burst < 1{
+		burst = 1
+	}
+	return &rateLimiter{rate: rate,burst: float64(burst),buckets: make(map[string]*tokenBucket)}
+}
+
+// check if a request of key may pass, if not, how long until it may, a nil limiter allows everything
+func (l *rateLimiter)allow(key string,now time.Time)(bool,time.Duration){
+	if l == nil{
+		return true,0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.swept) >= limiterIdle{
+		for k,b := range l.buckets{
+			if now.Sub(b.last) >= limiterIdle{
+				delete(l.buckets,k)
+			}
+		}
+		l.swept = now
+	}
+	b,ok := l.buckets[key]
+	if !ok{
+		if len(l.buckets) >= limiterMaxBuckets{
+			l.makeRoomLocked(now)
+		}
+		b = &tokenBucket{tokens: l.burst,last: now}
+		l.buckets[key] = b
+	}
+	return b.take(now,l.rate,l.burst)
+}
+
+// drop the buckets that refilled, which is the same as having none
+// if every bucket is in use some are dropped anyway, their keys get a fresh burst, caller holds the lock
+func (l *rateLimiter)makeRoomLocked(now time.Time){
+	for k,b := range l.buckets{
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst{
+			delete(l.buckets,k)
+		}
+	}
+	for k := range l.buckets{
+		if len(l.buckets) < limiterMaxBuckets{
+			break
+		}
+		delete(l.buckets,k)
+	}
+}
+
+// admits at most maxInFlight requests at once, the others queue for a slot
+// once queued requests wait longer than target for shedInterval, new ones are turned away until the queue drains
+type loadShedder struct{
+	slots chan struct{}
+	target time.Duration // acceptable time in the queue
+	mu sync.Mutex
+	aboveSince time.Time // since when queue delays are above target, zero if they are not
+	shedding bool
+}
+
+// nil if maxInFlight <= 0
+func newLoadShedder(maxInFlight int,target time.Duration)*loadShedder{
+	if maxInFlight <= 0{
+		return nil
+	}
+	if target <= 0{
+		target = 5*time.Millisecond
+	}
+	return &loadShedder{slots: make(chan struct{},maxInFlight),target: target}
+}
+
+// wait for a slot, call release when the request is answered
+// ok is false when the request is shed, retryAfter tells the client when to come back
+func (s *loadShedder)admit(ctx context.Context)(release func(),retryAfter time.Duration,ok bool){
+	if s == nil{
+		return func(){},0,true
+	}
+	release = func(){<-s.slots}
+	select{
+	case s.slots <- struct{}{}:
+		s.observe(0)
+		return release,0,true
+	default:
+	}
+	if s.isShedding(){
+		return nil,shedInterval,false
+	}
+	// nobody waits much longer than the target, a queue that does not move is what shedding is for
+	start := time.Now()
+	timer := time.NewTimer(2*s.target)
+	defer timer.Stop()
+	select{
+	case s.slots <- struct{}{}:
+		s.observe(time.Since(start))
+		return release,0,true
+	case <-timer.C:
+		s.observe(time.Since(start))
+		return nil,shedInterval,false
+	case <-ctx.Done():
+		return nil,0,false
+	}
+}
+
+// record how long a request waited for its slot
+func (s *loadShedder)observe(wait time.Duration){
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	switch{
+	case wait < s.target:
+		s.aboveSince = time.Time{}
+		s.shedding = false
+	case s.aboveSince.IsZero():
+		s.aboveSince = now
+	case now.Sub(s.aboveSince) >= shedInterval:
+		s.shedding = true
+	}
+}
+
+func (s *loadShedder)isShedding()bool{
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.shedding
+}
+
+// tell the client when to retry, in whole seconds as Retry-After wants
+func setRetryAfter(h http.Header,d time.Duration){
+	secs := int(math.Ceil(d.Seconds()))
+	if secs < 1{
+		secs = 1
+	}
+	h.Set("Retry-After",strconv.Itoa(secs))
+}
+
+// allow at most n database loads of the group at once, more loads wait for a free slot, n <= 0 means no limit
+// keeps a burst of misses from overwhelming the database, singleflight already merges loads of the same key
+func WithMaxLoads(n int)GroupOption{
+	return func(g *Group){
+		if n <= 0{
+			g.loadSlots = nil
+			return
+		}
+		g.loadSlots = make(chan struct{},n)
+	}
+}
+
+// take a database load slot, call the returned function when the load is done
+func (g *Group)acquireLoad(ctx context.Context)(func(),error){
+	if g.loadSlots == nil{
+		return func(){},nil
+	}
+	select{
+	case g.loadSlots <- struct{}{}:
+	default:
+		g.stats.loadWaits.Add(1)
+		select{
+		case g.loadSlots <- struct{}{}:
+		case <-ctx.Done():
+			return nil,ctx.Err()
+		}
+	}
+	return func(){<-g.loadSlots},nil
+}
@@ -0,0 +1,198 @@
+package cache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(1, 2)
+	now := time.Now()
+	steps := []struct {
+		key        string
+		after      time.Duration
+		allowed    bool
+		retryAfter time.Duration
+	}{
+		{"a", 0, true, 0},
+		{"a", 0, true, 0},
+		{"a", 0, false, time.Second},
+		{"b", 0, true, 0}, // every client has its own bucket
+		{"a", 500 * time.Millisecond, false, 500 * time.Millisecond},
+		{"a", time.Second, true, 0},
+	}
+	for i, s := range steps {
+		allowed, retryAfter := l.allow(s.key, now.Add(s.after))
+		if allowed != s.allowed || retryAfter != s.retryAfter {
+			t.Fatalf("step %d: expect %v %v, got %v %v", i, s.allowed, s.retryAfter, allowed, retryAfter)
+		}
+	}
+	if ok, _ := (*rateLimiter)(nil).allow("a", now); !ok {
+		t.Fatal("expect no limiter to allow everything")
+	}
+}
+
+func TestMaxLoads(t *testing.T) {
+	var running, most atomic.Int64
+	g := NewGroup("maxloads", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for m := most.Load(); n > m && !most.CompareAndSwap(m, n); m = most.Load() {
+		}
+		time.Sleep(20 * time.Millisecond)
+		return []byte(key), nil
+	}), WithMaxLoads(2))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := g.Get("key" + strconv.Itoa(i)); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if most.Load() != 2 {
+		t.Fatalf("expect at most 2 loads at once, got %d", most.Load())
+	}
+	if stats := g.Stats(); stats.LocalLoads != 6 || stats.LoadWaits == 0 {
+		t.Fatalf("expect 6 loads with some waiting, got %+v", stats)
+	}
+
+	// a waiting load gives up with its context
+	g.loadSlots <- struct{}{}
+	g.loadSlots <- struct{}{}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := g.getLocally(ctx, "Tom"); err != context.DeadlineExceeded {
+		t.Fatalf("expect deadline exceeded, got %v", err)
+	}
+}
+
+func TestLoadShedder(t *testing.T) {
+	s := newLoadShedder(1, 5*time.Millisecond)
+	release, _, ok := s.admit(context.Background())
+	if !ok {
+		t.Fatal("expect a free slot")
+	}
+	// the slot is never released, queued requests time out until the shedder gives up on the queue
+	deadline := time.Now().Add(time.Second)
+	for !s.isShedding() {
+		if time.Now().After(deadline) {
+			t.Fatal("expect shedding to start")
+		}
+		if _, _, ok := s.admit(context.Background()); ok {
+			t.Fatal("expect no slot")
+		}
+	}
+	start := time.Now()
+	if _, retryAfter, ok := s.admit(context.Background()); ok || retryAfter <= 0 || time.Since(start) > 5*time.Millisecond {
+		t.Fatalf("expect immediate rejection with retry after, got %v %v after %v", ok, retryAfter, time.Since(start))
+	}
+
+	// a drained queue stops the shedding
+	release()
+	if _, _, ok := s.admit(context.Background()); !ok || s.isShedding() {
+		t.Fatal("expect requests to be served again")
+	}
+}
+
+func TestRateLimiterMaxBuckets(t *testing.T) {
+	l := newRateLimiter(1, 2)
+	now := time.Now()
+	for i := 0; i < limiterMaxBuckets+10; i++ {
+		l.allow(strconv.Itoa(i), now)
+	}
+	if len(l.buckets) != limiterMaxBuckets {
+		t.Fatalf("expect %d buckets, got %d", limiterMaxBuckets, len(l.buckets))
+	}
+	// buckets that refilled go first, keys still over their rate keep theirs
+	later := now.Add(2 * time.Second)
+	busy := ""
+	for key := range l.buckets {
+		busy = key
+		break
+	}
+	l.allow(busy, later)
+	l.allow(busy, later)
+	l.allow("new", later)
+	if _, ok := l.buckets[busy]; !ok || len(l.buckets) != 2 {
+		t.Fatalf("expect only the busy and the new bucket left, got %d buckets", len(l.buckets))
+	}
+}
+
+func TestAPIRateLimit(t *testing.T) {
+	g := NewGroup("ratelimit", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		return []byte(db[key]), nil
+	}))
+	server, err := NewAPIServer("", ":0", g, WithClientRateLimit(1, 2), WithGroupRateLimit(1, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := server.httpServer.Handler
+	send := func(client string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/api?group=ratelimit&key=Tom", nil)
+		r.RemoteAddr = client + ":1234"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	steps := []struct {
+		client string
+		code   int
+	}{
+		{"10.0.0.1", http.StatusOK},
+		{"10.0.0.1", http.StatusOK},
+		{"10.0.0.1", http.StatusTooManyRequests}, // over the client burst
+		{"10.0.0.2", http.StatusOK},
+		{"10.0.0.3", http.StatusTooManyRequests}, // over the group burst
+	}
+	for i, s := range steps {
+		w := send(s.client)
+		if w.Code != s.code {
+			t.Fatalf("step %d: expect %d, got %d", i, s.code, w.Code)
+		}
+		if s.code == http.StatusTooManyRequests && w.Header().Get("Retry-After") != "1" {
+			t.Fatalf("step %d: expect Retry-After 1, got %q", i, w.Header().Get("Retry-After"))
+		}
+	}
+	// groups that do not exist take no bucket
+	r := httptest.NewRequest(http.MethodGet, "/api?group=made-up&key=Tom", nil)
+	r.RemoteAddr = "10.0.0.4:1234"
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expect 404 for a made up group, got %d", w.Code)
+	}
+}
+
+func TestAPIRateLimitBeforeAuth(t *testing.T) {
+	g := NewGroup("ratelimit-auth", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		return []byte(db[key]), nil
+	}))
+	auth := NewTokenAuth(map[string]string{"secret": "alice"})
+	server, err := NewAPIServer("", ":0", g, WithAuth(auth, nil), WithClientRateLimit(1, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// guessed tokens use up the burst of the address like any other request
+	for i, code := range []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests} {
+		r := httptest.NewRequest(http.MethodGet, "/api?group=ratelimit-auth&key=Tom", nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+		r.Header.Set("Authorization", "Bearer guess"+strconv.Itoa(i))
+		w := httptest.NewRecorder()
+		server.httpServer.Handler.ServeHTTP(w, r)
+		if w.Code != code {
+			t.Fatalf("guess %d: expect %d, got %d", i, code, w.Code)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package rendezvous
+
+import (
+	"hash/fnv"
+	"math"
+	"sort"
+)
+
+// largest weight of a server, a larger one is treated as MaxWeight
+const MaxWeight = 100
+
+// Map picks the server of a key with rendezvous (highest random weight) hashing:
+// every server gets a score for the key and the highest score wins,
+// so adding or removing a server only moves the keys that server wins or won
+type Map struct{
+	servers []server
+}
+
+type server struct{
+	name string
+	weight float64
+}
+
+// constructor of rendezvous hashing
+func New()*Map{
+	return &Map{}
+}
+
+// add servers with weight 1
+func (m *Map)Add(names ...string){
+	for _,name := range names{
+		m.AddWeighted(name,1)
+	}
+}
+
+// add a server that wins about weight times as many keys as a server with weight 1
+// weight < 1 is treated as 1 and weight > MaxWeight as MaxWeight, adding a server again updates its weight
+func (m *Map)AddWeighted(name string,weight int){
+	if weight < 1{
+		weight = 1
+	}else if weight > MaxWeight{
+		weight = MaxWeight
+	}
+	for i := range m.servers{
+		if m.servers[i].name == name{
+			m.servers[i].weight = float64(weight)
+			return
+		}
+	}
+	m.servers = append(m.servers, server{name: name,weight: float64(weight)})
+}
+
+// remove a server, only the keys it won move to other servers
+func (m *Map)Remove(name string){
+	for i := range m.servers{
+		if m.servers[i].name == name{
+			m.servers = append(m.servers[:i],m.servers[i+1:]...)
+			return
+		}
+	}
+}
+
+// given a key, return the server with the highest score
+func (m *Map)Get(key string)string{
+	best := ""
+	bestScore := math.Inf(-1)
+	for _,s := range m.servers{
+		if score := s.score(key);score > bestScore{
+			best,bestScore = s.name,score
+		}
+	}
+	return best
+}
+
+// weighted score -weight/ln(h) where h is the hash of server and key mapped into (0,1)
+// see "Weighted distributed hash tables" (Schindelhauer, Schomaker)
+func (s server)score(key string)float64{
+	h := fnv.New64a()
+	h.Write([]byte(s.name))
+	h.Write([]byte{0})
+	h.Write([]byte(key))
+	// use the top 53 bits, which a float64 holds exactly, and keep clear of 0 and 1
+	u := (float64(mix(h.Sum64())>>11)+0.5)/(1<<53)
+	return -s.weight/math.Log(u)
+}
+
+// finalizer of splitmix64, spreads the bits of fnv which are weak for similar inputs
+func mix(x uint64)uint64{
+	x ^= x>>30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x>>27
+	x *= 0x94d049bb133111eb
+	x ^= x>>31
+	return x
+}
+
+// return up to n servers for key ordered by score, the first one is the server Get returns
+func (m *Map)GetN(key string,n int)[]string{
+	if n <= 0{
+		return nil
+	}
+	type scored struct{
+		name string
+		score float64
+	}
+	all := make([]scored,len(m.servers))
+	for i,s := range m.servers{
+		all[i] = scored{s.name,s.score(key)}
+	}
+	sort.Slice(all,func(i,j int)bool{
+		return all[i].score > all[j].score
+	})
+	if n > len(all){
+		n = len(all)
+	}
+	names := make([]string,n)
+	for i := range names{
+		names[i] = all[i].name
+	}
+	return names
+}
@@ -0,0 +1,42 @@
+package rendezvous
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestGet(t *testing.T) {
+	m := New()
+	if m.Get("key") != "" {
+		t.Fatal("empty map should return no server")
+	}
+	m.Add("a", "b", "c")
+
+	owners := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		key := "key" + strconv.Itoa(i)
+		owners[key] = m.Get(key)
+	}
+
+	// removing a server only moves the keys it owned
+	m.Remove("b")
+	for key, owner := range owners {
+		if got := m.Get(key); owner != "b" && got != owner {
+			t.Fatalf("key %s moved from %s to %s", key, owner, got)
+		}
+	}
+}
+
+func TestAddWeighted(t *testing.T) {
+	m := New()
+	m.AddWeighted("small", 1)
+	m.AddWeighted("large", 3)
+	counts := make(map[string]int)
+	total := 40000
+	for i := 0; i < total; i++ {
+		counts[m.Get("key"+strconv.Itoa(i))]++
+	}
+	if got := float64(counts["large"]) / float64(total); got < 0.7 || got > 0.8 {
+		t.Fatalf("large server should own about 3/4 of the keys, got %.2f", got)
+	}
+}
@@ -0,0 +1,427 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// RESPServer is a tcp front end that speaks a subset of the redis protocol (RESP2)
+// every connection works on one group at a time, SELECT switches between groups
+type RESPServer struct{
+	defaultGroup string // group selected when a connection is opened
+	mu sync.Mutex // lock for listener and connections
+	listener net.Listener
+	conns map[net.Conn]struct{} // open client connections
+	closed bool
+}
+
+// max number of arguments and max size of a bulk string we accept from a client
+// memory for them grows as they are read, so a header alone can not make us allocate much
+const (
+	respMaxArgs = 64<<10
+	respMaxBulk = 512<<20
+	respPrealloc = 16 // arguments allocated up front
+)
+
+var errRESPClosed = errors.New("resp server closed")
+
+// constructor of RESPServer, defaultGroup is the group a new connection starts with
+func NewRESPServer(defaultGroup string)*RESPServer{
+	return &RESPServer{
+		defaultGroup: defaultGroup,
+		conns: make(map[net.Conn]struct{}),
+	}
+}
+
+// listen on addr and serve redis clients until Close is called, a closed server returns nil
+func (s *RESPServer)ListenAndServe(addr string)error{
+	l,err := net.Listen("tcp",addr)
+	if err != nil{
+		return err
+	}
+	return s.Serve(l)
+}
+
+// accept connections on l, each connection is handled in its own goroutine
+func (s *RESPServer)Serve(l net.Listener)error{
+	s.mu.Lock()
+	if s.closed{
+		s.mu.Unlock()
+		l.Close()
+		return errRESPClosed
+	}
+	s.listener = l
+	s.mu.Unlock()
+
+	for{
+		conn,err := l.Accept()
+		if err != nil{
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			// closed on purpose, not an error
+			if closed{
+				return nil
+			}
+			return err
+		}
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		go s.serveConn(conn)
+	}
+}
+
+// stop listening and close all client connections
+func (s *RESPServer)Close()error{
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	var err error
+	if s.listener != nil{
+		err = s.listener.Close()
+	}
+	for conn := range s.conns{
+		conn.Close()
+	}
+	return err
+}
+
+// per connection state
+type respConn struct{
+	r *bufio.Reader
+	w *bufio.Writer
+	group *Group // currently selected group, nil if it does not exist
+}
+
+// read commands from one client until it quits or the connection breaks
+func (s *RESPServer)serveConn(conn net.Conn){
+	defer func(){
+		s.mu.Lock()
+		delete(s.conns,conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+	c := &respConn{
+		r: bufio.NewReader(conn),
+		w: bufio.NewWriter(conn),
+		group: GetGroup(s.defaultGroup),
+	}
+	for{
+		args,err := readRESPCommand(c.r)
+		if err != nil{
+			if err != io.EOF{
+				// protocol error, tell the client before hanging up
+				c.writeError("ERR Protocol error: "+err.Error())
+				c.w.Flush()
+			}
+			return
+		}
+		if len(args) == 0{
+			continue
+		}
+		quit := c.dispatch(args)
+		// only flush when client is not pipelining more commands
+		if c.r.Buffered() == 0 || quit{
+			if err := c.w.Flush();err != nil{
+				return
+			}
+		}
+		if quit{
+			return
+		}
+	}
+}
+
+// read one command, either a RESP array of bulk strings or an inline command
+func readRESPCommand(r *bufio.Reader)([]string,error){
+	line,err := readRESPLine(r)
+	if err != nil{
+		return nil,err
+	}
+	if len(line) == 0{
+		return nil,nil
+	}
+	if line[0] != '*'{
+		// inline command, used by telnet
+		return strings.Fields(line),nil
+	}
+	n,err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 || n > respMaxArgs{
+		return nil,fmt.Errorf("invalid multibulk length")
+	}
+	// an empty array is skipped like an empty line
+	args := make([]string,0,respPrealloc)
+	for i := 0;i < n;i++{
+		line,err := readRESPLine(r)
+		if err != nil{
+			return nil,err
+		}
+		if len(line) == 0 || line[0] != '$'{
+			return nil,fmt.Errorf("expected '$', got '%s'",line)
+		}
+		size,err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > respMaxBulk{
+			return nil,fmt.Errorf("invalid bulk length")
+		}
+		// bulk string followed by \r\n
+		var buf bytes.Buffer
+		if _,err := io.CopyN(&buf,r,int64(size)+2);err != nil{
+			if err == io.EOF{
+				err = io.ErrUnexpectedEOF
+			}
+			return nil,err
+		}
+		args = append(args, string(buf.Bytes()[:size]))
+	}
+	return args,nil
+}
+
+// read a line terminated by \r\n (or \n) without the terminator
+func readRESPLine(r *bufio.Reader)(string,error){
+	line,err := r.ReadString('\n')
+	if err != nil{
+		if err == io.EOF && len(line) > 0{
+			return "",io.ErrUnexpectedEOF
+		}
+		return "",err
+	}
+	return strings.TrimRight(line,"\r\n"),nil
+}
+
+// execute one command, return true if the connection should be closed
+func (c *respConn)dispatch(args []string)bool{
+	cmd := strings.ToUpper(args[0])
+	args = args[1:]
+	switch cmd{
+	case "PING":
+		c.ping(args)
+	case "ECHO":
+		if len(args) != 1{
+			c.wrongArgs(cmd)
+			break
+		}
+		c.writeBulk([]byte(args[0]))
+	case "SELECT":
+		c.selectGroup(args)
+	case "GET":
+		c.get(args)
+	case "MGET":
+		c.mget(args)
+	case "SET":
+		c.set(args)
+	case "DEL":
+		c.del(args)
+	case "EXISTS":
+		c.exists(args)
+	case "INFO":
+		c.info()
+	case "COMMAND":
+		// redis-cli asks for command docs on start up, we have none to offer
+		c.writeArrayHeader(0)
+	case "QUIT":
+		c.writeStatus("OK")
+		return true
+	default:
+		c.writeError(fmt.Sprintf("ERR unknown command '%s'",strings.ToLower(cmd)))
+	}
+	return false
+}
+
+func (c *respConn)ping(args []string){
+	switch len(args){
+	case 0:
+		c.writeStatus("PONG")
+	case 1:
+		c.writeBulk([]byte(args[0]))
+	default:
+		c.wrongArgs("PING")
+	}
+}
+
+// SELECT takes a group name, or a database index into the sorted group names
+func (c *respConn)selectGroup(args []string){
+	if len(args) != 1{
+		c.wrongArgs("SELECT")
+		return
+	}
+	if g := GetGroup(args[0]);g != nil{
+		c.group = g
+		c.writeStatus("OK")
+		return
+	}
+	if idx,err := strconv.Atoi(args[0]);err == nil{
+		names := GroupNames()
+		if idx >= 0 && idx < len(names){
+			c.group = GetGroup(names[idx])
+			c.writeStatus("OK")
+			return
+		}
+		c.writeError("ERR DB index is out of range")
+		return
+	}
+	c.writeError("ERR no such group")
+}
+
+// return false and reply with an error if no group is selected
+func (c *respConn)checkGroup()bool{
+	if c.group == nil{
+		c.writeError("ERR no group selected")
+		return false
+	}
+	return true
+}
+
+func (c *respConn)get(args []string){
+	if len(args) != 1{
+		c.wrongArgs("GET")
+		return
+	}
+	if !c.checkGroup(){
+		return
+	}
+	view,err := c.group.Get(args[0])
+	if err != nil{
+		c.writeLoadError(err)
+		return
+	}
+	c.writeBulk(view.b)
+}
+
+func (c *respConn)mget(args []string){
+	if len(args) == 0{
+		c.wrongArgs("MGET")
+		return
+	}
+	if !c.checkGroup(){
+		return
+	}
+	c.writeArrayHeader(len(args))
+	for _,key := range args{
+		// MGET never fails, missing keys or failed loads become nil
+		view,err := c.group.Get(key)
+		if err != nil{
+			c.writeNil()
+			continue
+		}
+		c.writeBulk(view.b)
+	}
+}
+
+func (c *respConn)set(args []string){
+	if len(args) != 2{
+		c.writeError("ERR syntax error")
+		return
+	}
+	if !c.checkGroup(){
+		return
+	}
+	if err := c.group.Set(args[0],[]byte(args[1]));err != nil{
+		c.writeError("ERR "+err.Error())
+		return
+	}
+	c.writeStatus("OK")
+}
+
+func (c *respConn)del(args []string){
+	if len(args) == 0{
+		c.wrongArgs("DEL")
+		return
+	}
+	if !c.checkGroup(){
+		return
+	}
+	removed := 0
+	for _,key := range args{
+		if c.group.Delete(key){
+			removed++
+		}
+	}
+	c.writeInt(int64(removed))
+}
+
+// a key exists if the group can serve it, this may load it from a peer or the database
+func (c *respConn)exists(args []string){
+	if len(args) == 0{
+		c.wrongArgs("EXISTS")
+		return
+	}
+	if !c.checkGroup(){
+		return
+	}
+	count := 0
+	for _,key := range args{
+		if _,err := c.group.Get(key);err == nil{
+			count++
+		}
+	}
+	c.writeInt(int64(count))
+}
+
+// INFO lists every group with its counters, one line per group
+func (c *respConn)info(){
+	var b strings.Builder
+	b.WriteString("# Server\r\n")
+	b.WriteString("gocache_mode:cluster\r\n")
+	b.WriteString("\r\n# Groups\r\n")
+	for i,name := range GroupNames(){
+		g := GetGroup(name)
+		if g == nil{
+			continue
+		}
+		st := g.Stats()
+		fmt.Fprintf(&b,"db%d:name=%s,keys=%d,bytes=%d,gets=%d,hits=%d,peer_loads=%d,local_loads=%d\r\n",
+			i,name,st.Items,st.Bytes,st.Gets,st.CacheHits,st.PeerLoads,st.LocalLoads)
+	}
+	c.writeBulk([]byte(b.String()))
+}
+
+// missing keys become nil like in redis, every other error is passed to the client
+func (c *respConn)writeLoadError(err error){
+	if errors.Is(err,ErrNotFound){
+		c.writeNil()
+		return
+	}
+	log.Println("[RESP] load failed:",err)
+	c.writeError("ERR "+err.Error())
+}
+
+func (c *respConn)wrongArgs(cmd string){
+	c.writeError(fmt.Sprintf("ERR wrong number of arguments for '%s' command",strings.ToLower(cmd)))
+}
+
+func (c *respConn)writeStatus(s string){
+	c.w.WriteString("+"+s+"\r\n")
+}
+
+func (c *respConn)writeError(s string){
+	// error strings must not contain new lines
+	s = strings.NewReplacer("\r"," ","\n"," ").Replace(s)
+	c.w.WriteString("-"+s+"\r\n")
+}
+
+func (c *respConn)writeInt(n int64){
+	c.w.WriteString(":"+strconv.FormatInt(n,10)+"\r\n")
+}
+
+func (c *respConn)writeBulk(b []byte){
+	c.w.WriteString("$"+strconv.Itoa(len(b))+"\r\n")
+	c.w.Write(b)
+	c.w.WriteString("\r\n")
+}
+
+func (c *respConn)writeNil(){
+	c.w.WriteString("$-1\r\n")
+}
+
+func (c *respConn)writeArrayHeader(n int){
+	c.w.WriteString("*"+strconv.Itoa(n)+"\r\n")
+}
@@ -0,0 +1,139 @@
+package cache
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// start a RESP server on a random port and return a connected client
+func newRESPClient(t *testing.T, group string) (net.Conn, *bufio.Reader) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewRESPServer(group)
+	go server.Serve(l)
+	t.Cleanup(func() { server.Close() })
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, bufio.NewReader(conn)
+}
+
+// send a command as RESP array and read back one reply line (plus bulk body if any)
+func respDo(t *testing.T, conn net.Conn, r *bufio.Reader, args ...string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := conn.Write([]byte(b.String())); err != nil {
+		t.Fatal(err)
+	}
+	return respRead(t, r)
+}
+
+func respRead(t *testing.T, r *bufio.Reader) string {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	line = strings.TrimRight(line, "\r\n")
+	switch line[0] {
+	case '$':
+		if line == "$-1" {
+			return "(nil)"
+		}
+		var n int
+		fmt.Sscanf(line[1:], "%d", &n)
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	case '*':
+		var n int
+		fmt.Sscanf(line[1:], "%d", &n)
+		parts := make([]string, n)
+		for i := range parts {
+			parts[i] = respRead(t, r)
+		}
+		return "[" + strings.Join(parts, ",") + "]"
+	}
+	return line
+}
+
+func TestRESPCommands(t *testing.T) {
+	NewGroup("resp", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		if v, ok := db[key]; ok {
+			return []byte(v), nil
+		}
+		return nil, fmt.Errorf("%s: %w", key, ErrNotFound)
+	}))
+	NewGroup("resp-other", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		return nil, fmt.Errorf("%s: %w", key, ErrNotFound)
+	}))
+	conn, r := newRESPClient(t, "resp")
+
+	cases := []struct {
+		args   []string
+		expect string
+	}{
+		{[]string{"PING"}, "+PONG"},
+		{[]string{"GET", "Tom"}, "630"},
+		{[]string{"GET", "unknown"}, "(nil)"},
+		{[]string{"SET", "k", "v"}, "+OK"},
+		{[]string{"MGET", "Tom", "k", "unknown"}, "[630,v,(nil)]"},
+		{[]string{"EXISTS", "Tom", "unknown", "k"}, ":2"},
+		{[]string{"DEL", "k", "k2"}, ":1"},
+		{[]string{"SELECT", "resp-other"}, "+OK"},
+		{[]string{"GET", "Tom"}, "(nil)"},
+		{[]string{"SELECT", "no-such-group"}, "-ERR no such group"},
+		{[]string{"NOPE"}, "-ERR unknown command 'nope'"},
+	}
+	for _, c := range cases {
+		if got := respDo(t, conn, r, c.args...); got != c.expect {
+			t.Fatalf("%v: expect %q, got %q", c.args, c.expect, got)
+		}
+	}
+}
+
+func TestRESPInline(t *testing.T) {
+	conn, r := newRESPClient(t, "")
+	conn.Write([]byte("PING\r\n"))
+	if got := respRead(t, r); got != "+PONG" {
+		t.Fatalf("expect +PONG, got %q", got)
+	}
+	conn.Write([]byte("GET Tom\r\n"))
+	if got := respRead(t, r); got != "-ERR no group selected" {
+		t.Fatalf("expect no group error, got %q", got)
+	}
+}
+
+func TestRESPBadLength(t *testing.T) {
+	conn, r := newRESPClient(t, "")
+	// an empty array is skipped
+	conn.Write([]byte("*0\r\n"))
+	if got := respDo(t, conn, r, "PING"); got != "+PONG" {
+		t.Fatalf("expect +PONG after an empty array, got %q", got)
+	}
+	// a negative length is refused
+	conn.Write([]byte("*-1\r\n"))
+	if got := respRead(t, r); got != "-ERR Protocol error: invalid multibulk length" {
+		t.Fatalf("expect a protocol error, got %q", got)
+	}
+	// a huge bulk is read as it arrives, not allocated up front
+	conn, r = newRESPClient(t, "")
+	conn.Write([]byte("*2\r\n$3\r\nGET\r\n$536870912\r\nTom\r\n"))
+	conn.(*net.TCPConn).CloseWrite()
+	if got := respRead(t, r); got != "-ERR Protocol error: unexpected EOF" {
+		t.Fatalf("expect a protocol error, got %q", got)
+	}
+}
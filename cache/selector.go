@@ -0,0 +1,44 @@
+package cache
+
+import (
+	"cache/consistenthash"
+	"cache/jumphash"
+	"cache/rendezvous"
+	"fmt"
+)
+
+// number of virtual nodes of a peer with weight 1 on the hash ring
+const defaultReplicas = 5
+
+var _ boundedSelector = (*consistenthash.Map)(nil)
+var _ PeerSelector = (*rendezvous.Map)(nil)
+var _ PeerSelector = (*jumphash.Map)(nil)
+
+// hash ring with virtual nodes, the default selector, supports bounded loads
+func NewRingSelector()PeerSelector{
+	return consistenthash.New(defaultReplicas,nil)
+}
+
+// rendezvous (highest random weight) hashing, no virtual nodes and an even spread, lookups cost O(peers)
+func NewRendezvousSelector()PeerSelector{
+	return rendezvous.New()
+}
+
+// jump consistent hashing, lookups are fast and need no memory
+// peers are numbered in the order they are set, so every node has to set them in the same order, like the order of the config
+func NewJumpSelector()PeerSelector{
+	return jumphash.New()
+}
+
+// look up a selector constructor by name: "ring" (or ""), "rendezvous" or "jump"
+func SelectorByName(name string)(func()PeerSelector,error){
+	switch name{
+	case "","ring":
+		return NewRingSelector,nil
+	case "rendezvous":
+		return NewRendezvousSelector,nil
+	case "jump":
+		return NewJumpSelector,nil
+	}
+	return nil,fmt.Errorf("unknown peer selector %q",name)
+}
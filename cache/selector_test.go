@@ -0,0 +1,139 @@
+package cache
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+)
+
+var selectors = []struct {
+	name string
+	new  func() PeerSelector
+}{
+	{"ring", NewRingSelector},
+	{"rendezvous", NewRendezvousSelector},
+	{"jump", NewJumpSelector},
+}
+
+// build a selector with peers node0..node{n-1}
+func newTestSelector(newSelector func() PeerSelector, n int) PeerSelector {
+	s := newSelector()
+	for i := 0; i < n; i++ {
+		// jump numbers peers by name, so new peers have names that sort last, TestSelectorUnsortedNames covers the others
+		s.AddWeighted(fmt.Sprintf("node%03d", i), 1)
+	}
+	return s
+}
+
+// share of keys that change owner when one peer is appended to n peers
+func movedKeys(newSelector func() PeerSelector, n int, keys int) float64 {
+	before := newTestSelector(newSelector, n)
+	after := newTestSelector(newSelector, n+1)
+	moved := 0
+	for i := 0; i < keys; i++ {
+		key := "key" + strconv.Itoa(i)
+		if before.Get(key) != after.Get(key) {
+			moved++
+		}
+	}
+	return float64(moved) / float64(keys)
+}
+
+func TestSelectorKeyMovement(t *testing.T) {
+	n := 10
+	// the ideal is 1/(n+1) of the keys, the ring with few virtual nodes is noisier than the others
+	for _, s := range selectors {
+		moved := movedKeys(s.new, n, 20000)
+		t.Logf("%s: %.1f%% of keys moved when adding peer %d", s.name, moved*100, n+1)
+		if moved > 2.0/float64(n+1) {
+			t.Errorf("%s moved %.1f%% of keys, expect about %.1f%%", s.name, moved*100, 100.0/float64(n+1))
+		}
+	}
+}
+
+// addresses do not sort in the order peers are added, 10.0.0.10 sorts before 10.0.0.9
+func TestSelectorUnsortedNames(t *testing.T) {
+	n := 9
+	for _, s := range selectors {
+		before, after := s.new(), s.new()
+		for i := 1; i <= n; i++ {
+			before.AddWeighted(fmt.Sprintf("http://10.0.0.%d", i), 1)
+			after.AddWeighted(fmt.Sprintf("http://10.0.0.%d", i), 1)
+		}
+		after.AddWeighted(fmt.Sprintf("http://10.0.0.%d", n+1), 1)
+		moved := 0
+		for i := 0; i < 20000; i++ {
+			key := "key" + strconv.Itoa(i)
+			if before.Get(key) != after.Get(key) {
+				moved++
+			}
+		}
+		share := float64(moved) / 20000
+		t.Logf("%s: %.1f%% of keys moved when adding a peer whose name does not sort last", s.name, share*100)
+		// every selector numbers or places peers in the order they joined, so about 1/(n+1) of the keys move
+		if share > 1.5/float64(n+1) {
+			t.Errorf("%s moved %.1f%% of keys, expect about %.1f%%", s.name, share*100, 100.0/float64(n+1))
+		}
+	}
+}
+
+func TestSelectorGetN(t *testing.T) {
+	for _, s := range selectors {
+		sel := newTestSelector(s.new, 5)
+		for i := 0; i < 1000; i++ {
+			key := "key" + strconv.Itoa(i)
+			replicas := sel.GetN(key, 3)
+			if len(replicas) != 3 || replicas[0] != sel.Get(key) {
+				t.Fatalf("%s: replicas of %s should start with its owner %s, got %v", s.name, key, sel.Get(key), replicas)
+			}
+			if replicas[0] == replicas[1] || replicas[1] == replicas[2] || replicas[0] == replicas[2] {
+				t.Fatalf("%s: expect distinct replicas, got %v", s.name, replicas)
+			}
+		}
+		if n := len(sel.GetN("key", 10)); n != 5 {
+			t.Fatalf("%s: expect every peer once when asking for more than there are, got %d", s.name, n)
+		}
+	}
+}
+
+func TestSelectorByName(t *testing.T) {
+	for _, s := range selectors {
+		if _, err := SelectorByName(s.name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := SelectorByName("random"); err == nil {
+		t.Fatal("expect unknown selector to be rejected")
+	}
+}
+
+func BenchmarkSelectorGet(b *testing.B) {
+	for _, s := range selectors {
+		for _, n := range []int{3, 10, 100} {
+			b.Run(fmt.Sprintf("%s/peers=%d", s.name, n), func(b *testing.B) {
+				sel := newTestSelector(s.new, n)
+				keys := make([]string, 1024)
+				for i := range keys {
+					keys[i] = "key" + strconv.Itoa(i)
+				}
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					sel.Get(keys[i%len(keys)])
+				}
+			})
+		}
+	}
+}
+
+// reports the share of keys moved when a peer joins, next to the cost of building the selector
+func BenchmarkSelectorMembershipChange(b *testing.B) {
+	for _, s := range selectors {
+		b.Run(s.name, func(b *testing.B) {
+			var moved float64
+			for i := 0; i < b.N; i++ {
+				moved = movedKeys(s.new, 10, 1000)
+			}
+			b.ReportMetric(moved*100, "%moved")
+		})
+	}
+}
@@ -11,6 +11,8 @@ type call struct{
 type Group struct{
 	mu sync.Mutex
 	m map[string]*call
+	inflight int // number of ongoing calls, used to drain on shutdown
+	idle *sync.Cond // signaled when inflight drops to 0
 }
 
 func (g *Group)Do(key string, fn func()(interface{},error))(interface{},error){
@@ -33,6 +35,7 @@ func (g *Group)Do(key string, fn func()(interface{},error))(interface{},error){
 	c := new(call)
 	// locked befre it was called
 	c.wg.Add(1)
+	g.inflight++
 	// add it into map
 	g.m[key] = c
 	g.mu.Unlock()
@@ -46,7 +49,23 @@ func (g *Group)Do(key string, fn func()(interface{},error))(interface{},error){
 	//update g.map
 	g.mu.Lock()
 	delete(g.m,key)
+	g.inflight--
+	if g.inflight == 0 && g.idle != nil{
+		g.idle.Broadcast()
+	}
 	g.mu.Unlock()
 	//return value
 	return c.val,c.err
-}
\ No newline at end of file
+}
+
+// block until every ongoing call has returned
+func (g *Group)Wait(){
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.idle == nil{
+		g.idle = sync.NewCond(&g.mu)
+	}
+	for g.inflight > 0{
+		g.idle.Wait()
+	}
+}
@@ -0,0 +1,421 @@
+package slab
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// every entry starts with a header: expire time in unix nanoseconds (0 never expires), key length, value length, tag, flags
+// and the unix nanoseconds it was last added or read at
+const headerSize = 26
+
+const (
+	flagDeleted = 1 << iota // the entry was removed or replaced, its bytes are reclaimed when it is at the head
+	flagAccessed // the entry was read since it was written or last moved
+)
+
+// entries that were read are moved to the tail instead of evicted, but never more than this many per add
+const maxMoves = 5
+
+// Cache keeps entries in one preallocated byte slab used as a ring buffer, indexed by the hash of their key
+// the slab and the index hold no pointers, so the garbage collector does not scan them however many entries there are
+// new entries are appended at the tail and the oldest ones are evicted at the head,
+// entries read since they were written get a second chance at the tail, which keeps hot entries like a lru would
+type Cache struct{
+	ring []byte
+	head int64 // offset of the oldest entry, removed entries at the head are reclaimed right away so it is always a live one
+	tail int64 // offset the next entry is written at
+	used int64 // bytes of the ring taken by entries, removed ones included until they are reclaimed
+	nBytes int64 // key and value bytes of cached entries
+	overhead int64 // bytes counted per entry on top of its key and value
+	index map[uint64]int64 // hash of key to offset of its entry
+	scratch []byte // buffer for moving entries
+	onRemoved func(key string,value []byte,tag uint8,reason Reason)
+}
+
+// why an entry left the cache
+type Reason int
+
+const (
+	Capacity Reason = iota // evicted to make room, or replaced by a key with the same hash
+	Expired // found expired
+	Removed // removed with Remove
+	replaced // replaced by a new value of its key, not reported
+)
+
+// decoded entry header
+type header struct{
+	expire int64
+	keyLen int64
+	valueLen int64
+	tag uint8
+	flags uint8
+	used int64
+}
+
+func(h *header)size()int64{
+	return headerSize + h.keyLen + h.valueLen
+}
+
+func(h *header)expired(now int64)bool{
+	return h.expire != 0 && now > h.expire
+}
+
+// constructor, the whole slab of maxBytes is allocated right away
+// entry headers and replaced entries take room in the slab too, so fewer bytes of keys and values fit than maxBytes
+func New(maxBytes int64)*Cache{
+	if maxBytes <= 0{
+		panic("slab: maxBytes must be positive")
+	}
+	return &Cache{
+		ring: make([]byte,maxBytes),
+		index: make(map[uint64]int64),
+	}
+}
+
+// get a copy of the value and the tag of key, the slab is reused so values can not be handed out in place
+func(c *Cache)Get(key string)(value []byte,tag uint8,ok bool){
+	h,off,hd,ok := c.find(key)
+	if !ok{
+		return nil,0,false
+	}
+	now := time.Now().UnixNano()
+	// expired entries are removed lazily when they are read
+	if hd.expired(now){
+		c.kill(h,off,&hd,Expired)
+		return nil,0,false
+	}
+	if hd.flags&flagAccessed == 0{
+		c.setFlags(off,hd.flags|flagAccessed)
+	}
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:],uint64(now))
+	c.write(c.wrap(off+18),buf[:])
+	value = make([]byte,hd.valueLen)
+	c.read(c.wrap(off+headerSize+hd.keyLen),value)
+	return value,hd.tag,true
+}
+
+// check if key is cached without marking it as read
+func(c *Cache)Contains(key string)bool{
+	_,_,hd,ok := c.find(key)
+	return ok && !hd.expired(time.Now().UnixNano())
+}
+
+// add new kv into cache
+func(c *Cache)Add(key string,value []byte,tag uint8){
+	c.AddWithExpire(key,value,tag,time.Time{})
+}
+
+// add new kv into cache which expires at given time, zero time means never expire
+// tag is kept with the value for the caller, like how the value is encoded
+func(c *Cache)AddWithExpire(key string,value []byte,tag uint8,expire time.Time){
+	h := hashString(key)
+	// the old entry is replaced, so is an entry of another key with the same hash
+	if _,off,hd,ok := c.find(key);ok{
+		c.kill(h,off,&hd,replaced)
+	}else if off,ok := c.index[h];ok{
+		hd := c.header(off)
+		c.kill(h,off,&hd,Capacity)
+	}
+	hd := header{keyLen: int64(len(key)),valueLen: int64(len(value)),tag: tag,used: time.Now().UnixNano()}
+	if !expire.IsZero(){
+		hd.expire = expire.UnixNano()
+	}
+	size := hd.size()
+	// an entry larger than the slab is never cached, like a lru evicts it right away
+	if size > int64(len(c.ring)){
+		return
+	}
+	c.makeRoom(size)
+	var buf [headerSize]byte
+	hd.encode(buf[:])
+	off := c.tail
+	c.write(off,buf[:])
+	c.writeString(c.wrap(off+headerSize),key)
+	c.write(c.wrap(off+headerSize+hd.keyLen),value)
+	c.index[h] = off
+	c.tail = c.wrap(off+size)
+	c.used += size
+	c.nBytes += hd.keyLen+hd.valueLen
+}
+
+// remove the entry with given key, return true if it existed
+func(c *Cache)Remove(key string)bool{
+	h,off,hd,ok := c.find(key)
+	if !ok{
+		return false
+	}
+	c.kill(h,off,&hd,Removed)
+	return true
+}
+
+// change expire time of an existing entry, return false if key is not cached
+func(c *Cache)SetExpire(key string,expire time.Time)bool{
+	h,off,hd,ok := c.find(key)
+	if !ok{
+		return false
+	}
+	if hd.expired(time.Now().UnixNano()){
+		c.kill(h,off,&hd,Expired)
+		return false
+	}
+	hd.expire = 0
+	if !expire.IsZero(){
+		hd.expire = expire.UnixNano()
+	}
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:],uint64(hd.expire))
+	c.write(off,buf[:])
+	return true
+}
+
+// get a copy of the value, the tag and expire time of key without marking it as read
+func(c *Cache)Peek(key string)(value []byte,tag uint8,expire time.Time,ok bool){
+	_,off,hd,ok := c.find(key)
+	if !ok || hd.expired(time.Now().UnixNano()){
+		return nil,0,time.Time{},false
+	}
+	value = make([]byte,hd.valueLen)
+	c.read(c.wrap(off+headerSize+hd.keyLen),value)
+	if hd.expire != 0{
+		expire = time.Unix(0,hd.expire)
+	}
+	return value,hd.tag,expire,true
+}
+
+// keys of all entries, most recently added first
+func(c *Cache)Keys()[]string{
+	keys := make([]string,0,len(c.index))
+	for off,walked := c.head,int64(0);walked < c.used;{
+		hd := c.header(off)
+		if hd.flags&flagDeleted == 0{
+			key := make([]byte,hd.keyLen)
+			c.read(c.wrap(off+headerSize),key)
+			keys = append(keys, string(key))
+		}
+		walked += hd.size()
+		off = c.wrap(off+hd.size())
+	}
+	for i,j := 0,len(keys)-1;i < j;i,j = i+1,j-1{
+		keys[i],keys[j] = keys[j],keys[i]
+	}
+	return keys
+}
+
+// number of entries in cache
+func(c *Cache)Len()int{
+	return len(c.index)
+}
+
+// key and value bytes of the entries plus the overhead of each, removed entries not reclaimed yet are not counted
+func(c *Cache)Bytes()int64{
+	return c.nBytes + c.overhead*int64(len(c.index))
+}
+
+// count every entry with bytes on top of its key and value, like its header and index slot
+// it only changes what Bytes reports, the room in the slab is what it is
+func(c *Cache)SetOverhead(bytes int64){
+	c.overhead = bytes
+}
+
+// last time the entry that is evicted next was added or read, false if the cache is empty
+// an entry read since it was written is moved instead, so this is only a hint of how cold the cache is
+func(c *Cache)OldestUse()(time.Time,bool){
+	if c.used == 0{
+		return time.Time{},false
+	}
+	return time.Unix(0,c.header(c.head).used),true
+}
+
+// evict the oldest entry
+func(c *Cache)RemoveOldest(){
+	if c.used == 0{
+		return
+	}
+	off := c.head
+	hd := c.header(off)
+	c.kill(c.hashAt(c.wrap(off+headerSize),hd.keyLen),off,&hd,evictReason(&hd,time.Now().UnixNano()))
+}
+
+// size of the slab in bytes
+func(c *Cache)Cap()int64{
+	return int64(len(c.ring))
+}
+
+// reclaim entries at the head until size bytes are free at the tail
+func(c *Cache)makeRoom(size int64){
+	now := time.Now().UnixNano()
+	moves := 0
+	for int64(len(c.ring))-c.used < size{
+		off := c.head
+		hd := c.header(off)
+		h := c.hashAt(c.wrap(off+headerSize),hd.keyLen)
+		if hd.flags&flagAccessed != 0 && !hd.expired(now) && moves < maxMoves{
+			c.move(h,off,&hd)
+			moves++
+			continue
+		}
+		// killing the head reclaims it
+		c.kill(h,off,&hd,evictReason(&hd,now))
+	}
+}
+
+// give the room of removed entries at the head back, so the head is a live entry or the cache is empty
+// every entry is reclaimed once, so this is O(1) per removed entry
+func(c *Cache)reclaim(){
+	for c.used > 0{
+		hd := c.header(c.head)
+		if hd.flags&flagDeleted == 0{
+			return
+		}
+		c.head = c.wrap(c.head+hd.size())
+		c.used -= hd.size()
+	}
+}
+
+// move the entry at the head to the tail, it counts as not read again
+func(c *Cache)move(h uint64,off int64,hd *header){
+	size := hd.size()
+	if int64(cap(c.scratch)) < size{
+		c.scratch = make([]byte,size)
+	}
+	entry := c.scratch[:size]
+	c.read(off,entry)
+	entry[17] = hd.flags&^flagAccessed
+	c.head = c.wrap(off+size)
+	c.write(c.tail,entry)
+	c.index[h] = c.tail
+	c.tail = c.wrap(c.tail+size)
+	c.reclaim()
+}
+
+// look up the entry of key, the index only holds hashes so the key of the entry is compared too
+func(c *Cache)find(key string)(h uint64,off int64,hd header,ok bool){
+	h = hashString(key)
+	off,ok = c.index[h]
+	if !ok{
+		return
+	}
+	hd = c.header(off)
+	if hd.keyLen != int64(len(key)) || !c.equalAt(c.wrap(off+headerSize),key){
+		return h,off,hd,false
+	}
+	return h,off,hd,true
+}
+
+// call fn with a copy of every entry that leaves the cache and why, entries replaced by a new value of their key are not reported
+func(c *Cache)SetOnRemoved(fn func(key string,value []byte,tag uint8,reason Reason)){
+	c.onRemoved = fn
+}
+
+// reason an entry at the head is evicted for
+func evictReason(hd *header,now int64)Reason{
+	if hd.expired(now){
+		return Expired
+	}
+	return Capacity
+}
+
+// unindex an entry and mark it deleted, its bytes stay in the slab until it is at the head
+func(c *Cache)kill(h uint64,off int64,hd *header,reason Reason){
+	if c.onRemoved != nil && reason != replaced{
+		key := make([]byte,hd.keyLen)
+		c.read(c.wrap(off+headerSize),key)
+		value := make([]byte,hd.valueLen)
+		c.read(c.wrap(off+headerSize+hd.keyLen),value)
+		c.onRemoved(string(key),value,hd.tag,reason)
+	}
+	delete(c.index,h)
+	c.setFlags(off,hd.flags|flagDeleted)
+	c.nBytes -= hd.keyLen+hd.valueLen
+	if off == c.head{
+		c.reclaim()
+	}
+}
+
+func(c *Cache)header(off int64)header{
+	var buf [headerSize]byte
+	c.read(off,buf[:])
+	return header{
+		expire: int64(binary.LittleEndian.Uint64(buf[0:8])),
+		keyLen: int64(binary.LittleEndian.Uint32(buf[8:12])),
+		valueLen: int64(binary.LittleEndian.Uint32(buf[12:16])),
+		tag: buf[16],
+		flags: buf[17],
+		used: int64(binary.LittleEndian.Uint64(buf[18:26])),
+	}
+}
+
+func(h *header)encode(buf []byte){
+	binary.LittleEndian.PutUint64(buf[0:8],uint64(h.expire))
+	binary.LittleEndian.PutUint32(buf[8:12],uint32(h.keyLen))
+	binary.LittleEndian.PutUint32(buf[12:16],uint32(h.valueLen))
+	buf[16] = h.tag
+	buf[17] = h.flags
+	binary.LittleEndian.PutUint64(buf[18:26],uint64(h.used))
+}
+
+func(c *Cache)setFlags(off int64,flags uint8){
+	c.ring[c.wrap(off+17)] = flags
+}
+
+// offsets past the end of the ring continue at its start
+func(c *Cache)wrap(off int64)int64{
+	if off >= int64(len(c.ring)){
+		off -= int64(len(c.ring))
+	}
+	return off
+}
+
+// copy b into the ring at off, wrapping around its end
+func(c *Cache)write(off int64,b []byte){
+	n := copy(c.ring[off:],b)
+	copy(c.ring,b[n:])
+}
+
+func(c *Cache)writeString(off int64,s string){
+	n := copy(c.ring[off:],s)
+	copy(c.ring,s[n:])
+}
+
+// copy len(b) bytes of the ring at off into b, wrapping around its end
+func(c *Cache)read(off int64,b []byte){
+	n := copy(b,c.ring[off:])
+	copy(b[n:],c.ring)
+}
+
+// compare the bytes of the ring at off with s
+func(c *Cache)equalAt(off int64,s string)bool{
+	for i := 0;i < len(s);i++{
+		if c.ring[c.wrap(off+int64(i))] != s[i]{
+			return false
+		}
+	}
+	return true
+}
+
+// fnv-1a, computed in place so neither lookups nor evictions allocate
+const (
+	offset64 = 14695981039346656037
+	prime64 = 1099511628211
+)
+
+func hashString(s string)uint64{
+	h := uint64(offset64)
+	for i := 0;i < len(s);i++{
+		h ^= uint64(s[i])
+		h *= prime64
+	}
+	return h
+}
+
+// hash of the n bytes of the ring at off, the same as hashString of them
+func(c *Cache)hashAt(off int64,n int64)uint64{
+	h := uint64(offset64)
+	for i := int64(0);i < n;i++{
+		h ^= uint64(c.ring[c.wrap(off+i)])
+		h *= prime64
+	}
+	return h
+}
@@ -0,0 +1,147 @@
+package slab
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGet(t *testing.T) {
+	c := New(1 << 10)
+	c.Add("key1", []byte("1234"), 7)
+	if v, tag, ok := c.Get("key1"); !ok || string(v) != "1234" || tag != 7 {
+		t.Fatalf("expect 1234 with tag 7, got %q %d %v", v, tag, ok)
+	}
+	if _, _, ok := c.Get("key2"); ok {
+		t.Fatal("expect key2 to miss")
+	}
+	c.Add("key1", []byte("56"), 0)
+	if v, _, _ := c.Get("key1"); string(v) != "56" || c.Len() != 1 || c.Bytes() != 6 {
+		t.Fatalf("expect key1 replaced, got %q %d entries %d bytes", v, c.Len(), c.Bytes())
+	}
+}
+
+func TestEvictOldest(t *testing.T) {
+	// room for three entries of a header, 4 bytes of key and 6 of value
+	c := New(3 * (headerSize + 10))
+	for i := 1; i <= 4; i++ {
+		c.Add(fmt.Sprintf("key%d", i), []byte(fmt.Sprintf("value%d", i)), 0)
+	}
+	if c.Contains("key1") || !c.Contains("key4") || c.Len() != 3 {
+		t.Fatalf("expect key1 evicted, got %v", c.Keys())
+	}
+	if !reflect.DeepEqual(c.Keys(), []string{"key4", "key3", "key2"}) {
+		t.Fatalf("expect newest keys first, got %v", c.Keys())
+	}
+}
+
+func TestOldestUse(t *testing.T) {
+	c := New(1 << 10)
+	if _, ok := c.OldestUse(); ok {
+		t.Fatal("expect no oldest use of an empty cache")
+	}
+	for i := 1; i <= 3; i++ {
+		c.Add(fmt.Sprintf("key%d", i), []byte("value"), 0)
+	}
+	// removed entries at the head are reclaimed, so the head is the oldest live entry
+	c.Remove("key1")
+	c.Remove("key2")
+	if c.head != 2*(headerSize+9) || c.used != headerSize+9 {
+		t.Fatalf("expect the removed entries reclaimed, got head %d and %d bytes used", c.head, c.used)
+	}
+	if _, ok := c.OldestUse(); !ok {
+		t.Fatal("expect the oldest use of key3")
+	}
+	c.RemoveOldest()
+	if _, ok := c.OldestUse(); ok || c.Len() != 0 || c.used != 0 {
+		t.Fatalf("expect an empty cache, got %v", c.Keys())
+	}
+}
+
+func TestSecondChance(t *testing.T) {
+	c := New(3 * (headerSize + 10))
+	c.Add("key1", []byte("value1"), 0)
+	c.Add("key2", []byte("value2"), 0)
+	c.Add("key3", []byte("value3"), 0)
+	// key1 was read, so key2 goes instead
+	c.Get("key1")
+	c.Add("key4", []byte("value4"), 0)
+	if !c.Contains("key1") || c.Contains("key2") {
+		t.Fatalf("expect key2 evicted, got %v", c.Keys())
+	}
+	if v, _, ok := c.Get("key1"); !ok || string(v) != "value1" {
+		t.Fatalf("expect key1 to survive its move, got %q", v)
+	}
+}
+
+func TestWrapAround(t *testing.T) {
+	// entries of odd sizes end up split across the end of the ring
+	c := New(100)
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("k%d", i)
+		value := []byte(fmt.Sprintf("v%0*d", i%13, i))
+		c.Add(key, value, 0)
+		if v, _, ok := c.Get(key); !ok || string(v) != string(value) {
+			t.Fatalf("%s: expect %q, got %q", key, value, v)
+		}
+	}
+	var bytes int64
+	for _, key := range c.Keys() {
+		v, _, _, ok := c.Peek(key)
+		if !ok {
+			t.Fatalf("expect %s listed in keys to be cached", key)
+		}
+		bytes += int64(len(key) + len(v))
+	}
+	if bytes != c.Bytes() {
+		t.Fatalf("expect %d bytes, got %d", bytes, c.Bytes())
+	}
+}
+
+func TestExpire(t *testing.T) {
+	c := New(1 << 10)
+	c.AddWithExpire("old", []byte("1"), 0, time.Now().Add(-time.Second))
+	c.AddWithExpire("new", []byte("2"), 0, time.Now().Add(time.Hour))
+	if _, _, ok := c.Get("old"); ok || c.Len() != 1 {
+		t.Fatal("expect expired entry to be removed")
+	}
+	expire := time.Now().Add(time.Minute).Round(0)
+	if !c.SetExpire("new", expire) {
+		t.Fatal("expect new to be cached")
+	}
+	if _, _, got, ok := c.Peek("new"); !ok || !got.Equal(expire) {
+		t.Fatalf("expect expire %v, got %v", expire, got)
+	}
+	if !c.Remove("new") || c.Remove("new") || c.Bytes() != 0 {
+		t.Fatal("expect new removed once")
+	}
+}
+
+func TestTooLarge(t *testing.T) {
+	c := New(32)
+	c.Add("key", []byte("small"), 0)
+	c.Add("key", make([]byte, 32), 0)
+	if c.Contains("key") || c.Len() != 0 {
+		t.Fatal("expect a value larger than the slab not to be cached")
+	}
+}
+
+func TestOnRemoved(t *testing.T) {
+	var removed []string
+	c := New(3 * (headerSize + 10))
+	c.SetOnRemoved(func(key string, value []byte, tag uint8, reason Reason) {
+		removed = append(removed, fmt.Sprintf("%s=%s %d", key, value, reason))
+	})
+	c.Add("key1", []byte("value1"), 0)
+	// replaced values are not reported
+	c.Add("key1", []byte("value2"), 0)
+	c.AddWithExpire("key2", []byte("value2"), 0, time.Now().Add(-time.Second))
+	c.Add("key3", []byte("value3"), 0)
+	c.Get("key2")
+	c.Remove("key3")
+	expect := []string{fmt.Sprintf("key2=value2 %d", Expired), fmt.Sprintf("key3=value3 %d", Removed)}
+	if !reflect.DeepEqual(removed, expect) {
+		t.Fatalf("expect %v, got %v", expect, removed)
+	}
+}
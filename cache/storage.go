@@ -0,0 +1,198 @@
+package cache
+
+import (
+	"cache/lru"
+	"cache/slab"
+	"time"
+)
+
+// storage keeps the entries of a cache, the cache locks around every call
+type storage interface{
+	addWithExpire(key string,value ByteView,expire time.Time)
+	get(key string)(ByteView,bool)
+	remove(key string)bool
+	touch(key string,expire time.Time)bool
+	contains(key string)bool
+	peek(key string)(ByteView,time.Time,bool)
+	keys()[]string
+	removeOldest()
+	oldestUse()(time.Time,bool)
+	stats()(items int,bytes int64)
+	// call fn with every entry that leaves the storage, under the lock of the cache
+	setOnRemoved(fn func(key string,value ByteView,reason EvictReason))
+}
+
+// bytes an entry takes in memory on top of its key and value, measured with go 1.19 on amd64
+const (
+	// list element, entry, the ByteView boxed in it and its map slot
+	DefaultHeapEntryOverhead = 200
+	// header in the slab and index slot
+	DefaultSlabEntryOverhead = 56
+)
+
+// charge every entry of the group bytes on top of its key and value, in its cacheBytes, the memory budget and the bytes stat
+// without it the default of the storage is used, negative bytes also means the default and 0 counts keys and values only
+func WithEntryOverhead(bytes int64)GroupOption{
+	return func(g *Group){
+		g.mainCache.overhead = bytes
+	}
+}
+
+// keep cached values in byte slabs instead of the heap, see slab.Cache
+// with millions of small entries the heap storage makes the garbage collector scan a pointer or more per entry, the slab storage none
+// reads copy the value out of the slab, and entry headers take room in cacheBytes too
+// groups with cacheBytes <= 0 have no limit to size a slab by, they keep the heap storage
+func WithSlabStorage()GroupOption{
+	return func(g *Group){
+		g.mainCache.slab = true
+	}
+}
+
+// lru list of values on the heap, reads share the cached bytes
+type lruStorage struct{
+	lru *lru.Cache
+}
+
+func newLRUStorage(maxBytes int64,overhead int64)*lruStorage{
+	s := &lruStorage{lru: lru.New(maxBytes,nil)}
+	s.lru.SetOverhead(overhead)
+	return s
+}
+
+func(s *lruStorage)addWithExpire(key string,value ByteView,expire time.Time){
+	s.lru.AddWithExpire(key,value,expire)
+}
+
+func(s *lruStorage)get(key string)(ByteView,bool){
+	if v,ok := s.lru.Get(key);ok{
+		return v.(ByteView),true
+	}
+	return ByteView{},false
+}
+
+func(s *lruStorage)remove(key string)bool{
+	return s.lru.Remove(key)
+}
+
+func(s *lruStorage)touch(key string,expire time.Time)bool{
+	return s.lru.SetExpire(key,expire)
+}
+
+func(s *lruStorage)contains(key string)bool{
+	return s.lru.Contains(key)
+}
+
+func(s *lruStorage)peek(key string)(ByteView,time.Time,bool){
+	v,expire,ok := s.lru.Peek(key)
+	if !ok{
+		return ByteView{},time.Time{},false
+	}
+	return v.(ByteView),expire,true
+}
+
+func(s *lruStorage)keys()[]string{
+	return s.lru.Keys()
+}
+
+func(s *lruStorage)removeOldest(){
+	s.lru.RemoveOldest()
+}
+
+func(s *lruStorage)oldestUse()(time.Time,bool){
+	return s.lru.OldestUse()
+}
+
+func(s *lruStorage)stats()(int,int64){
+	return s.lru.Len(),s.lru.Bytes()
+}
+
+func(s *lruStorage)setOnRemoved(fn func(key string,value ByteView,reason EvictReason)){
+	s.lru.SetOnRemoved(func(key string,value lru.Value,reason lru.Reason){
+		fn(key,value.(ByteView),evictReasons[reason])
+	})
+}
+
+// tags of slab entries
+const (
+	slabPlain = iota
+	slabCompressed // compressed by the compressor of the group
+)
+
+// values in a preallocated slab, off the scanned heap
+type slabStorage struct{
+	slab *slab.Cache
+	// a group compresses all its values with one compressor, so a tag is enough to find it again
+	codec Compressor
+}
+
+func newSlabStorage(maxBytes int64,overhead int64)*slabStorage{
+	s := &slabStorage{slab: slab.New(maxBytes)}
+	s.slab.SetOverhead(overhead)
+	return s
+}
+
+func(s *slabStorage)addWithExpire(key string,value ByteView,expire time.Time){
+	tag := uint8(slabPlain)
+	if value.codec != nil{
+		s.codec = value.codec
+		tag = slabCompressed
+	}
+	s.slab.AddWithExpire(key,value.b,tag,expire)
+}
+
+func(s *slabStorage)view(b []byte,tag uint8)ByteView{
+	if tag == slabCompressed{
+		return ByteView{b: b,codec: s.codec}
+	}
+	return ByteView{b: b}
+}
+
+func(s *slabStorage)get(key string)(ByteView,bool){
+	b,tag,ok := s.slab.Get(key)
+	if !ok{
+		return ByteView{},false
+	}
+	return s.view(b,tag),true
+}
+
+func(s *slabStorage)remove(key string)bool{
+	return s.slab.Remove(key)
+}
+
+func(s *slabStorage)touch(key string,expire time.Time)bool{
+	return s.slab.SetExpire(key,expire)
+}
+
+func(s *slabStorage)contains(key string)bool{
+	return s.slab.Contains(key)
+}
+
+func(s *slabStorage)peek(key string)(ByteView,time.Time,bool){
+	b,tag,expire,ok := s.slab.Peek(key)
+	if !ok{
+		return ByteView{},time.Time{},false
+	}
+	return s.view(b,tag),expire,true
+}
+
+func(s *slabStorage)keys()[]string{
+	return s.slab.Keys()
+}
+
+func(s *slabStorage)removeOldest(){
+	s.slab.RemoveOldest()
+}
+
+func(s *slabStorage)oldestUse()(time.Time,bool){
+	return s.slab.OldestUse()
+}
+
+func(s *slabStorage)stats()(int,int64){
+	return s.slab.Len(),s.slab.Bytes()
+}
+
+func(s *slabStorage)setOnRemoved(fn func(key string,value ByteView,reason EvictReason)){
+	s.slab.SetOnRemoved(func(key string,value []byte,tag uint8,reason slab.Reason){
+		fn(key,s.view(value,tag),slabEvictReasons[reason])
+	})
+}
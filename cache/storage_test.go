@@ -0,0 +1,92 @@
+package cache
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// both storages keep the same contract
+func TestStorages(t *testing.T) {
+	for name, store := range map[string]storage{"lru": newLRUStorage(1<<10, 0), "slab": newSlabStorage(1<<10, 0)} {
+		t.Run(name, func(t *testing.T) {
+			store.addWithExpire("Tom", ByteView{b: []byte("630")}, time.Time{})
+			store.addWithExpire("Jack", ByteView{b: []byte("589")}, time.Now().Add(-time.Second))
+			if v, ok := store.get("Tom"); !ok || v.String() != "630" {
+				t.Fatalf("expect 630, got %q", v.String())
+			}
+			if _, ok := store.get("Jack"); ok || store.contains("Jack") {
+				t.Fatal("expect Jack expired")
+			}
+			expire := time.Now().Add(time.Hour).Round(0)
+			if !store.touch("Tom", expire) {
+				t.Fatal("expect Tom to be cached")
+			}
+			if _, got, ok := store.peek("Tom"); !ok || !got.Equal(expire) {
+				t.Fatalf("expect expire %v, got %v", expire, got)
+			}
+			if items, bytes := store.stats(); items != 1 || bytes != 6 {
+				t.Fatalf("expect 1 item of 6 bytes, got %d %d", items, bytes)
+			}
+			if !store.remove("Tom") || len(store.keys()) != 0 {
+				t.Fatal("expect Tom removed")
+			}
+			// a value filling the whole budget pushes the others out
+			for i := 0; i < 100; i++ {
+				store.addWithExpire(fmt.Sprintf("key%d", i), ByteView{b: bytes.Repeat([]byte{'x'}, 100)}, time.Time{})
+			}
+			if items, bytes := store.stats(); bytes > 1<<10 || items == 0 || items > 10 {
+				t.Fatalf("expect the budget kept, got %d items of %d bytes", items, bytes)
+			}
+		})
+	}
+}
+
+func TestSlabGroup(t *testing.T) {
+	large := strings.Repeat(`{"name":"Tom","score":630},`, 100)
+	g := NewGroup("slabbed", 2<<20, GetterFunc(func(key string) ([]byte, error) {
+		return []byte(db[key] + large), nil
+	}), WithSlabStorage(), WithCompression(NewGzipCompressor(-1), 64))
+	for i := 0; i < 2; i++ {
+		if v, err := g.Get("Tom"); err != nil || v.String() != "630"+large {
+			t.Fatalf("get %d: expect the plain value, got %v", i, err)
+		}
+	}
+	if stats := g.Stats(); stats.CacheHits != 1 || stats.Bytes >= int64(len(large)) {
+		t.Fatalf("expect a hit on the compressed value, got %+v", stats)
+	}
+	if _, ok := g.mainCache.store.(*slabStorage); !ok {
+		t.Fatal("expect slab storage")
+	}
+}
+
+// time of a full collection with a million small entries cached, the slab storage gives the collector nothing to scan
+func BenchmarkGCPause(b *testing.B) {
+	const entries = 1 << 20
+	stores := map[string]func() storage{
+		"lru":  func() storage { return newLRUStorage(0, 0) },
+		"slab": func() storage { return newSlabStorage(entries*64, 0) },
+	}
+	for name, newStore := range stores {
+		b.Run(name, func(b *testing.B) {
+			store := newStore()
+			value := []byte("0123456789")
+			for i := 0; i < entries; i++ {
+				store.addWithExpire(fmt.Sprintf("key%d", i), ByteView{b: value}, time.Time{})
+			}
+			runtime.GC()
+			b.ResetTimer()
+			var pause time.Duration
+			for i := 0; i < b.N; i++ {
+				start := time.Now()
+				runtime.GC()
+				pause += time.Since(start)
+			}
+			b.ReportMetric(float64(pause.Nanoseconds())/float64(b.N), "gc-ns/op")
+			runtime.KeepAlive(store)
+		})
+	}
+}
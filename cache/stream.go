@@ -0,0 +1,268 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// trailer of a streamed response that carries the error when the stream broke after the first byte
+const streamErrorTrailer = "X-Gocache-Error"
+
+// values over the size limit of a group are rejected with an error wrapping ErrValueTooLarge
+var ErrValueTooLarge = errors.New("value too large")
+
+// StreamGetter is a Getter that can also stream a value, so passthrough groups never hold a large value in memory
+type StreamGetter interface{
+	GetStream(ctx context.Context,key string)(io.ReadCloser,error)
+}
+
+// StreamPeerGetter fetches a value from a peer as a stream
+type StreamPeerGetter interface{
+	GetStream(ctx context.Context,group string,key string)(io.ReadCloser,error)
+}
+
+var _ StreamPeerGetter = (*httpGetter)(nil)
+
+// never cache values larger than maxBytes, maxBytes <= 0 means no limit
+// without passthrough, loading or setting a larger value fails with ErrValueTooLarge
+// with passthrough, larger values are served without being cached, and Stream copies them from the database
+// or the owning peer without holding them in memory
+func WithMaxValueBytes(maxBytes int64,passthrough bool)GroupOption{
+	return func(g *Group){
+		g.maxValueBytes = maxBytes
+		g.passthrough = passthrough && maxBytes > 0
+	}
+}
+
+// check if a value of size bytes may be cached
+func (g *Group)fits(size int64)bool{
+	return g.maxValueBytes <= 0 || size <= g.maxValueBytes
+}
+
+func (g *Group)tooLarge(key string,size int64)error{
+	return fmt.Errorf("%s/%s is %d bytes, more than the %d bytes allowed: %w",g.name,key,size,g.maxValueBytes,ErrValueTooLarge)
+}
+
+// write the value of key to w and return the number of bytes written
+// values of passthrough groups are streamed from the owning peer or the database and cached only if they fit,
+// concurrent streams of a missing key are not merged like loads are, every other group writes the value of Get
+func (g *Group)Stream(ctx context.Context,key string,w io.Writer)(int64,error){
+	return g.stream(ctx,key,w,true)
+}
+
+// stream key to w, a miss is read from the owning peer only if forward is set, see get
+func (g *Group)stream(ctx context.Context,key string,w io.Writer,forward bool)(int64,error){
+	if !g.passthrough{
+		view,err := g.get(key,forward)
+		if err != nil{
+			return 0,err
+		}
+		return view.WriteTo(w)
+	}
+	if key == ""{
+		return 0,fmt.Errorf("key is required")
+	}
+	g.stats.gets.Add(1)
+	if v,ok := g.lookupCache(key);ok{
+		return v.WriteTo(w)
+	}
+	src,cached,err := g.openStream(ctx,key,forward)
+	if err != nil{
+		return 0,err
+	}
+	defer src.Close()
+	if cached{
+		return io.Copy(w,src)
+	}
+	// hold on to the first maxValueBytes, a value that ends before that is cached like any other
+	head,err := io.ReadAll(io.LimitReader(src,g.maxValueBytes+1))
+	if err != nil{
+		return 0,err
+	}
+	if int64(len(head)) <= g.maxValueBytes{
+		if g.admits(key){
+			g.populateCache(key,ByteView{b: head})
+		}
+		n,err := w.Write(head)
+		return int64(n),err
+	}
+	g.stats.oversized.Add(1)
+	n,err := w.Write(head)
+	if err != nil{
+		return int64(n),err
+	}
+	rest,err := io.Copy(w,src)
+	return int64(n)+rest,err
+}
+
+// open the value of key from the owning peer if forward is set, or else the database
+// cached reports that the value was loaded the usual way and is already in the cache if it fits
+func (g *Group)openStream(ctx context.Context,key string,forward bool)(io.ReadCloser,bool,error){
+	if forward && g.peers != nil{
+		if peer,ok := g.peers.PickPeer(key);ok{
+			if sp,ok := peer.(StreamPeerGetter);ok{
+				rc,err := sp.GetStream(ctx,g.name,key)
+				if err == nil{
+					g.stats.peerLoads.Add(1)
+					return rc,false,nil
+				}
+				if peerAnswered(err){
+					return nil,false,err
+				}
+				g.peerFailed(key,err)
+			}
+		}
+	}
+	sg,ok := g.getter.(StreamGetter)
+	if !ok{
+		view,err := g.getLocally(ctx,key)
+		if err != nil{
+			return nil,false,err
+		}
+		return io.NopCloser(view.Reader()),true,nil
+	}
+	release,err := g.acquireLoad(ctx)
+	if err != nil{
+		return nil,false,err
+	}
+	rc,err := sg.GetStream(ctx,key)
+	if err != nil{
+		release()
+		g.stats.localLoadErrs.Add(1)
+		return nil,false,err
+	}
+	g.stats.localLoads.Add(1)
+	// the load slot is held until the stream is read
+	return &releaseCloser{ReadCloser: rc,release: release},false,nil
+}
+
+// stream closer that gives back a load slot
+type releaseCloser struct{
+	io.ReadCloser
+	release func()
+}
+
+func (r *releaseCloser)Close()error{
+	err := r.ReadCloser.Close()
+	r.release()
+	return err
+}
+
+// write a response in chunks as stream produces it, every chunk is flushed to the client right away
+// an error after the first byte can not change the status any more, it is sent in the streamErrorTrailer instead
+// started reports whether anything was written, if not the caller still has to answer
+func serveStream(w http.ResponseWriter,stream func(w io.Writer)(int64,error))(started bool,err error){
+	w.Header().Set("Trailer",streamErrorTrailer)
+	fw := &flushWriter{w: w}
+	if f,ok := w.(http.Flusher);ok{
+		fw.flusher = f
+	}
+	_,err = stream(fw)
+	if err != nil && fw.started{
+		w.Header().Set(streamErrorTrailer,err.Error())
+	}
+	if !fw.started{
+		w.Header().Del("Trailer")
+	}
+	return fw.started,err
+}
+
+// writer that flushes every write, so a streamed value leaves in chunks as it arrives
+type flushWriter struct{
+	w http.ResponseWriter
+	flusher http.Flusher
+	started bool
+}
+
+func (f *flushWriter)Write(b []byte)(int,error){
+	if len(b) == 0{
+		return 0,nil
+	}
+	if !f.started{
+		f.started = true
+		f.w.WriteHeader(http.StatusOK)
+	}
+	n,err := f.w.Write(b)
+	if f.flusher != nil{
+		f.flusher.Flush()
+	}
+	return n,err
+}
+
+// body of a streamed response, a stream that broke on the sending side ends in an error instead of EOF
+type trailerReader struct{
+	res *http.Response
+}
+
+func (t *trailerReader)Read(b []byte)(int,error){
+	n,err := t.res.Body.Read(b)
+	if err == io.EOF{
+		if msg := t.res.Trailer.Get(streamErrorTrailer);msg != ""{
+			return n,fmt.Errorf("peer stream broke: %s",msg)
+		}
+	}
+	return n,err
+}
+
+func (t *trailerReader)Close()error{
+	return t.res.Body.Close()
+}
+
+// http status of an error serving a value
+func valueErrorStatus(err error)int{
+	switch{
+	case errors.Is(err,ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err,ErrValueTooLarge):
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusInternalServerError
+}
+
+// status of a peer request for a group this node does not serve, a misconfigured peer and not a missing key
+const statusNoSuchGroup = http.StatusMisdirectedRequest
+
+// errors a peer answers a fetch with, the database would say the same so they are not worth another load
+func peerAnswered(err error)bool{
+	return errors.Is(err,ErrNotFound) || errors.Is(err,ErrValueTooLarge)
+}
+
+// error of a peer response status, so ErrNotFound and ErrValueTooLarge survive the trip
+func peerStatusError(res *http.Response)error{
+	switch res.StatusCode{
+	case http.StatusNotFound:
+		return fmt.Errorf("server returned %v: %w",res.Status,ErrNotFound)
+	case http.StatusRequestEntityTooLarge:
+		return fmt.Errorf("server returned %v: %w",res.Status,ErrValueTooLarge)
+	}
+	return fmt.Errorf("server returned %v",res.Status)
+}
+
+// answer a peer fetch of key, values of passthrough groups are streamed in chunks,
+// the others are sent whole, compressed as they are cached if the peer accepts the encoding
+func servePeerValue(w http.ResponseWriter,r *http.Request,group *Group,key string){
+	w.Header().Set("Content-Type","application/octet-stream")
+	if group.passthrough{
+		started,err := serveStream(w,func(dst io.Writer)(int64,error){
+			return group.stream(r.Context(),key,dst,false)
+		})
+		if err != nil && !started{
+			http.Error(w,err.Error(),valueErrorStatus(err))
+		}
+		return
+	}
+	value,encoding,err := group.getForPeer(key,r.Header.Get("Accept-Encoding"))
+	if err != nil{
+		http.Error(w,err.Error(),valueErrorStatus(err))
+		return
+	}
+	if encoding != ""{
+		w.Header().Set("Content-Encoding",encoding)
+	}
+	w.Header().Set("Content-Length",strconv.Itoa(len(value)))
+	w.Write(value)
+}
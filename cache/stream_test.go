@@ -0,0 +1,147 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// getter that streams its values, values of broken keys fail after the first 120 bytes
+type streamGetter struct {
+	values map[string]string
+	loads  int
+}
+
+func (s *streamGetter) Get(key string) ([]byte, error) {
+	rc, err := s.GetStream(context.Background(), key)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+func (s *streamGetter) GetStream(ctx context.Context, key string) (io.ReadCloser, error) {
+	s.loads++
+	if strings.HasPrefix(key, "broken") {
+		return io.NopCloser(io.MultiReader(strings.NewReader(strings.Repeat("first bytes ", 10)), iotest.ErrReader(errors.New("database went away")))), nil
+	}
+	v, ok := s.values[key]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", key, ErrNotFound)
+	}
+	return io.NopCloser(strings.NewReader(v)), nil
+}
+
+var streamValues = map[string]string{"small": "630", "large": strings.Repeat("gocache ", 4<<10)}
+
+func TestMaxValueBytes(t *testing.T) {
+	g := NewGroup("limited", 2<<10, &streamGetter{values: streamValues}, WithMaxValueBytes(64, false))
+	if v, err := g.Get("small"); err != nil || v.String() != "630" {
+		t.Fatalf("expect 630, got %v", err)
+	}
+	if _, err := g.Get("large"); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("expect too large, got %v", err)
+	}
+	if err := g.Set("large", []byte(streamValues["large"])); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("expect set to be rejected, got %v", err)
+	}
+	if _, _, ok := g.mainCache.peek("large"); ok {
+		t.Fatal("expect the large value not to be cached")
+	}
+}
+
+func TestPassthrough(t *testing.T) {
+	getter := &streamGetter{values: streamValues}
+	g := NewGroup("passthrough", 2<<10, getter, WithMaxValueBytes(64, true))
+	for i := 0; i < 2; i++ {
+		var buf bytes.Buffer
+		if n, err := g.Stream(context.Background(), "large", &buf); err != nil || n != int64(len(streamValues["large"])) || buf.String() != streamValues["large"] {
+			t.Fatalf("expect the large value streamed, got %d bytes %v", n, err)
+		}
+		var small bytes.Buffer
+		if _, err := g.Stream(context.Background(), "small", &small); err != nil || small.String() != "630" {
+			t.Fatalf("expect 630, got %q %v", small.String(), err)
+		}
+	}
+	// small values are cached, large ones are loaded every time
+	if getter.loads != 3 {
+		t.Fatalf("expect 3 loads, got %d", getter.loads)
+	}
+	if stats := g.Stats(); stats.Oversized != 2 {
+		t.Fatalf("expect 2 oversized values, got %d", stats.Oversized)
+	}
+	if _, err := g.Stream(context.Background(), "nobody", io.Discard); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expect not found, got %v", err)
+	}
+}
+
+func TestPeerStream(t *testing.T) {
+	NewGroup("peerstream", 2<<10, &streamGetter{values: streamValues}, WithMaxValueBytes(64, true))
+	NewGroup("peerlimited", 2<<10, &streamGetter{values: streamValues}, WithMaxValueBytes(64, false))
+	server, err := NewCacheServer("http://self", ":0", []string{"http://self"}, GetGroup("peerstream"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(server.httpServer.Handler)
+	defer ts.Close()
+	getter := &httpGetter{baseUrl: ts.URL + defaultBasePath, client: http.DefaultClient}
+
+	rc, err := getter.GetStream(context.Background(), "peerstream", "large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil || string(b) != streamValues["large"] {
+		t.Fatalf("expect the large value, got %d bytes %v", len(b), err)
+	}
+	if v, err := getter.Get("peerstream", "small"); err != nil || string(v) != "630" {
+		t.Fatalf("expect 630, got %q %v", v, err)
+	}
+
+	// a stream that breaks after the status was sent still ends in an error
+	rc, err = getter.GetStream(context.Background(), "peerstream", "broken")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = io.ReadAll(rc)
+	rc.Close()
+	if err == nil || !strings.Contains(err.Error(), "database went away") {
+		t.Fatalf("expect the stream to fail, got %q %v", b, err)
+	}
+
+	// limits and missing keys survive the trip
+	if _, err := getter.Get("peerlimited", "large"); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("expect too large, got %v", err)
+	}
+	if _, err := getter.GetStream(context.Background(), "peerstream", "nobody"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expect not found, got %v", err)
+	}
+}
+
+func TestAPITooLarge(t *testing.T) {
+	g := NewGroup("apilimited", 2<<10, &streamGetter{values: streamValues}, WithMaxValueBytes(64, false))
+	server, err := NewAPIServer("", ":0", g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := server.httpServer.Handler
+	for _, r := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/api?group=apilimited&key=large", nil),
+		httptest.NewRequest(http.MethodPut, "/api?group=apilimited&key=large", strings.NewReader(streamValues["large"])),
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusRequestEntityTooLarge || !strings.Contains(w.Body.String(), "value too large") {
+			t.Fatalf("%s: expect 413, got %d %q", r.Method, w.Code, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package cache
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// how often certificate files are checked for changes
+const tlsReloadInterval = 10*time.Second
+
+// certificate, key and CA files of a node, reloaded when they change on disk
+// so certificates can be rotated without restarting the node
+type certReloader struct{
+	certFile string // may be empty for clients that do not present a certificate
+	keyFile string
+	caFile string // empty means the system roots and no client certificates
+	interval time.Duration // how often the files are checked
+	mu sync.Mutex
+	cert *tls.Certificate
+	pool *x509.CertPool
+	modTime time.Time // latest modification time of the loaded files
+	checked time.Time // last time the files were checked
+}
+
+func newCertReloader(certFile string,keyFile string,caFile string)(*certReloader,error){
+	if (certFile == "") != (keyFile == ""){
+		return nil,errors.New("tls: certificate and key must be given together")
+	}
+	r := &certReloader{certFile: certFile,keyFile: keyFile,caFile: caFile,interval: tlsReloadInterval}
+	if err := r.load();err != nil{
+		return nil,err
+	}
+	return r,nil
+}
+
+// read all files again, keep the loaded ones if any file is invalid
+func (r *certReloader)load()error{
+	modTime,err := r.latestModTime()
+	if err != nil{
+		return err
+	}
+	var cert *tls.Certificate
+	if r.certFile != ""{
+		c,err := tls.LoadX509KeyPair(r.certFile,r.keyFile)
+		if err != nil{
+			return fmt.Errorf("tls: %w",err)
+		}
+		cert = &c
+	}
+	var pool *x509.CertPool
+	if r.caFile != ""{
+		pem,err := os.ReadFile(r.caFile)
+		if err != nil{
+			return fmt.Errorf("tls: %w",err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem){
+			return fmt.Errorf("tls: no certificate found in %s",r.caFile)
+		}
+	}
+	r.mu.Lock()
+	r.cert,r.pool,r.modTime = cert,pool,modTime
+	r.checked = time.Now()
+	r.mu.Unlock()
+	return nil
+}
+
+// latest modification time of the files
+func (r *certReloader)latestModTime()(time.Time,error){
+	var latest time.Time
+	for _,name := range []string{r.certFile,r.keyFile,r.caFile}{
+		if name == ""{
+			continue
+		}
+		info,err := os.Stat(name)
+		if err != nil{
+			return time.Time{},fmt.Errorf("tls: %w",err)
+		}
+		if info.ModTime().After(latest){
+			latest = info.ModTime()
+		}
+	}
+	return latest,nil
+}
+
+// loaded certificate and CA pool, the files are reloaded first if they changed since the last check
+func (r *certReloader)current()(*tls.Certificate,*x509.CertPool){
+	r.mu.Lock()
+	due := time.Since(r.checked) >= r.interval
+	if due{
+		r.checked = time.Now()
+	}
+	loaded := r.modTime
+	r.mu.Unlock()
+	if due{
+		if modTime,err := r.latestModTime();err == nil && modTime.After(loaded){
+			// a half written file fails to parse, the next check picks it up once it is complete
+			if err := r.load();err != nil{
+				log.Println("[TLS] reload failed, keeping the current certificates:",err)
+			}else{
+				log.Println("[TLS] reloaded certificates")
+			}
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cert,r.pool
+}
+
+// config of a server presenting the current certificate
+// with mutual set and a CA file, clients must present a certificate signed by the CA
+func (r *certReloader)serverConfig(mutual bool)*tls.Config{
+	newConfig := func()*tls.Config{
+		cert,pool := r.current()
+		c := &tls.Config{MinVersion: tls.VersionTLS12,Certificates: []tls.Certificate{*cert}}
+		if mutual && pool != nil{
+			c.ClientAuth = tls.RequireAndVerifyClientCert
+			c.ClientCAs = pool
+		}
+		return c
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// net/http wants a certificate source on the base config
+		GetCertificate: func(*tls.ClientHelloInfo)(*tls.Certificate,error){
+			cert,_ := r.current()
+			return cert,nil
+		},
+		// every handshake gets the current certificate and CA
+		GetConfigForClient: func(*tls.ClientHelloInfo)(*tls.Config,error){
+			return newConfig(),nil
+		},
+	}
+}
+
+// config of a client presenting the current certificate, if any, and verifying servers with the current CA
+func (r *certReloader)clientConfig()*tls.Config{
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetClientCertificate: func(*tls.CertificateRequestInfo)(*tls.Certificate,error){
+			cert,_ := r.current()
+			if cert == nil{
+				return &tls.Certificate{},nil
+			}
+			return cert,nil
+		},
+		// the server is verified in VerifyConnection instead, against the CA loaded at the time of the handshake
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState)error{
+			if len(cs.PeerCertificates) == 0{
+				return errors.New("tls: server presented no certificate")
+			}
+			_,pool := r.current()
+			opts := x509.VerifyOptions{DNSName: cs.ServerName,Roots: pool,Intermediates: x509.NewCertPool()}
+			for _,c := range cs.PeerCertificates[1:]{
+				opts.Intermediates.AddCert(c)
+			}
+			_,err := cs.PeerCertificates[0].Verify(opts)
+			return err
+		},
+	}
+}
+
+// tls config for clients of a cache cluster, like gocache-cli
+// certFile and keyFile are presented to servers that ask for a certificate, caFile verifies the servers
+// empty names are skipped, an empty caFile uses the system roots, the files are reloaded when they change
+func LoadClientTLS(certFile string,keyFile string,caFile string)(*tls.Config,error){
+	r,err := newCertReloader(certFile,keyFile,caFile)
+	if err != nil{
+		return nil,err
+	}
+	return r.clientConfig(),nil
+}
@@ -0,0 +1,177 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// certificate authority that issues test certificates
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "gocache test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue a certificate for localhost usable by servers and clients, return cert and key pem
+func (ca *testCA) issue(t *testing.T, serial int64) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// write content into dir/name and return its path
+func writeFile(t *testing.T, dir string, name string, content []byte) string {
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, content, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	caFile := writeFile(t, dir, "ca.pem", ca.pem)
+	cert, key := ca.issue(t, 2)
+	certFile, keyFile := writeFile(t, dir, "node.pem", cert), writeFile(t, dir, "node.key", key)
+
+	g := NewGroup("tls", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		return []byte(db[key]), nil
+	}))
+	server, err := NewCacheServer("https://self", ":0", []string{"https://self"}, g, WithTLS(certFile, keyFile, caFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewUnstartedServer(server.httpServer.Handler)
+	ts.TLS = server.httpServer.TLSConfig
+	ts.StartTLS()
+	defer ts.Close()
+
+	// a peer with a certificate of our CA gets through
+	getter := &httpGetter{baseUrl: ts.URL + defaultBasePath, client: server.networkController.client}
+	if v, err := getter.Get("tls", "Tom"); err != nil || string(v) != "630" {
+		t.Fatalf("expect 630 over mutual tls, got %q %v", v, err)
+	}
+
+	// no client certificate, a certificate of another CA, or a client that does not trust our CA
+	rogue := newTestCA(t)
+	rogueCert, rogueKey := rogue.issue(t, 3)
+	clients := map[string][3]string{
+		"no certificate":   {"", "", caFile},
+		"unknown CA":       {writeFile(t, dir, "rogue.pem", rogueCert), writeFile(t, dir, "rogue.key", rogueKey), caFile},
+		"untrusted server": {certFile, keyFile, writeFile(t, dir, "rogue-ca.pem", rogue.pem)},
+	}
+	for name, files := range clients {
+		config, err := LoadClientTLS(files[0], files[1], files[2])
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+		if res, err := client.Get(ts.URL + defaultBasePath + "tls/Tom"); err == nil {
+			res.Body.Close()
+			t.Fatalf("%s: expect handshake to fail, got %s", name, res.Status)
+		}
+	}
+}
+
+func TestCertReload(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	cert, key := ca.issue(t, 2)
+	certFile, keyFile := writeFile(t, dir, "node.pem", cert), writeFile(t, dir, "node.key", key)
+	r, err := newCertReloader(certFile, keyFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.interval = 0
+
+	// rotate the certificate on disk
+	cert2, key2 := ca.issue(t, 3)
+	writeFile(t, dir, "node.pem", cert2)
+	writeFile(t, dir, "node.key", key2)
+	later := time.Now().Add(time.Second)
+	os.Chtimes(certFile, later, later)
+
+	loaded, _ := r.current()
+	block, _ := pem.Decode(cert2)
+	if !bytes.Equal(loaded.Certificate[0], block.Bytes) {
+		t.Fatal("expect the rotated certificate to be loaded")
+	}
+
+	// a broken file keeps the current certificate
+	writeFile(t, dir, "node.pem", []byte("garbage"))
+	later = later.Add(time.Second)
+	os.Chtimes(certFile, later, later)
+	if loaded, _ := r.current(); !bytes.Equal(loaded.Certificate[0], block.Bytes) {
+		t.Fatal("expect the last good certificate to be kept")
+	}
+}
+
+func TestServerBadTLSFiles(t *testing.T) {
+	g := NewGroup("tls-missing", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		return nil, ErrNotFound
+	}))
+	missing := filepath.Join(t.TempDir(), "missing.pem")
+	if _, err := NewCacheServer("https://self", ":0", []string{"https://self"}, g, WithTLS(missing, missing, "")); err == nil {
+		t.Fatal("expect a cache server with missing tls files to fail")
+	}
+	if _, err := NewAPIServer("", ":0", g, WithTLS(missing, missing, "")); err == nil {
+		t.Fatal("expect an api server with missing tls files to fail")
+	}
+}
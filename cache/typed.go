@@ -0,0 +1,114 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Codec turns values of T into the bytes a group caches and back
+type Codec[T any] interface{
+	Encode(v T)([]byte,error)
+	Decode(b []byte)(T,error)
+}
+
+// TypedGetter loads the value of key from the database, ctx is cancelled when the value is no longer needed
+type TypedGetter[T any] func(ctx context.Context,key string)(T,error)
+
+// DecodeError is returned when cached bytes can not be decoded into a value, like after the type of a group changed
+// it is not a load error: the bytes came from the cache, a peer or a value set by hand
+type DecodeError struct{
+	Group string
+	Key string
+	Err error
+}
+
+func (e *DecodeError)Error()string{
+	return fmt.Sprintf("decode %s/%s: %v",e.Group,e.Key,e.Err)
+}
+
+func (e *DecodeError)Unwrap()error{
+	return e.Err
+}
+
+// TypedGroup is a group of values of type T, encoded with a codec in the cache and between peers
+type TypedGroup[T any] struct{
+	group *Group
+	codec Codec[T]
+}
+
+// create a group of values of type T, getter loads missing values which are encoded with codec before caching
+func NewTypedGroup[T any](name string,cacheBytes int64,codec Codec[T],getter TypedGetter[T],opts ...GroupOption)*TypedGroup[T]{
+	if getter == nil{
+		panic("nil getter")
+	}
+	return &TypedGroup[T]{group: NewGroup(name,cacheBytes,typedGetter[T]{get: getter,codec: codec},opts...),codec: codec}
+}
+
+// the untyped group, for RegisterPeers, stats and the front ends
+func (t *TypedGroup[T])Group()*Group{
+	return t.group
+}
+
+func (t *TypedGroup[T])Name()string{
+	return t.group.Name()
+}
+
+// get the value of key, errors of the getter are returned as they are, undecodable bytes as *DecodeError
+// concurrent callers share one load, so ctx only stops this caller from starting
+func (t *TypedGroup[T])Get(ctx context.Context,key string)(T,error){
+	var zero T
+	if err := ctx.Err();err != nil{
+		return zero,err
+	}
+	view,err := t.group.Get(key)
+	if err != nil{
+		return zero,err
+	}
+	v,err := t.codec.Decode(view.b)
+	if err != nil{
+		return zero,&DecodeError{Group: t.group.Name(),Key: key,Err: err}
+	}
+	return v,nil
+}
+
+// cache v for key in this node, it expires after the group ttl
+func (t *TypedGroup[T])Set(key string,v T)error{
+	return t.SetWithTTL(key,v,t.group.ttl)
+}
+
+// same as Set, but v expires after ttl, ttl <= 0 means never expire
+func (t *TypedGroup[T])SetWithTTL(key string,v T,ttl time.Duration)error{
+	b,err := t.codec.Encode(v)
+	if err != nil{
+		return fmt.Errorf("encode %s/%s: %w",t.group.Name(),key,err)
+	}
+	return t.group.SetWithTTL(key,b,ttl)
+}
+
+// remove key from the cache of this node, return true if it was cached
+func (t *TypedGroup[T])Delete(key string)bool{
+	return t.group.Delete(key)
+}
+
+// adapts a TypedGetter to the byte getter of a group
+type typedGetter[T any] struct{
+	get TypedGetter[T]
+	codec Codec[T]
+}
+
+func (g typedGetter[T])Get(key string)([]byte,error){
+	return g.GetContext(context.Background(),key)
+}
+
+func (g typedGetter[T])GetContext(ctx context.Context,key string)([]byte,error){
+	v,err := g.get(ctx,key)
+	if err != nil{
+		return nil,err
+	}
+	b,err := g.codec.Encode(v)
+	if err != nil{
+		return nil,fmt.Errorf("encode %s: %w",key,err)
+	}
+	return b,nil
+}
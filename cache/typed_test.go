@@ -0,0 +1,82 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type player struct {
+	Name  string `json:"name"`
+	Score int    `json:"score"`
+}
+
+// run the same checks against a typed group of players with every codec
+func TestTypedGroup(t *testing.T) {
+	codecs := map[string]Codec[player]{
+		"json":    JSONCodec[player]{},
+		"gob":     GobCodec[player]{},
+		"msgpack": MsgpackCodec[player]{},
+	}
+	for name, codec := range codecs {
+		t.Run(name, func(t *testing.T) {
+			loads := 0
+			g := NewTypedGroup("typed-"+name, 2<<10, codec, func(ctx context.Context, key string) (player, error) {
+				if ctx == nil {
+					t.Fatal("expect a context")
+				}
+				if key == "nobody" {
+					return player{}, fmt.Errorf("%s: %w", key, ErrNotFound)
+				}
+				loads++
+				return player{Name: key, Score: len(key) * 100}, nil
+			})
+
+			for i := 0; i < 2; i++ {
+				p, err := g.Get(context.Background(), "Tom")
+				if err != nil || p != (player{Name: "Tom", Score: 300}) {
+					t.Fatalf("expect Tom, got %+v %v", p, err)
+				}
+			}
+			if loads != 1 {
+				t.Fatalf("expect the second get to hit the cache, got %d loads", loads)
+			}
+
+			if err := g.Set("Jack", player{Name: "Jack", Score: 589}); err != nil {
+				t.Fatal(err)
+			}
+			if p, err := g.Get(context.Background(), "Jack"); err != nil || p.Score != 589 {
+				t.Fatalf("expect the value set, got %+v %v", p, err)
+			}
+
+			// getter errors and decode errors can be told apart
+			if _, err := g.Get(context.Background(), "nobody"); !errors.Is(err, ErrNotFound) {
+				t.Fatalf("expect not found, got %v", err)
+			}
+			g.Group().Set("broken", []byte{0xc1, 0xff, 0x00})
+			var decodeErr *DecodeError
+			if _, err := g.Get(context.Background(), "broken"); !errors.As(err, &decodeErr) || decodeErr.Key != "broken" {
+				t.Fatalf("expect decode error, got %v", err)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			if _, err := g.Get(ctx, "Sam"); err != context.Canceled {
+				t.Fatalf("expect canceled, got %v", err)
+			}
+		})
+	}
+}
+
+func TestProtoCodec(t *testing.T) {
+	g := NewTypedGroup[*wrapperspb.StringValue]("typed-proto", 2<<10, ProtoCodec[*wrapperspb.StringValue]{}, func(ctx context.Context, key string) (*wrapperspb.StringValue, error) {
+		return wrapperspb.String(db[key]), nil
+	})
+	v, err := g.Get(context.Background(), "Tom")
+	if err != nil || v.GetValue() != "630" {
+		t.Fatalf("expect 630, got %v %v", v, err)
+	}
+}
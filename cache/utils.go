@@ -1,60 +1,582 @@
 package cache
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
 // create a group, we can accept different name for group name
-func CreateGroup(groupName string, fn Getter,cacheSize int64)*Group{
-	return NewGroup(groupName,cacheSize,fn)
+func CreateGroup(groupName string, fn Getter,cacheSize int64, opts ...GroupOption)*Group{
+	return NewGroup(groupName,cacheSize,fn,opts...)
 }
 
-// start a cache server, user will not sense it. this will only expose to peer node
-func StartCacheServer(addr string, port string, addrs[]string, mainCache *Group){
+// largest value the api server accepts in a single PUT
+const maxAPIValueBytes = 32<<20
+
+// ServerOption configures the servers created by NewCacheServer and NewAPIServer
+type ServerOption func(*serverOptions)
+
+type serverOptions struct{
+	peerTimeout time.Duration // time limit of requests to peers
+	readTimeout time.Duration // time limit to read a request
+	writeTimeout time.Duration // time limit to write a response
+	peerWeights map[string]int // weight of peers on the ring, missing peers have weight 1
+	loadBound float64 // epsilon of bounded load peer selection, 0 disables it
+	newSelector func()PeerSelector // how keys are mapped to peers, nil means the hash ring
+	handoffRate int64 // bytes per second of key handoff when peers change, 0 disables it
+	certFile string // certificate and key of the node, empty serves plain http
+	keyFile string
+	caFile string // CA of peer certificates, turns on mutual tls between cache servers
+	auth Authenticator // identifies api callers, nil serves everyone
+	acl *ACL // what every api caller may do, nil allows everything to authenticated callers
+	peerKeys []PeerKey // secrets of peer request signing, empty leaves the cache server open
+	clientRate float64 // api requests per second of every client, 0 means no limit
+	clientBurst int
+	groupRate float64 // api requests per second of every group, 0 means no limit
+	groupBurst int
+	maxPeerInFlight int // peer fetches served at once before the rest queue, 0 means no limit
+	peerQueueTarget time.Duration // peer fetches queued longer than this get shed
+}
+
+// limit how long a request to a peer may take, 0 means no limit
+func WithPeerTimeout(timeout time.Duration)ServerOption{
+	return func(o *serverOptions){
+		o.peerTimeout = timeout
+	}
+}
+
+// limit how long the server waits for a request and how long it may take to write the response
+func WithServerTimeouts(read time.Duration,write time.Duration)ServerOption{
+	return func(o *serverOptions){
+		o.readTimeout = read
+		o.writeTimeout = write
+	}
+}
+
+// give peers of a cache server different weights on the ring, peers not in weights get weight 1
+func WithPeerWeights(weights map[string]int)ServerOption{
+	return func(o *serverOptions){
+		o.peerWeights = weights
+	}
+}
+
+// pick peers with consistent hashing with bounded loads, no peer gets more than (1+epsilon) times its share
+func WithBoundedLoad(epsilon float64)ServerOption{
+	return func(o *serverOptions){
+		o.loadBound = epsilon
+	}
+}
+
+// choose how a cache server maps keys to peers, like NewRendezvousSelector or NewJumpSelector
+func WithPeerSelector(newSelector func()PeerSelector)ServerOption{
+	return func(o *serverOptions){
+		o.newSelector = newSelector
+	}
+}
+
+// stream cached keys to their new owner when peers join or leave, at most bytesPerSecond, 0 disables it
+// a cache server that shuts down also hands its keys to the peers taking them over
+func WithHandoff(bytesPerSecond int64)ServerOption{
+	return func(o *serverOptions){
+		o.handoffRate = bytesPerSecond
+	}
+}
+
+// serve https with the certificate and key in the given pem files, they are reloaded when they change
+// cache servers with a caFile also require mutual tls: peers must present a certificate signed by the CA,
+// and requests to peers present our certificate and verify theirs with the CA, peer addresses must be https
+// the api server only uses the certificate, users do not need one
+func WithTLS(certFile string,keyFile string,caFile string)ServerOption{
+	return func(o *serverOptions){
+		o.certFile = certFile
+		o.keyFile = keyFile
+		o.caFile = caFile
+	}
+}
+
+// require api callers to authenticate with auth, and to have the permission acl gives them for the group they use
+// reading values needs PermRead, setting and deleting PermWrite, /api/stats and /api/memory only show groups with PermAdmin
+// callers without valid credentials get 401, callers without permission 403, a nil acl allows everything
+func WithAuth(auth Authenticator,acl *ACL)ServerOption{
+	return func(o *serverOptions){
+		o.auth = auth
+		o.acl = acl
+	}
+}
+
+// sign requests to peers with the first key and only answer peers that signed with one of the keys
+// list the old and new key during a rotation, so nodes that have not switched yet are still accepted
+func WithPeerKeys(keys ...PeerKey)ServerOption{
+	return func(o *serverOptions){
+		o.peerKeys = keys
+	}
+}
+
+// limit every api client address to rate requests per second with bursts of up to burst requests,
+// callers over the limit get 429 with Retry-After. requests are counted before authentication, failed ones too
+func WithClientRateLimit(rate float64,burst int)ServerOption{
+	return func(o *serverOptions){
+		o.clientRate,o.clientBurst = rate,burst
+	}
+}
+
+// limit the api requests to every group to rate per second with bursts of up to burst, over the limit gets 429
+func WithGroupRateLimit(rate float64,burst int)ServerOption{
+	return func(o *serverOptions){
+		o.groupRate,o.groupBurst = rate,burst
+	}
+}
+
+// serve at most maxInFlight peer fetches at once, the others wait in a queue
+// when requests keep waiting longer than target the cache server sheds new ones with 503 and Retry-After,
+// so peers fall back to a replica or the database instead of piling up, maxInFlight <= 0 turns it off
+func WithLoadShedding(maxInFlight int,target time.Duration)ServerOption{
+	return func(o *serverOptions){
+		o.maxPeerInFlight,o.peerQueueTarget = maxInFlight,target
+	}
+}
+
+func buildServerOptions(opts []ServerOption)serverOptions{
+	var o serverOptions
+	for _,opt := range opts{
+		opt(&o)
+	}
+	return o
+}
+
+// Server is a http server of a cache node or api front end that can be shut down gracefully
+type Server struct{
+	httpServer *http.Server
+	networkController *NetworkController // only set for cache servers
+}
+
+// serve requests until Shutdown is called, a graceful shutdown returns nil
+// a cache server announces itself to its peers once it listens, so peers it left before take it back
+func (s *Server)ListenAndServe()error{
+	addr := s.httpServer.Addr
+	if addr == ""{
+		addr = ":http"
+	}
+	ln,err := net.Listen("tcp",addr)
+	if err != nil{
+		return err
+	}
+	if s.networkController != nil{
+		go s.networkController.Register(context.Background())
+	}
+	if s.httpServer.TLSConfig != nil{
+		// certificates come from the tls config
+		err = s.httpServer.ServeTLS(ln,"","")
+	}else{
+		err = s.httpServer.Serve(ln)
+	}
+	if err != http.ErrServerClosed{
+		return err
+	}
+	return nil
+}
+
+// tls config of a server, nil for plain http
+func (o *serverOptions)serverTLS(mutual bool)(*certReloader,*tls.Config,error){
+	if o.certFile == "" && o.keyFile == ""{
+		return nil,nil,nil
+	}
+	r,err := newCertReloader(o.certFile,o.keyFile,o.caFile)
+	if err != nil{
+		return nil,nil,err
+	}
+	return r,r.serverConfig(mutual),nil
+}
+
+// peer picker of a cache server, register it with every other group this node serves
+func (s *Server)Peers()*NetworkController{
+	return s.networkController
+}
+
+// stop taking new requests and wait for in-flight ones to finish
+// a cache server tells its peers that it is leaving before it stops
+func (s *Server)Shutdown(ctx context.Context)error{
+	if s.networkController != nil{
+		// our keys stay warm on the peers that own them once we are gone
+		if err := s.networkController.handoffLeaving(ctx);err != nil{
+			s.networkController.Log("Handoff before leaving failed: %v",err)
+		}
+		// peers that did not hear from us will fall back to the database after a failed fetch
+		s.networkController.Deregister(ctx)
+	}
+	return s.httpServer.Shutdown(ctx)
+}
+
+// create a cache server, user will not sense it. this will only expose to peer node
+// it fails if the tls files can not be loaded
+func NewCacheServer(addr string, port string, addrs[]string, mainCache *Group, opts ...ServerOption)(*Server,error){
+	o := buildServerOptions(opts)
+	certs,tlsConfig,err := o.serverTLS(true)
+	if err != nil{
+		return nil,err
+	}
 	r := gin.Default()
 	networkController := NewNetworkController(addr)
-	networkController.Set(addrs...)
+	if certs != nil{
+		networkController.SetTLS(certs.clientConfig())
+	}
+	// peers are authenticated by signed requests or by client certificates of mutual tls
+	peerAuth := len(o.peerKeys) > 0 || (certs != nil && o.caFile != "")
+	networkController.authenticated = peerAuth
+	networkController.SetTimeout(o.peerTimeout)
+	networkController.SetLoadBound(o.loadBound)
+	if peerAuth{
+		networkController.SetHandoffRate(o.handoffRate)
+	}else if o.handoffRate > 0{
+		networkController.Log("Handoff needs peer keys or mutual tls, it is turned off")
+	}
+	networkController.SetPeerKeys(o.peerKeys...)
+	networkController.SetLoadShedding(o.maxPeerInFlight,o.peerQueueTarget)
+	if o.newSelector != nil{
+		networkController.SetSelector(o.newSelector)
+	}
+	peers := make([]Peer,len(addrs))
+	for i,peerAddr := range addrs{
+		peers[i] = Peer{Addr: peerAddr,Weight: o.peerWeights[peerAddr]}
+	}
+	networkController.SetPeers(peers...)
 	queryPath := networkController.basePath+":group/:key"
 	mainCache.RegisterPeers(networkController)
 	log.Println(queryPath)
+	// only peers holding one of our keys may fetch, push or transfer keys
+	r.Use(func(ctx *gin.Context) {
+		if err := networkController.VerifyPeer(ctx.Request);err != nil{
+			networkController.Log("Rejected peer request from %s: %v",ctx.ClientIP(),err)
+			ctx.String(http.StatusUnauthorized,"unauthorized")
+			ctx.Abort()
+		}
+	})
 	r.GET(queryPath,func(ctx *gin.Context) {
 		log.Println("Recieved a fetch request from peer node")
+		release,retryAfter,ok := networkController.admit(ctx.Request.Context())
+		if !ok{
+			setRetryAfter(ctx.Writer.Header(),retryAfter)
+			ctx.String(http.StatusServiceUnavailable,"overloaded")
+			return
+		}
+		defer release()
+		defer networkController.trackServe()()
 		groupName := ctx.Param("group")
 		key := ctx.Param("key")
 		group := GetGroup(groupName)
 		if group == nil{
-			ctx.String(http.StatusNotFound,"no such group")
+			ctx.String(statusNoSuchGroup,"no such group")
+			return
+		}
+		servePeerValue(ctx.Writer,ctx.Request,group,key)
+	})
+	// peers write our caches and change the ring, so only authenticated peers may
+	if peerAuth{
+		registerWriteRoutes(r,networkController)
+		registerPeersRoutes(r,networkController)
+	}
+	return &Server{
+		httpServer: &http.Server{Addr: port,Handler: r,ReadTimeout: o.readTimeout,WriteTimeout: o.writeTimeout,TLSConfig: tlsConfig},
+		networkController: networkController,
+	},nil
+}
+
+// serve the routes peers write our caches through: pushes of replicas and keys handed off to us
+func registerWriteRoutes(r *gin.Engine,networkController *NetworkController){
+	// a replica that loaded a key from the database pushes it to us
+	r.PUT(networkController.basePath+":group/:key",func(ctx *gin.Context) {
+		group := GetGroup(ctx.Param("group"))
+		if group == nil{
+			ctx.String(statusNoSuchGroup,"no such group")
 			return
 		}
-		view, err := group.Get(key)
+		value,err := io.ReadAll(http.MaxBytesReader(ctx.Writer,ctx.Request.Body,maxAPIValueBytes))
 		if err != nil{
-			ctx.String(http.StatusInternalServerError,err.Error())
-			return 
+			ctx.String(http.StatusRequestEntityTooLarge,err.Error())
+			return
 		}
-		ctx.Header("Content-Type","application/octet-stream")
-		ctx.String(http.StatusOK,view.String())
+		if err := group.Set(ctx.Param("key"),value);err != nil{
+			if errors.Is(err,ErrValueTooLarge){
+				ctx.String(http.StatusRequestEntityTooLarge,err.Error())
+				return
+			}
+			ctx.String(http.StatusBadRequest,err.Error())
+			return
+		}
+		ctx.Status(http.StatusNoContent)
+	})
+	// a previous owner streams the keys we took over
+	r.POST(networkController.basePath+transferPath+"/:group",func(ctx *gin.Context) {
+		group := GetGroup(ctx.Param("group"))
+		if group == nil{
+			ctx.String(statusNoSuchGroup,"no such group")
+			return
+		}
+		n,err := group.receiveEntries(ctx.Request.Body,maxAPIValueBytes)
+		if err != nil{
+			ctx.String(http.StatusBadRequest,err.Error())
+			return
+		}
+		ctx.String(http.StatusOK,strconv.Itoa(n))
 	})
-	r.Run(port)
 }
 
+// serve the peers path, a leaving peer takes itself off the ring and a peer that left comes back
+func registerPeersRoutes(r *gin.Engine,networkController *NetworkController){
+	// a leaving peer asks us to take it off the ring
+	r.DELETE(networkController.basePath+peersPath,func(ctx *gin.Context) {
+		peer := ctx.Query("peer")
+		if peer == ""{
+			ctx.String(http.StatusBadRequest,"peer is required")
+			return
+		}
+		networkController.Remove(peer)
+		ctx.String(http.StatusOK,"")
+	})
+	// a peer that left announces itself again when it starts
+	r.POST(networkController.basePath+peersPath,func(ctx *gin.Context) {
+		peer := ctx.Query("peer")
+		weight,err := strconv.Atoi(ctx.DefaultQuery("weight","1"))
+		if peer == "" || err != nil || weight < 1 || weight > MaxPeerWeight{
+			ctx.String(http.StatusBadRequest,"peer and a weight in 1..%d are required",MaxPeerWeight)
+			return
+		}
+		if err := networkController.Add(peer,weight);err != nil{
+			ctx.String(http.StatusForbidden,err.Error())
+			return
+		}
+		ctx.String(http.StatusOK,"")
+	})
+}
 
-// start a front end interaction, this address and port will be exposed to user
-func StartAPIServer(apiAddr string,port string, cache*Group){
+// start a cache server and block until it stops
+func StartCacheServer(addr string, port string, addrs[]string, mainCache *Group){
+	server,err := NewCacheServer(addr,port,addrs,mainCache)
+	if err == nil{
+		err = server.ListenAndServe()
+	}
+	if err != nil{
+		log.Fatal(err)
+	}
+}
+
+// gin context key of the authenticated api caller
+const principalKey = "gocache.principal"
+
+// answer a failed api get, only a value over the size limit of its group says why
+func apiError(ctx *gin.Context,err error){
+	status := valueErrorStatus(err)
+	if status == http.StatusRequestEntityTooLarge{
+		ctx.String(status,err.Error())
+		return
+	}
+	ctx.String(status,"")
+}
+
+// create a front end interaction, this address and port will be exposed to user
+// it fails if the tls files can not be loaded
+func NewAPIServer(apiAddr string,port string, cache*Group, opts ...ServerOption)(*Server,error){
+	o := buildServerOptions(opts)
+	_,tlsConfig,err := o.serverTLS(false)
+	if err != nil{
+		return nil,err
+	}
 	r := gin.Default()
+	clients := newRateLimiter(o.clientRate,o.clientBurst)
+	groups := newRateLimiter(o.groupRate,o.groupBurst)
+	// reject callers over their rate, the others still get through
+	limited := func(ctx *gin.Context,limiter *rateLimiter,key string)bool{
+		ok,retryAfter := limiter.allow(key,time.Now())
+		if !ok{
+			setRetryAfter(ctx.Writer.Header(),retryAfter)
+			ctx.String(http.StatusTooManyRequests,"too many requests")
+		}
+		return !ok
+	}
+	// clients are limited by address before they are authenticated, so failed guesses of tokens count too
+	if clients != nil{
+		r.Use(func(ctx *gin.Context) {
+			if limited(ctx,clients,ctx.ClientIP()){
+				ctx.Abort()
+			}
+		})
+	}
+	if o.auth != nil{
+		r.Use(func(ctx *gin.Context) {
+			principal,err := o.auth.Authenticate(ctx.Request)
+			if err != nil{
+				ctx.Header("WWW-Authenticate",`Bearer realm="gocache"`)
+				ctx.String(http.StatusUnauthorized,"unauthorized")
+				ctx.Abort()
+				return
+			}
+			ctx.Set(principalKey,principal)
+		})
+	}
+	// check the caller may use group with perm
+	allowed := func(ctx *gin.Context,group string,perm Permission)bool{
+		return o.auth == nil || o.acl == nil || o.acl.Allowed(ctx.GetString(principalKey),group,perm)
+	}
+	// pick the group named in the query, or the default group of this server
+	// the permission is checked before the group is looked up, so callers can not probe for groups
+	// only groups that exist are rate limited, so made up names do not take buckets
+	groupOf := func(ctx *gin.Context,perm Permission)*Group{
+		name := ctx.Query("group")
+		if name == ""{
+			name = cache.Name()
+		}
+		if !allowed(ctx,name,perm){
+			ctx.String(http.StatusForbidden,"forbidden")
+			return nil
+		}
+		group := cache
+		if name != cache.Name(){
+			group = GetGroup(name)
+		}
+		if group == nil{
+			ctx.String(http.StatusNotFound,"no such group")
+			return nil
+		}
+		if limited(ctx,groups,name){
+			return nil
+		}
+		return group
+	}
 	r.GET("/api",func(ctx *gin.Context) {
+		group := groupOf(ctx,PermRead)
+		if group == nil{
+			return
+		}
 		key := ctx.DefaultQuery("key","Tom")
-		view,err := cache.Get(key)
+		// values of passthrough groups may be too large to hold, they are streamed in chunks
+		if group.passthrough{
+			ctx.Header("Content-Type","application/octet-stream")
+			started,err := serveStream(ctx.Writer,func(w io.Writer)(int64,error){
+				return group.Stream(ctx.Request.Context(),key,w)
+			})
+			if err != nil && !started{
+				apiError(ctx,err)
+			}
+			return
+		}
+		view,err := group.Get(key)
 		if err != nil{
-			ctx.String(http.StatusInternalServerError,"")
+			apiError(ctx,err)
 			return
 		}
+		// the cached bytes are written as they are, large values are not copied
 		ctx.Header("Content-Type","application/octet-stream")
-		ctx.String(http.StatusOK,view.String())
+		ctx.Header("Content-Length",strconv.Itoa(view.Len()))
+		ctx.Status(http.StatusOK)
+		view.WriteTo(ctx.Writer)
+	})
+	// store the request body as value of key, ttl is optional like "30s"
+	r.PUT("/api",func(ctx *gin.Context) {
+		group := groupOf(ctx,PermWrite)
+		if group == nil{
+			return
+		}
+		ttl := group.ttl
+		if v := ctx.Query("ttl");v != ""{
+			parsed,err := time.ParseDuration(v)
+			if err != nil{
+				ctx.String(http.StatusBadRequest,"invalid ttl")
+				return
+			}
+			ttl = parsed
+		}
+		value,err := io.ReadAll(http.MaxBytesReader(ctx.Writer,ctx.Request.Body,maxAPIValueBytes))
+		if err != nil{
+			ctx.String(http.StatusRequestEntityTooLarge,err.Error())
+			return
+		}
+		if err := group.SetWithTTL(ctx.Query("key"),value,ttl);err != nil{
+			if errors.Is(err,ErrValueTooLarge){
+				ctx.String(http.StatusRequestEntityTooLarge,err.Error())
+				return
+			}
+			ctx.String(http.StatusBadRequest,err.Error())
+			return
+		}
+		ctx.Status(http.StatusNoContent)
+	})
+	r.DELETE("/api",func(ctx *gin.Context) {
+		group := groupOf(ctx,PermWrite)
+		if group == nil{
+			return
+		}
+		if !group.Delete(ctx.Query("key")){
+			ctx.Status(http.StatusNotFound)
+			return
+		}
+		ctx.Status(http.StatusNoContent)
+	})
+	// groups the caller may read
+	r.GET("/api/groups",func(ctx *gin.Context) {
+		names := []string{}
+		for _,name := range GroupNames(){
+			if allowed(ctx,name,PermRead){
+				names = append(names, name)
+			}
+		}
+		ctx.JSON(http.StatusOK,names)
+	})
+	// counters of every group served by this node that the caller administers
+	r.GET("/api/stats",func(ctx *gin.Context) {
+		stats := make(map[string]Stats)
+		for _,name := range GroupNames(){
+			if !allowed(ctx,name,PermAdmin){
+				continue
+			}
+			if group := GetGroup(name);group != nil{
+				stats[name] = group.Stats()
+			}
+		}
+		ctx.JSON(http.StatusOK,stats)
 	})
-	r.Run(port)
+	// memory budget of the node, with the groups the caller administers
+	r.GET("/api/memory",func(ctx *gin.Context) {
+		stats := GetMemoryStats()
+		for name := range stats.Groups{
+			if !allowed(ctx,name,PermAdmin){
+				delete(stats.Groups,name)
+			}
+		}
+		ctx.JSON(http.StatusOK,stats)
+	})
+	return &Server{httpServer: &http.Server{Addr: port,Handler: r,ReadTimeout: o.readTimeout,WriteTimeout: o.writeTimeout,TLSConfig: tlsConfig}},nil
 }
 
+// start a front end server and block until it stops
+func StartAPIServer(apiAddr string,port string, cache*Group){
+	server,err := NewAPIServer(apiAddr,port,cache)
+	if err == nil{
+		err = server.ListenAndServe()
+	}
+	if err != nil{
+		log.Fatal(err)
+	}
+}
 
+// start a redis protocol front end, redis clients start on the given group and can SELECT others
+func StartRESPServer(port string, cache *Group){
+	server := NewRESPServer(cache.Name())
+	log.Println("RESP server listening on",port)
+	log.Fatal(server.ListenAndServe(port))
+}
+
+// start a memcached ascii protocol front end for a group
+func StartMemcachedServer(port string, cache *Group){
+	server := NewMemcachedServer(cache)
+	log.Println("Memcached server listening on",port)
+	log.Fatal(server.ListenAndServe(port))
+}
@@ -0,0 +1,68 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// send one request to handler and return the recorded response
+func serveAPI(handler http.Handler, method string, target string, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+	return w
+}
+
+func TestAPIServer(t *testing.T) {
+	g := NewGroup("api", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		if v, ok := db[key]; ok {
+			return []byte(v), nil
+		}
+		return nil, fmt.Errorf("%s: %w", key, ErrNotFound)
+	}))
+	server, err := NewAPIServer("", ":0", g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := server.httpServer.Handler
+
+	cases := []struct {
+		method, target, body string
+		code                 int
+		expect               string
+	}{
+		{"GET", "/api?key=Tom", "", http.StatusOK, "630"},
+		{"GET", "/api?key=unknown", "", http.StatusNotFound, ""},
+		{"GET", "/api?key=Tom&group=nope", "", http.StatusNotFound, "no such group"},
+		{"PUT", "/api?key=k", "v", http.StatusNoContent, ""},
+		{"PUT", "/api?key=k2&ttl=soon", "v", http.StatusBadRequest, "invalid ttl"},
+		{"GET", "/api?key=k&group=api", "", http.StatusOK, "v"},
+		{"DELETE", "/api?key=k", "", http.StatusNoContent, ""},
+		{"DELETE", "/api?key=k", "", http.StatusNotFound, ""},
+	}
+	for _, c := range cases {
+		w := serveAPI(handler, c.method, c.target, c.body)
+		if w.Code != c.code || w.Body.String() != c.expect {
+			t.Fatalf("%s %s: expect %d %q, got %d %q", c.method, c.target, c.code, c.expect, w.Code, w.Body.String())
+		}
+	}
+
+	var names []string
+	if err := json.Unmarshal(serveAPI(handler, "GET", "/api/groups", "").Body.Bytes(), &names); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(strings.Join(names, ","), "api") {
+		t.Fatalf("expect group api in %v", names)
+	}
+
+	var stats map[string]Stats
+	if err := json.Unmarshal(serveAPI(handler, "GET", "/api/stats", "").Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if st := stats["api"]; st.Gets != 3 || st.LocalLoads != 1 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bufio"
+	"cache"
+	"cache/config"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const usage = `usage: gocache-cli [flags] <command> [args]
+
+commands:
+  get <key>            fetch a value (through the api server, or the owning node with -direct)
+  set <key> <value>    store a value in the api node, -ttl sets its time to live
+  del <key>            remove a key from the api node
+  groups               list the groups of the api node
+  stats                dump the counters of every group as json
+  memory               dump the memory budget of the api node and what its groups use as json
+  owner <key>          show which node owns key on the ring
+  warmup <file>        load every key of file, one per line, "key<TAB>value" lines are stored instead
+
+flags:
+`
+
+// cli settings shared by every command
+type client struct{
+	api string // base address of the api server
+	group string
+	peers []cache.Peer // cluster members with their weights, used to find the owner of a key
+	selector string // how the cluster maps keys to peers
+	direct bool // fetch from the owning node instead of the api server
+	ttl time.Duration
+	concurrency int
+	token string // bearer token of the api server
+	hmacID string // key id and secret requests are signed with
+	hmacSecret []byte
+	peerKey *cache.PeerKey // signs -direct requests like a peer of the cluster does
+	http *http.Client
+}
+
+func main(){
+	c := &client{}
+	var configPath string
+	var peers string
+	flag.StringVar(&c.api,"api","http://localhost:9999","Api server address")
+	flag.StringVar(&c.group,"group","","Group name, defaults to the group of the api server")
+	flag.StringVar(&configPath,"config","","Config file to read peers and api address from")
+	flag.StringVar(&peers,"peers","","Comma separated peer addresses (addr or addr#weight), overrides -config")
+	flag.StringVar(&c.selector,"selector","ring","Peer selector of the cluster: ring, rendezvous or jump")
+	flag.BoolVar(&c.direct,"direct",false,"get: ask the node owning the key instead of the api server")
+	flag.DurationVar(&c.ttl,"ttl",0,"set: time to live of the value, 0 uses the group default")
+	flag.IntVar(&c.concurrency,"c",8,"warmup: number of concurrent requests")
+	timeout := flag.Duration("timeout",5*time.Second,"Time limit of every request")
+	var certFile,keyFile,caFile string
+	flag.StringVar(&certFile,"cert","","Client certificate for nodes that require mutual tls")
+	flag.StringVar(&keyFile,"key","","Key of the client certificate")
+	flag.StringVar(&caFile,"cacert","","CA that signed the node certificates, defaults to the system roots")
+	flag.StringVar(&c.token,"token","","Api token sent as \"Authorization: Bearer <token>\"")
+	hmacKey := flag.String("hmac","","Sign api requests with key id:secret")
+	flag.Usage = func(){
+		fmt.Fprint(flag.CommandLine.Output(),usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if configPath != ""{
+		conf,err := config.Load(configPath)
+		if err != nil{
+			fail(err)
+		}
+		for _,peer := range conf.Peers{
+			c.peers = append(c.peers, cache.Peer{Addr: peer.Addr,Weight: peer.Weight})
+		}
+		if !flagSet("selector"){
+			c.selector = conf.Selector
+		}
+		// an explicit -api wins over the config
+		if !flagSet("api") && conf.API.Addr != ""{
+			c.api = conf.API.Addr
+		}
+		if c.group == "" && len(conf.Groups) > 0{
+			c.group = conf.Groups[0].Name
+		}
+		// a node config lets the cli talk to the nodes like a peer does
+		if !flagSet("cert") && !flagSet("key"){
+			certFile,keyFile = conf.TLS.CertFile,conf.TLS.KeyFile
+		}
+		if !flagSet("cacert"){
+			caFile = conf.TLS.CAFile
+		}
+		if len(conf.PeerKeys) > 0{
+			c.peerKey = &cache.PeerKey{ID: conf.PeerKeys[0].ID,Secret: []byte(conf.PeerKeys[0].Secret)}
+		}
+	}
+	if peers != ""{
+		c.peers = nil
+		for _,s := range strings.Split(peers,","){
+			peer,err := config.ParsePeer(s)
+			if err != nil{
+				fail(err)
+			}
+			c.peers = append(c.peers, cache.Peer{Addr: peer.Addr,Weight: peer.Weight})
+		}
+	}
+	if c.group == "" && c.direct{
+		fail(fmt.Errorf("-direct needs -group or -config"))
+	}
+	if c.concurrency < 1{
+		fail(fmt.Errorf("-c must be at least 1"))
+	}
+	if *hmacKey != ""{
+		id,secret,ok := strings.Cut(*hmacKey,":")
+		if !ok || id == "" || secret == ""{
+			fail(fmt.Errorf("-hmac must be id:secret"))
+		}
+		c.hmacID,c.hmacSecret = id,[]byte(secret)
+	}
+	c.api = strings.TrimRight(c.api,"/")
+	c.http = &http.Client{Timeout: *timeout}
+	if certFile != "" || caFile != ""{
+		config,err := cache.LoadClientTLS(certFile,keyFile,caFile)
+		if err != nil{
+			fail(err)
+		}
+		c.http.Transport = &http.Transport{TLSClientConfig: config}
+	}
+
+	args := flag.Args()
+	if len(args) == 0{
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := c.run(args[0],args[1:]);err != nil{
+		fail(err)
+	}
+}
+
+// execute one command
+func (c *client)run(cmd string,args []string)error{
+	need := func(n int)error{
+		if len(args) != n{
+			return fmt.Errorf("%s takes %d argument(s)",cmd,n)
+		}
+		return nil
+	}
+	switch cmd{
+	case "get":
+		if err := need(1);err != nil{
+			return err
+		}
+		value,err := c.get(args[0])
+		if err != nil{
+			return err
+		}
+		os.Stdout.Write(value)
+		fmt.Println()
+	case "set":
+		if err := need(2);err != nil{
+			return err
+		}
+		return c.set(args[0],args[1])
+	case "del":
+		if err := need(1);err != nil{
+			return err
+		}
+		_,err := c.do(http.MethodDelete,c.apiURL("/api",args[0]),nil)
+		return err
+	case "groups":
+		body,err := c.do(http.MethodGet,c.api+"/api/groups",nil)
+		if err != nil{
+			return err
+		}
+		var names []string
+		if err := json.Unmarshal(body,&names);err != nil{
+			return err
+		}
+		fmt.Println(strings.Join(names,"\n"))
+	case "stats":
+		body,err := c.do(http.MethodGet,c.api+"/api/stats",nil)
+		if err != nil{
+			return err
+		}
+		var stats map[string]cache.Stats
+		if err := json.Unmarshal(body,&stats);err != nil{
+			return err
+		}
+		out,_ := json.MarshalIndent(stats,"","  ")
+		fmt.Println(string(out))
+	case "memory":
+		body,err := c.do(http.MethodGet,c.api+"/api/memory",nil)
+		if err != nil{
+			return err
+		}
+		var stats cache.MemoryStats
+		if err := json.Unmarshal(body,&stats);err != nil{
+			return err
+		}
+		out,_ := json.MarshalIndent(stats,"","  ")
+		fmt.Println(string(out))
+	case "owner":
+		if err := need(1);err != nil{
+			return err
+		}
+		owner,err := c.owner(args[0])
+		if err != nil{
+			return err
+		}
+		fmt.Println(owner)
+	case "warmup":
+		if err := need(1);err != nil{
+			return err
+		}
+		return c.warmup(args[0])
+	default:
+		return fmt.Errorf("unknown command %q",cmd)
+	}
+	return nil
+}
+
+// fetch a key from the api server, or straight from the peer endpoint of its owner
+func (c *client)get(key string)([]byte,error){
+	if !c.direct{
+		return c.do(http.MethodGet,c.apiURL("/api",key),nil)
+	}
+	owner,err := c.owner(key)
+	if err != nil{
+		return nil,err
+	}
+	u := fmt.Sprintf("%s/_gocache/%s/%s",strings.TrimRight(owner,"/"),url.PathEscape(c.group),url.PathEscape(key))
+	req,err := http.NewRequest(http.MethodGet,u,nil)
+	if err != nil{
+		return nil,err
+	}
+	// nodes with peer keys only answer signed requests
+	if c.peerKey != nil{
+		if err := cache.SignPeerRequest(req,*c.peerKey);err != nil{
+			return nil,err
+		}
+	}
+	return c.send(req)
+}
+
+func (c *client)set(key string,value string)error{
+	u := c.apiURL("/api",key)
+	if c.ttl > 0{
+		u += "&ttl="+url.QueryEscape(c.ttl.String())
+	}
+	_,err := c.do(http.MethodPut,u,strings.NewReader(value))
+	return err
+}
+
+// find the owner of key with the same ring the nodes use
+func (c *client)owner(key string)(string,error){
+	if len(c.peers) == 0{
+		return "",fmt.Errorf("owner lookup needs -peers or -config")
+	}
+	newSelector,err := cache.SelectorByName(c.selector)
+	if err != nil{
+		return "",err
+	}
+	ring := cache.NewNetworkController("")
+	ring.SetSelector(newSelector)
+	ring.SetPeers(c.peers...)
+	return ring.Owner(key),nil
+}
+
+// load or store every key of file with a bounded number of concurrent requests
+func (c *client)warmup(path string)error{
+	f,err := os.Open(path)
+	if err != nil{
+		return err
+	}
+	defer f.Close()
+
+	lines := make(chan string)
+	var ok,failed atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0;i < c.concurrency;i++{
+		wg.Add(1)
+		go func(){
+			defer wg.Done()
+			for line := range lines{
+				var err error
+				if key,value,found := strings.Cut(line,"\t");found{
+					err = c.set(key,value)
+				}else{
+					_,err = c.get(line)
+				}
+				if err != nil{
+					fmt.Fprintf(os.Stderr,"%s: %v\n",line,err)
+					failed.Add(1)
+					continue
+				}
+				ok.Add(1)
+			}
+		}()
+	}
+
+	start := time.Now()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan(){
+		if line := strings.TrimSpace(scanner.Text());line != "" && !strings.HasPrefix(line,"#"){
+			lines <- line
+		}
+	}
+	close(lines)
+	wg.Wait()
+	fmt.Printf("warmed up %d keys in %v, %d failed\n",ok.Load(),time.Since(start).Round(time.Millisecond),failed.Load())
+	return scanner.Err()
+}
+
+// url of an api endpoint for key in the selected group
+func (c *client)apiURL(path string,key string)string{
+	q := url.Values{"key": {key}}
+	if c.group != ""{
+		q.Set("group",c.group)
+	}
+	return c.api+path+"?"+q.Encode()
+}
+
+// send an api request with the credentials of the cli
+func (c *client)do(method string,u string,body io.Reader)([]byte,error){
+	req,err := http.NewRequest(method,u,body)
+	if err != nil{
+		return nil,err
+	}
+	if c.token != ""{
+		req.Header.Set("Authorization","Bearer "+c.token)
+	}
+	if c.hmacID != ""{
+		if err := cache.SignRequest(req,c.hmacID,c.hmacSecret);err != nil{
+			return nil,err
+		}
+	}
+	return c.send(req)
+}
+
+// send req and return the body, any non 2xx status is an error
+func (c *client)send(req *http.Request)([]byte,error){
+	res,err := c.http.Do(req)
+	if err != nil{
+		return nil,err
+	}
+	defer res.Body.Close()
+	data,err := io.ReadAll(res.Body)
+	if err != nil{
+		return nil,err
+	}
+	if res.StatusCode/100 != 2{
+		if len(data) > 0{
+			return nil,fmt.Errorf("%s: %s",res.Status,data)
+		}
+		return nil,fmt.Errorf("%s",res.Status)
+	}
+	return data,nil
+}
+
+// check if a flag was given on the command line
+func flagSet(name string)bool{
+	set := false
+	flag.Visit(func(f *flag.Flag){
+		if f.Name == name{
+			set = true
+		}
+	})
+	return set
+}
+
+func fail(err error){
+	fmt.Fprintln(os.Stderr,"gocache-cli:",err)
+	os.Exit(1)
+}
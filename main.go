@@ -2,10 +2,17 @@ package main
 
 import (
 	"cache"
+	"cache/config"
+	"context"
 	"flag"
 	"fmt"
 	"log"
+	"net/url"
+	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
+	"time"
 )
 
 // dummy db
@@ -17,24 +24,44 @@ var db = map[string]string{
 
 func main(){
 	// allowed user to decide if we want to start a api server
+	// flags override the config file, which overrides the defaults
+	var configPath string
 	var port int
 	var api bool
-	flag.IntVar(&port,"port",8001,"Cache server port")
+	var respPort int
+	var memcachedPort int
+	flag.StringVar(&configPath,"config","","Config file (.json, .yaml), defaults to a local 3 node cluster")
+	flag.IntVar(&port,"port",8001,"Cache server port, picks the peer with this port as self")
 	flag.BoolVar(&api,"api",false,"Start a api server?")
+	flag.IntVar(&respPort,"resp",0,"Redis protocol port, 0 to disable")
+	flag.IntVar(&memcachedPort,"memcached",0,"Memcached protocol port, 0 to disable")
 	flag.Parse()
 
-	// so there is where you place your 
-	apiAddr := "http://localhost:9999"
-	addrMap := map[int]string{
-		8001:"http://localhost:8001",
-		8002:"http://localhost:8002",
-		8003:"http://localhost:8003",
+	conf := config.Default()
+	if configPath != ""{
+		var err error
+		if conf,err = config.Load(configPath);err != nil{
+			log.Fatal(err)
+		}
+	}else if err := conf.ApplyEnv(os.LookupEnv);err != nil{
+		log.Fatal(err)
 	}
-
-	var addrs []string
-
-	for _,v := range addrMap{
-		addrs = append(addrs, v)
+	// only flags given on the command line override the config
+	flag.Visit(func(f *flag.Flag){
+		switch f.Name{
+		case "port":
+			conf.Listen = ":"+strconv.Itoa(port)
+			conf.Self = peerWithPort(conf.PeerAddrs(),port)
+		case "api":
+			conf.API.Enabled = api
+		case "resp":
+			conf.RESPListen = listenAddr(respPort)
+		case "memcached":
+			conf.MemcachedListen = listenAddr(memcachedPort)
+		}
+	})
+	if err := conf.Validate();err != nil{
+		log.Fatal(err)
 	}
 
 	// here is only a dummy getter function
@@ -44,18 +71,170 @@ func main(){
 		if v,ok := db[key];ok{
 			return []byte(v),nil;
 		}
-		return nil,fmt.Errorf("%s not exist",key)
+		return nil,fmt.Errorf("%s not exist: %w",key,cache.ErrNotFound)
 	})
-	// create a group
-	cacheGroup := cache.CreateGroup("scores",getterFn,2<<10)
+	// create the groups, the first one is served by the front ends
+	var cacheGroups []*cache.Group
+	for _,g := range conf.Groups{
+		opts := []cache.GroupOption{cache.WithTTL(time.Duration(g.TTL)),cache.WithReplicas(g.Replicas),
+			cache.WithHedging(g.HedgePercentile,time.Duration(g.HedgeMinDelay)),cache.WithMaxLoads(g.MaxLoads),
+			cache.WithMaxValueBytes(g.MaxValueBytes,g.Passthrough)}
+		if g.Storage == "slab"{
+			opts = append(opts, cache.WithSlabStorage())
+		}
+		if g.EntryOverhead > 0{
+			opts = append(opts, cache.WithEntryOverhead(g.EntryOverhead))
+		}
+		if g.MinBytes > 0{
+			opts = append(opts, cache.WithMinBytes(g.MinBytes))
+		}
+		if g.AdmissionHits > 1{
+			opts = append(opts, cache.WithAdmission(g.AdmissionHits,time.Duration(g.AdmissionWindow)))
+		}
+		if compressor,ok := cache.CompressorByName(g.Compression);ok{
+			opts = append(opts, cache.WithCompression(compressor,g.CompressionMinBytes))
+		}
+		cacheGroups = append(cacheGroups, cache.CreateGroup(g.Name,getterFn,g.CacheBytes,opts...))
+	}
+	cacheGroup := cacheGroups[0]
+	memoryPolicy,err := cache.MemoryPolicyByName(conf.MemoryPolicy)
+	if err != nil{
+		log.Fatal(err)
+	}
+	cache.SetMemoryPolicy(memoryPolicy)
+	cache.SetMemoryBudget(conf.MemoryBudget)
+	newSelector,err := cache.SelectorByName(conf.Selector)
+	if err != nil{
+		log.Fatal(err)
+	}
+	serverOpts := []cache.ServerOption{
+		cache.WithPeerSelector(newSelector),
+		cache.WithPeerTimeout(time.Duration(conf.Timeouts.PeerRequest)),
+		cache.WithServerTimeouts(time.Duration(conf.Timeouts.Read),time.Duration(conf.Timeouts.Write)),
+		cache.WithPeerWeights(conf.PeerWeights()),
+		cache.WithBoundedLoad(conf.LoadBound),
+		cache.WithHandoff(conf.HandoffRate),
+		cache.WithTLS(conf.TLS.CertFile,conf.TLS.KeyFile,conf.TLS.CAFile),
+		cache.WithPeerKeys(peerKeys(conf.PeerKeys)...),
+		cache.WithClientRateLimit(conf.Limits.ClientRate,conf.Limits.ClientBurst),
+		cache.WithGroupRateLimit(conf.Limits.GroupRate,conf.Limits.GroupBurst),
+		cache.WithLoadShedding(conf.Limits.PeerMaxInFlight,time.Duration(conf.Limits.PeerQueueTarget)),
+	}
+	// every front end we start is stopped again on SIGINT/SIGTERM
+	var stoppers []func(ctx context.Context)error
 	// create an API server
-	if api{
+	if conf.API.Enabled{
 		// since we use gin as our sever, we need to use "go" to start a new thread
 		// if we dont use go here, the thread will stuck and will not proceed to create local cache server
-		go cache.StartAPIServer(apiAddr,":9999",cacheGroup)
+		apiOpts := serverOpts
+		if conf.API.Auth.Enabled(){
+			apiOpts = append(apiOpts[:len(apiOpts):len(apiOpts)], apiAuth(conf.API.Auth))
+		}
+		apiServer,err := cache.NewAPIServer(conf.API.Addr,conf.API.Listen,cacheGroup,apiOpts...)
+		if err != nil{
+			log.Fatal(err)
+		}
+		go serve("API",apiServer.ListenAndServe)
+		stoppers = append(stoppers, apiServer.Shutdown)
+	}
+	// redis clients can talk to this node directly
+	if conf.RESPListen != ""{
+		respServer := cache.NewRESPServer(cacheGroup.Name())
+		go serve("RESP",func()error{return respServer.ListenAndServe(conf.RESPListen)})
+		stoppers = append(stoppers, func(context.Context)error{return respServer.Close()})
+	}
+	// so can memcached clients
+	if conf.MemcachedListen != ""{
+		memcachedServer := cache.NewMemcachedServer(cacheGroup)
+		go serve("Memcached",func()error{return memcachedServer.ListenAndServe(conf.MemcachedListen)})
+		stoppers = append(stoppers, func(context.Context)error{return memcachedServer.Close()})
 	}
 	
-	// start Cache server
-	cache.StartCacheServer(addrMap[port],":"+ strconv.Itoa(port),addrs,cacheGroup)
+	// start Cache server, it is stopped last so peers can still reach us while front ends drain
+	cacheServer,err := cache.NewCacheServer(conf.Self,conf.Listen,conf.PeerAddrs(),cacheGroup,serverOpts...)
+	if err != nil{
+		log.Fatal(err)
+	}
+	for _,g := range cacheGroups[1:]{
+		g.RegisterPeers(cacheServer.Peers())
+	}
+	go serve("Cache",cacheServer.ListenAndServe)
+	stoppers = append(stoppers, cacheServer.Shutdown)
+
+	// block until we are asked to stop
+	ctx,stop := signal.NotifyContext(context.Background(),syscall.SIGINT,syscall.SIGTERM)
+	<-ctx.Done()
+	stop()
+	log.Println("Shutting down")
+
+	shutdownCtx,cancel := context.WithTimeout(context.Background(),time.Duration(conf.Timeouts.Shutdown))
+	defer cancel()
+	for _,stopServer := range stoppers{
+		if err := stopServer(shutdownCtx);err != nil{
+			log.Println("Stop server failed:",err)
+		}
+	}
+	// wait for ongoing loads and run the cleanup hooks of every group
+	if err := cache.Shutdown(shutdownCtx);err != nil{
+		log.Println("Shutdown failed:",err)
+	}
+}
+
+// run a blocking server, exit the process if it can not serve
+func serve(name string,listenAndServe func()error){
+	if err := listenAndServe();err != nil{
+		log.Fatalf("%s server failed: %v",name,err)
+	}
 }
 
+// find the peer listening on port, so the same config can be shared by every local node
+func peerWithPort(peers []string,port int)string{
+	for _,peer := range peers{
+		if u,err := url.Parse(peer);err == nil && u.Port() == strconv.Itoa(port){
+			return peer
+		}
+	}
+	return "http://localhost:"+strconv.Itoa(port)
+}
+
+// secrets of peer request signing, in the order of the config
+func peerKeys(conf []config.HMACKeyConfig)[]cache.PeerKey{
+	keys := make([]cache.PeerKey,len(conf))
+	for i,k := range conf{
+		keys[i] = cache.PeerKey{ID: k.ID,Secret: []byte(k.Secret)}
+	}
+	return keys
+}
+
+// authenticate api callers with the configured tokens and hmac keys, and check them against the acl
+func apiAuth(conf config.AuthConfig)cache.ServerOption{
+	tokens := make(map[string]string,len(conf.Tokens))
+	for _,t := range conf.Tokens{
+		tokens[t.Token] = t.Principal
+	}
+	keys := make(map[string][]byte,len(conf.HMACKeys))
+	for _,k := range conf.HMACKeys{
+		keys[k.ID] = []byte(k.Secret)
+	}
+	// no rules lets every authenticated caller do everything
+	var acl *cache.ACL
+	if len(conf.ACL) > 0{
+		acl = cache.NewACL()
+		for _,rule := range conf.ACL{
+			// validated with the config
+			perm,_ := cache.ParsePermission(rule.Permission)
+			for _,group := range rule.Groups{
+				acl.Allow(rule.Principal,group,perm)
+			}
+		}
+	}
+	return cache.WithAuth(cache.ChainAuth(cache.NewTokenAuth(tokens),cache.NewHMACAuth(keys)),acl)
+}
+
+// port 0 disables a front end
+func listenAddr(port int)string{
+	if port == 0{
+		return ""
+	}
+	return ":"+strconv.Itoa(port)
+}
@@ -1,15 +1,18 @@
 #!/bin/bash
+# kill 0 sends SIGTERM to every node, which shuts them down gracefully
 trap "rm server;kill 0" EXIT
 
 go build -o server
-./server -port=8001 &
-./server -port=8002 &
-./server -port=8003 -api=1 &
+./server -config=config.example.yaml -port=8001 &
+./server -config=config.example.yaml -port=8002 &
+./server -config=config.example.yaml -port=8003 -api=1 &
 
 sleep 2
 echo ">>> start test"
-curl "http://localhost:9999/api?key=Tom" &
-curl "http://localhost:9999/api?key=Sam" &
-curl "http://localhost:9999/api?key=Jack" &
+# token of alice in config.example.yaml
+auth="Authorization: Bearer change-me"
+curl -H "$auth" "http://localhost:9999/api?key=Tom" &
+curl -H "$auth" "http://localhost:9999/api?key=Sam" &
+curl -H "$auth" "http://localhost:9999/api?key=Jack" &
 
 wait
\ No newline at end of file